@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// azureBlob is a destination for Azure Blob Storage, storing files as block blobs in a container.
+// Requests are authorized with either the Shared Key of the storage account, or a SAS token.
+type azureBlob struct {
+	endpoint  *url.URL // scheme, host and optional path (for emulators), eg https://account.blob.core.windows.net
+	account   string
+	key       []byte     // decoded shared key, nil if sas is used
+	sas       url.Values // shared access signature, added to each request, if key is nil
+	container string
+	path      string // starts and ends with slash
+	partSize  int    // in bytes, size of blocks for data files
+	inFlight  int    // max number of blocks uploading concurrently
+}
+
+var _ destination = &azureBlob{}
+var _ multipartUploader = &azureBlob{}
+
+const azureVersion = "2019-12-12"
+
+// delay between checks for completion of a server-side copy.
+var azureCopyPollDelay = time.Second
+
+// azureCanonicalResource returns the canonicalized resource for shared key authorization.
+func azureCanonicalResource(account, escapedPath string, query url.Values) string {
+	s := "/" + account + escapedPath
+	var keys []string
+	for k := range query {
+		keys = append(keys, strings.ToLower(k))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		s += "\n" + k + ":" + strings.Join(values, ",")
+	}
+	return s
+}
+
+// azureStringToSign returns the string to sign for shared key authorization.
+// The Content-Length must be passed separately, it is not in the header for outgoing requests.
+func azureStringToSign(method string, header http.Header, contentLength int64, canonicalResource string) string {
+	length := ""
+	if contentLength > 0 {
+		length = fmt.Sprintf("%d", contentLength)
+	}
+	var ms []string
+	for k, v := range header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-ms-") {
+			ms = append(ms, lk+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(ms)
+	headers := ""
+	for _, h := range ms {
+		headers += h + "\n"
+	}
+	return strings.Join([]string{
+		method,
+		header.Get("Content-Encoding"),
+		header.Get("Content-Language"),
+		length,
+		header.Get("Content-MD5"),
+		header.Get("Content-Type"),
+		header.Get("Date"),
+		header.Get("If-Modified-Since"),
+		header.Get("If-Match"),
+		header.Get("If-None-Match"),
+		header.Get("If-Unmodified-Since"),
+		header.Get("Range"),
+		headers + canonicalResource,
+	}, "\n")
+}
+
+// azureSignature returns the base64-encoded signature for stringToSign.
+func azureSignature(key []byte, stringToSign string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// url returns the url for blob (without leading slash) in our container, with optional query string, and the sas token if configured.
+func (r *azureBlob) url(blob string, query url.Values) *url.URL {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range r.sas {
+		q[k] = v
+	}
+	path := r.endpoint.Path + "/" + r.container
+	rawPath := r.endpoint.EscapedPath() + "/" + s3Escape(r.container, false)
+	if blob != "" {
+		path += "/" + blob
+		rawPath += "/" + s3Escape(blob, true)
+	}
+	return &url.URL{
+		Scheme:   r.endpoint.Scheme,
+		Host:     r.endpoint.Host,
+		Path:     path,
+		RawPath:  rawPath,
+		RawQuery: strings.Replace(q.Encode(), "+", "%20", -1),
+	}
+}
+
+// do authorizes and executes a request. On success, the response is returned and the
+// caller must close its body. On error, or if the status code is not
+// expectStatus, an error is returned and the response body is closed.
+func (r *azureBlob) do(method, blob string, query url.Values, header http.Header, body []byte, expectStatus int) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.url(blob, query).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	if r.key != nil {
+		cr := azureCanonicalResource(r.account, req.URL.EscapedPath(), req.URL.Query())
+		sig := azureSignature(r.key, azureStringToSign(method, req.Header, req.ContentLength, cr))
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", r.account, sig))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectStatus {
+		defer resp.Body.Close()
+		return nil, azureResponseError(resp, expectStatus)
+	}
+	return resp, nil
+}
+
+// azureXML parses an xml response body. Azure starts its xml with a byte order mark, which is skipped.
+func azureXML(r io.Reader, v interface{}) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading response: %s", err)
+	}
+	buf = bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))
+	return xml.Unmarshal(buf, v)
+}
+
+// azureResponseError returns an error for an unexpected http response, with the error code and message from the response, if any.
+func azureResponseError(resp *http.Response, expectStatus int) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if azureXML(io.LimitReader(resp.Body, 16*1024), &e) != nil || e.Code == "" {
+		// responses to HEAD requests have no body
+		e.Code = resp.Header.Get("x-ms-error-code")
+	}
+	detail := e.Code
+	if e.Message != "" {
+		detail += ": " + strings.TrimSpace(e.Message)
+	}
+	return &httpStatusError{"", expectStatus, resp.StatusCode, detail}
+}
+
+// List returns filenames, ordered by name.
+func (r *azureBlob) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *azureBlob) ListDir(dir string) (names []string, err error) {
+	prefix := r.path[1:]
+	if dir != "" {
+		prefix += dir + "/"
+	}
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := r.do("GET", "", query, nil, nil, 200)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", "/"+r.container+"/"+prefix, err)
+		}
+		var list struct {
+			Name       []string `xml:"Blobs>Blob>Name"`
+			NextMarker string
+		}
+		err = azureXML(resp.Body, &list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing directory contents xml: %s", err)
+		}
+		for _, name := range list.Name {
+			if !strings.HasPrefix(name, prefix) {
+				return nil, fmt.Errorf("listing %s: blob %q does not have requested prefix", "/"+r.container+"/"+prefix, name)
+			}
+			names = append(names, name[len(prefix):])
+		}
+		if list.NextMarker == "" {
+			break
+		}
+		if list.NextMarker == marker {
+			return nil, fmt.Errorf("listing %s: next marker %q did not change", "/"+r.container+"/"+prefix, marker)
+		}
+		marker = list.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *azureBlob) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *azureBlob) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	var header http.Header
+	expect := 200
+	if rng := httpRange(offset, length); rng != "" {
+		header = http.Header{"Range": {rng}}
+		expect = 206
+	}
+	resp, err := r.do("GET", r.path[1:]+path, nil, header, nil, expect)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+// Create returns a writer that stages blocks of partSize and commits them
+// when closed. Small files are uploaded in a single request.
+func (r *azureBlob) Create(path string) (w io.WriteCloser, err error) {
+	return newMultipartWriter(r, path, r.partSize, r.inFlight), nil
+}
+
+func (r *azureBlob) putObject(path string, buf []byte) error {
+	if buf == nil {
+		buf = []byte{}
+	}
+	header := http.Header{"x-ms-blob-type": {"BlockBlob"}}
+	resp, err := r.do("PUT", r.path[1:]+path, nil, header, buf, 201)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
+
+// initUpload returns a random prefix for the block ids of this upload.
+// Azure has no explicit start of an upload, blocks are staged for a blob
+// until a block list is committed.
+func (r *azureBlob) initUpload(path string) (uploadID string, err error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// azureBlockID returns the block id for a part. All block ids of a blob must have the same length.
+func azureBlockID(uploadID string, partNumber int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%05d", uploadID, partNumber)))
+}
+
+func (r *azureBlob) uploadPart(path, uploadID string, partNumber int, buf []byte) (etag string, err error) {
+	id := azureBlockID(uploadID, partNumber)
+	query := url.Values{
+		"comp":    {"block"},
+		"blockid": {id},
+	}
+	resp, err := r.do("PUT", r.path[1:]+path, query, nil, buf, 201)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return id, nil
+}
+
+func (r *azureBlob) completeUpload(path, uploadID string, etags []string) error {
+	var list struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string
+	}
+	list.Latest = etags
+	buf, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do("PUT", r.path[1:]+path, url.Values{"comp": {"blocklist"}}, nil, buf, 201)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// abortUpload does nothing, staged blocks that are never committed are removed by Azure after a week.
+func (r *azureBlob) abortUpload(path, uploadID string) error {
+	return nil
+}
+
+// Rename copies the file to the new name at the server, then removes the original.
+// Copies within a storage account are usually done before the response is sent, otherwise we wait for it to finish.
+func (r *azureBlob) Rename(opath, npath string) (err error) {
+	header := http.Header{"x-ms-copy-source": {r.url(r.path[1:]+opath, nil).String()}}
+	resp, err := r.do("PUT", r.path[1:]+npath, nil, header, nil, 202)
+	if err != nil {
+		return fmt.Errorf("copying resource: %w", err)
+	}
+	resp.Body.Close()
+	for status := resp.Header.Get("x-ms-copy-status"); status != "success"; status = resp.Header.Get("x-ms-copy-status") {
+		if status != "pending" {
+			return fmt.Errorf("copying resource: copy status %q: %s", status, resp.Header.Get("x-ms-copy-status-description"))
+		}
+		time.Sleep(azureCopyPollDelay)
+		resp, err = r.do("HEAD", r.path[1:]+npath, nil, nil, nil, 200)
+		if err != nil {
+			return fmt.Errorf("checking copy status: %w", err)
+		}
+		resp.Body.Close()
+	}
+
+	err = r.Delete(opath)
+	if err != nil {
+		return fmt.Errorf("deleting original resource after copying: %w", err)
+	}
+	return nil
+}
+
+func (r *azureBlob) Delete(path string) (err error) {
+	resp, err := r.do("DELETE", r.path[1:]+path, nil, nil, nil, 202)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
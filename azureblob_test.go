@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure is a minimal server for the Azure Blob Storage REST API, for a single
+// container. Requests must be authorized with the shared key, or with the sas
+// token (only its signature is checked).
+type fakeAzure struct {
+	account    string
+	key        []byte
+	sas        string
+	container  string
+	maxResults int
+
+	sync.Mutex
+	blobs         map[string][]byte
+	blocks        map[string]map[string][]byte // uncommitted blocks, per blob
+	pendingCopies int                          // number of copies that report "pending" first
+	copying       map[string]bool              // pending copies, reported as done on the next HEAD
+	down          bool                         // if set, all requests fail with a server error
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{
+		account:    "testaccount",
+		key:        []byte("test key of the storage account"),
+		sas:        "sv=2019-12-12&ss=b&srt=co&sp=rwdlac&sig=dGVzdCBzaWduYXR1cmU%3D",
+		container:  "backups",
+		maxResults: 5000,
+		blobs:      map[string][]byte{},
+		blocks:     map[string]map[string][]byte{},
+		copying:    map[string]bool{},
+	}
+}
+
+func (s *fakeAzure) verify(r *http.Request) error {
+	date, err := time.Parse(http.TimeFormat, r.Header.Get("x-ms-date"))
+	if err != nil {
+		return fmt.Errorf("bad x-ms-date header: %s", err)
+	}
+	if d := time.Since(date); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("date too far off")
+	}
+	if r.Header.Get("x-ms-version") == "" {
+		return fmt.Errorf("missing x-ms-version")
+	}
+
+	q := r.URL.Query()
+	if sig := q.Get("sig"); sig != "" {
+		sas, _ := url.ParseQuery(s.sas)
+		if sig != sas.Get("sig") {
+			return fmt.Errorf("bad sas signature")
+		}
+		return nil
+	}
+
+	length := ""
+	if r.ContentLength > 0 {
+		length = fmt.Sprint(r.ContentLength)
+	}
+	msg := r.Method + "\n\n\n" + length + "\n\n\n\n\n\n\n\n" + r.Header.Get("Range") + "\n"
+	var ms []string
+	for k := range r.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			ms = append(ms, k+":"+r.Header.Get(k)+"\n")
+		}
+	}
+	sort.Strings(ms)
+	msg += strings.Join(ms, "")
+	msg += "/" + s.account + r.URL.EscapedPath()
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg += "\n" + k + ":" + q.Get(k)
+	}
+
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(msg))
+	exp := fmt.Sprintf("SharedKey %s:%s", s.account, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if auth := r.Header.Get("Authorization"); auth != exp {
+		return fmt.Errorf("bad shared key signature")
+	}
+	return nil
+}
+
+func (s *fakeAzure) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>fake error</Message></Error>", code)
+}
+
+func (s *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.down {
+		s.error(w, http.StatusServiceUnavailable, "ServerBusy")
+		return
+	}
+	if err := s.verify(r); err != nil {
+		s.error(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	q := r.URL.Query()
+	if r.URL.Path == "/"+s.container && q.Get("restype") == "container" && q.Get("comp") == "list" && r.Method == "GET" {
+		prefix := q.Get("prefix")
+		delim := q.Get("delimiter")
+		var names []string
+		for k := range s.blobs {
+			if strings.HasPrefix(k, prefix) && k >= q.Get("marker") && (delim == "" || !strings.Contains(k[len(prefix):], delim)) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		var result struct {
+			XMLName    xml.Name `xml:"EnumerationResults"`
+			Name       []string `xml:"Blobs>Blob>Name"`
+			NextMarker string
+		}
+		if len(names) > s.maxResults {
+			// the marker is opaque, we use the first name of the next page
+			result.NextMarker = names[s.maxResults]
+			names = names[:s.maxResults]
+		}
+		result.Name = names
+		w.Write([]byte("\xef\xbb\xbf"))
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+s.container+"/") {
+		s.error(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	blob := r.URL.Path[len("/"+s.container+"/"):]
+
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		buf, ok := s.blobs[blob]
+		if !ok {
+			s.error(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if r.Method == "HEAD" {
+			delete(s.copying, blob)
+			w.Header().Set("x-ms-copy-status", "success")
+			return
+		}
+		// handles range requests
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	case r.Method == "PUT" && q.Get("comp") == "block":
+		id := q.Get("blockid")
+		if _, err := base64.StdEncoding.DecodeString(id); err != nil || id == "" {
+			s.error(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		for other := range s.blocks[blob] {
+			if len(other) != len(id) {
+				s.error(w, http.StatusBadRequest, "InvalidBlobOrBlock")
+				return
+			}
+		}
+		if s.blocks[blob] == nil {
+			s.blocks[blob] = map[string][]byte{}
+		}
+		s.blocks[blob][id] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			s.error(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var buf []byte
+		for _, id := range list.Latest {
+			block, ok := s.blocks[blob][id]
+			if !ok {
+				s.error(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			buf = append(buf, block...)
+		}
+		delete(s.blocks, blob)
+		s.blobs[blob] = buf
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && r.Header.Get("x-ms-copy-source") != "":
+		u, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+		if err != nil || u.Host != r.Host || !strings.HasPrefix(u.Path, "/"+s.container+"/") {
+			s.error(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		buf, ok := s.blobs[u.Path[len("/"+s.container+"/"):]]
+		if !ok {
+			s.error(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		s.blobs[blob] = buf
+		status := "success"
+		if s.pendingCopies > 0 {
+			s.pendingCopies--
+			s.copying[blob] = true
+			status = "pending"
+		}
+		w.Header().Set("x-ms-copy-status", status)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+		s.blobs[blob] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE":
+		if _, ok := s.blobs[blob]; !ok {
+			s.error(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(s.blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.error(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// newFakeAzureBlob returns a destination for the fake server at serverURL, with shared key or sas authorization.
+func newFakeAzureBlob(t *testing.T, fake *fakeAzure, serverURL string, useSAS bool) *azureBlob {
+	endpoint, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("parsing url: %s", err)
+	}
+	r := &azureBlob{endpoint: endpoint, account: fake.account, container: fake.container, path: "/host/", partSize: 10, inFlight: 2}
+	if useSAS {
+		r.sas, err = url.ParseQuery(fake.sas)
+		if err != nil {
+			t.Fatalf("parsing sas: %s", err)
+		}
+	} else {
+		r.key = fake.key
+	}
+	return r
+}
+
+func TestAzureBlob(t *testing.T) {
+	for _, useSAS := range []bool{false, true} {
+		fake := newFakeAzure()
+		fake.maxResults = 2 // force paginated listings
+		fake.pendingCopies = 1
+		server := httptest.NewServer(fake)
+		r := newFakeAzureBlob(t, fake, server.URL, useSAS)
+
+		defer func(d time.Duration) {
+			azureCopyPollDelay = d
+		}(azureCopyPollDelay)
+		azureCopyPollDelay = time.Millisecond
+
+		fake.blobs["host/nested/ignored"] = []byte("x")
+		fake.blobs["elsewhere"] = []byte("x")
+
+		write := func(path, data string) {
+			t.Helper()
+			w, err := r.Create(path)
+			if err != nil {
+				t.Fatalf("create %s: %s", path, err)
+			}
+			if _, err := w.Write([]byte(data)); err != nil {
+				t.Fatalf("write %s: %s", path, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close %s: %s", path, err)
+			}
+		}
+
+		data := "0123456789abcdefghijklmnopqrstuvwxyz" // staged in 4 blocks
+		write("20171222-0001.data", data)
+		if string(fake.blobs["host/20171222-0001.data"]) != data || len(fake.blocks) != 0 {
+			t.Errorf("blocks not committed")
+		}
+		write("20171222-0001.index1.full.tmp", "small+file")
+		write("20171222-0002.data", "")
+		write("name with space", "x")
+
+		names, err := r.List()
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		exp := []string{"20171222-0001.data", "20171222-0001.index1.full.tmp", "20171222-0002.data", "name with space"}
+		if strings.Join(names, ",") != strings.Join(exp, ",") {
+			t.Errorf("list, got %v, expected %v", names, exp)
+		}
+
+		rc, err := r.OpenRange("20171222-0001.data", 10, 5)
+		if err != nil {
+			t.Fatalf("open range: %s", err)
+		}
+		buf, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(buf) != "abcde" {
+			t.Errorf("read range, got %q, %v", buf, err)
+		}
+
+		// the copy is pending at first
+		if err := r.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+			t.Fatalf("rename: %s", err)
+		}
+		if len(fake.copying) != 0 {
+			t.Errorf("rename did not wait for pending copy")
+		}
+		if _, err := r.Open("20171222-0001.index1.full.tmp"); err == nil || !strings.Contains(err.Error(), "BlobNotFound") {
+			t.Errorf("open of renamed file, got %v, expected BlobNotFound", err)
+		}
+		if err := r.Delete("name with space"); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+		if string(fake.blobs["host/20171222-0001.index1.full"]) != "small+file" || fake.blobs["host/name with space"] != nil {
+			t.Errorf("unexpected blobs at server after rename and delete")
+		}
+
+		testDestinationDir(t, r)
+
+		if useSAS {
+			r.sas.Set("sig", "bad")
+		} else {
+			r.key = []byte("bad")
+		}
+		if _, err := r.List(); err == nil {
+			t.Errorf("list with bad credentials succeeded")
+		}
+		server.Close()
+	}
+}
+
+// TestAzureBlobBackups runs the backup tests against the fake Azure server.
+func TestAzureBlobBackups(t *testing.T) {
+	fake := newFakeAzure()
+	fake.maxResults = 3 // force paginated listings
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	setMain := func(c *configuration) {
+		c.Kind = "azureblob"
+		c.AzureBlob.Endpoint = server.URL
+		c.AzureBlob.Account = fake.account
+		c.AzureBlob.Key = base64.StdEncoding.EncodeToString(fake.key)
+		c.AzureBlob.Container = fake.container
+		c.AzureBlob.Path = "/host/"
+		c.Retries = -1 // the server going down is not temporary
+	}
+	testBackups(t, setMain, markDown(fake, &fake.down))
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -14,55 +18,62 @@ import (
 	"syscall"
 )
 
-func backupCmd(args []string, name string) {
+// walkHook is called for each path visited during a backup, before its contents
+// are read. Tests use it to change files while they are being backed up.
+var walkHook = func(path string) {}
+
+// backupCmd makes a new backup. With "continueOnError", files that cannot be
+// read are left out, and it returns whether that happened.
+func backupCmd(args []string, name string) (partial bool) {
 	fs := flag.NewFlagSet("backup", flag.ExitOnError)
 	fs.Usage = func() {
 		log.Println("usage: bolong [flags] backup [flags] [directory]")
 		fs.PrintDefaults()
 	}
 	verbose := fs.Bool("verbose", false, "print files being backed up")
+	continueOnError := fs.Bool("continue-on-error", false, `leave out files that cannot be read, instead of failing, and exit with status 3; also enabled by config field "continueOnError"`)
+	hashMode := fs.String("hash", "", `detect changed files by their sha256 hash too: "always" reads all files, "ctime" only files with a changed ctime, "none" disables; overrides config field "hash"`)
 	fs.Parse(args)
 	args = fs.Args()
 
-	dir := "."
-	switch len(args) {
-	case 0:
-	case 1:
-		dir = args[0]
+	includes := compileRegexps("include", config.Include)
+	excludes := compileRegexps("exclude", config.Exclude)
+	var sources []*source
+	switch {
+	case len(config.Sources) > 0 && len(args) == 0:
+		for _, sc := range config.Sources {
+			src := &source{
+				name:     sc.Name,
+				dir:      sourceDir(sc.Path),
+				includes: append(compileRegexps("include", sc.Include), includes...),
+				excludes: append(compileRegexps("exclude", sc.Exclude), excludes...),
+			}
+			sources = append(sources, src)
+		}
+	case len(config.Sources) > 0:
+		log.Fatalln(`cannot backup a directory, config has "sources"`)
+	case len(args) == 0:
+		sources = []*source{{dir: sourceDir("."), includes: includes, excludes: excludes}}
+	case len(args) == 1:
+		sources = []*source{{dir: sourceDir(args[0]), includes: includes, excludes: excludes}}
 	default:
 		fs.Usage()
 		os.Exit(2)
 	}
 
-	includes := []*regexp.Regexp{}
-	for _, s := range config.Include {
-		re, err := regexp.Compile(s)
-		if err != nil {
-			log.Fatalf("bad include regexp %s: %s", s, err)
-		}
-		includes = append(includes, re)
-	}
-	excludes := []*regexp.Regexp{}
-	for _, s := range config.Exclude {
-		re, err := regexp.Compile(s)
-		if err != nil {
-			log.Fatalf("bad exclude regexp %s: %s", s, err)
-		}
-		excludes = append(excludes, re)
+	mode := config.Hash
+	switch *hashMode {
+	case "":
+	case "none":
+		mode = ""
+	case "ctime", "always":
+		mode = *hashMode
+	default:
+		log.Fatalf(`bad value %q for -hash, must be "none", "ctime" or "always"`, *hashMode)
 	}
+	hashPaths := compileRegexps("hashPaths", config.HashPaths)
 
-	info, err := os.Stat(dir)
-	check(err, "stat backup dir")
-	if !info.IsDir() {
-		log.Fatal("can only backup directories")
-	}
-	if dir == "." {
-		dir, err = os.Getwd()
-		check(err, `resolving "."`)
-	}
-	if !strings.HasSuffix(dir, "/") {
-		dir += "/"
-	}
+	var err error
 
 	// incremental backups list the previous incr/full backups that need files from
 	// so we have to do some bookkeeping when we do an incremental backup, only keeping index files of previous backups that still have a file we need.
@@ -75,25 +86,33 @@ func backupCmd(args []string, name string) {
 	nidx := &index{}
 	var oidx *index
 	unseen := map[string]*file{}
+	previousFiles := map[string]*file{} // by name, for hard links to files kept from the previous backup
 	incremental := false
 	if config.IncrementalsPerFull > 0 {
 		// backups will be all incremental backups (most recent first), leading to the first full backup (also included)
 		backups, err := findBackupChain("latest")
 		if err == nil {
 			incremental = len(backups)-1 < config.IncrementalsPerFull
+			if m, ok := store.(*mirrored); ok && incremental {
+				if mm, b := m.missing(backups); mm != nil {
+					log.Printf("mirror %s does not have previous backup %s, making a full backup\n", mm.name, b.name)
+					incremental = false
+				}
+			}
 			if incremental {
 				b := backups[0]
 				oidx, err = readIndex(b)
 				check(err, "parsing previous index file")
 				for _, f := range oidx.contents {
 					unseen[f.name] = f
+					previousFiles[f.name] = f
 				}
 
 				earliers = make([]earlier, len(oidx.previous)+1)
 				for i, p := range oidx.previous {
 					earliers[i] = earlier{p, false}
 				}
-				earliers[len(earliers)-1] = earlier{previous{true, b.name, oidx.dataSize}, false}
+				earliers[len(earliers)-1] = earlier{previous{b.incremental, b.name, oidx.dataSize}, false}
 			}
 		} else if err == errNotFound {
 			// do first full
@@ -104,7 +123,7 @@ func backupCmd(args []string, name string) {
 
 	// keep track of the paths we've created at remote, so we can clean up them up when we are interrupted.
 	partialpaths := make(chan string)
-	cleanup := make(chan os.Signal)
+	cleanup := make(chan os.Signal, 1)
 	signal.Notify(cleanup, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		var paths []string
@@ -123,12 +142,15 @@ func backupCmd(args []string, name string) {
 					os.Exit(1)
 				}
 				cleaning = true
+				// files being written to local destinations only exist under a temporary name
+				abortLocalWrites(store)
+				abortUploads()
 				done := make(chan struct{})
 				for _, path := range paths {
 					go func(path string) {
 						log.Println("cleaning up remote path", path)
 						err := store.Delete(path)
-						if err != nil {
+						if err != nil && !errors.Is(err, os.ErrNotExist) {
 							log.Println("failed to cleanup remote path:", err)
 						}
 						done <- struct{}{}
@@ -142,6 +164,12 @@ func backupCmd(args []string, name string) {
 		}
 	}()
 
+	var chunks *chunkStore
+	if config.Dedup {
+		chunks, err = newChunkStore(partialpaths)
+		check(err, "preparing chunks")
+	}
+
 	dataPath := fmt.Sprintf("%s.data", name)
 	var data io.WriteCloser
 	data, err = store.Create(dataPath)
@@ -149,37 +177,166 @@ func backupCmd(args []string, name string) {
 	partialpaths <- dataPath
 	dwc := &writeCounter{f: data}
 	data = dwc
-	data, err = newSafeWriter(data)
+	sdata, err := newSafeWriter(data)
 	check(err, "creating safe file")
+	data = sdata
 
-	var whitelist []string // whitelisted directories. all children files will be included.
+	var src *source                 // being walked
+	links := map[[2]uint64]string{} // device and inode of files with multiple hard links, to the first path
+	var whitelist []string          // whitelisted directories. all children files will be included.
+	var ignores []*ignoreFile       // of the directories of the path being walked
 	dataOffset := int64(0)
 	nfiles := 0
-	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatalf("error walking %s: %s\n", path, err)
+
+	skipFilesystems := map[string]bool{}
+	for _, t := range config.SkipFilesystems {
+		skipFilesystems[t] = true
+	}
+	fsTypes := map[uint64]string{} // by device, for mount points
+
+	excludeExts := excludeExtensions(config.ExcludeKinds)
+	maxSize := int64(config.MaxFileSize) * 1024 * 1024
+	var (
+		ncaches, nlarge, nkind int // cache directories, and files skipped for their size or kind
+		largeSize, kindSize    int64
+	)
+
+	// skipMount returns whether the contents of directory path should not be backed up, because it is a mount point of another file system.
+	skipMount := func(path string, info os.FileInfo) bool {
+		dev, ok := fileDevice(info)
+		if !ok || dev == src.dev {
+			return false
 		}
-		if !strings.HasPrefix(path, dir) {
-			log.Printf("path not prefixed by dir? path %s, dir %s\n", path, dir)
-			return nil
+		if config.OneFileSystem {
+			return true
 		}
-		relpath := path[len(dir):]
-		matchPath := relpath
-		if relpath == "" {
-			relpath = "."
+		if len(skipFilesystems) == 0 {
+			return false
 		}
-		if relpath == ".bolong.json" || strings.HasSuffix(relpath, "/.bolong.json") {
-			return nil
+		t, ok := fsTypes[dev]
+		if !ok {
+			var err error
+			t, err = fsType(path)
+			if err != nil {
+				log.Fatalf("%s\n", err)
+			}
+			fsTypes[dev] = t
 		}
-		if info.IsDir() && matchPath != "" {
-			matchPath += "/"
+		return skipFilesystems[t]
+	}
+
+	// with "onChange" other than "fail", files that vanish or change while being backed up don't fail the backup.
+	tolerant := config.OnChange != "" && config.OnChange != "fail"
+	changeRetries := config.ChangeRetries
+	if changeRetries == 0 {
+		changeRetries = 3
+	}
+	var inconsistent []string // files that changed or vanished, with the reason
+	vanished := func(err error) bool {
+		return tolerant && errors.Is(err, os.ErrNotExist)
+	}
+	// removeFile removes nf, the last file added to the new index.
+	removeFile := func(nf, of *file, info os.FileInfo) {
+		nidx.contents = nidx.contents[:len(nidx.contents)-1]
+		nfiles--
+		if of != nil {
+			unseen[nf.name] = of
+		} else if n := len(nidx.add); n > 0 && nidx.add[n-1] == nf.name {
+			nidx.add = nidx.add[:n-1]
+		}
+		if dev, ino, ok := hardLinkID(info); ok && links[[2]uint64{dev, ino}] == nf.name {
+			delete(links, [2]uint64{dev, ino})
+		}
+	}
+	// dropFile removes nf, for a file that vanished or changed.
+	dropFile := func(nf, of *file, info os.FileInfo, reason string) {
+		log.Printf("warning: %s %s, not backing it up\n", nf.name, reason)
+		inconsistent = append(inconsistent, nf.name+": "+reason+", skipped")
+		removeFile(nf, of, info)
+	}
+
+	// usePrevious makes nf, which is unchanged, reference the contents of of in an earlier backup.
+	usePrevious := func(nf, of *file) {
+		if nf.hardLink() {
+			// no contents, the link is the same as in the previous backup
+		} else if of.chunked() {
+			// chunks are not in a data file, they don't reference a previous backup
+			nf.dataOffset = chunkedOffset
+			nf.chunks = of.chunks
+		} else if !nf.isDir && nf.special == 0 {
+			nf.dataOffset = of.dataOffset
+			// these indices are against the index file from the previous incremental backup.
+			// we fix up these indices later on, after we know which previous backups are still referenced.
+			prevIndex := of.previousIndex
+			if prevIndex == -1 {
+				// files contained in the last index are now in the new previous-index-reference
+				prevIndex = len(earliers) - 1
+			}
+			nf.previousIndex = prevIndex
+			earliers[prevIndex].used = true
 		}
+	}
+
+	keepGoing := config.ContinueOnError || *continueOnError
+	var failures []string // files left out because of errors, with the error
+	// keepPrevious adds the files from the previous backup with name, or below
+	// it, to the new index, for files that could not be read. Hard links to a
+	// file that is not kept along with them become copies of that file, it may
+	// not be in the new backup, or with other contents.
+	keepPrevious := func(name string) {
+		var l []*file
+		for n, of := range unseen {
+			if n == name || name == "." || strings.HasPrefix(n, name+"/") {
+				l = append(l, of)
+			}
+		}
+		// parent directories first
+		sort.Slice(l, func(i, j int) bool {
+			return l[i].name < l[j].name
+		})
+		kept := map[string]bool{}
+		for _, of := range l {
+			delete(unseen, of.name)
+			kept[of.name] = true
+			if of.hardLink() && !kept[of.link] {
+				of = previousFiles[of.link].linkCopy(of)
+			}
+			nf := *of
+			usePrevious(&nf, of)
+			nidx.contents = append(nidx.contents, &nf)
+			nfiles++
+		}
+	}
+	// failFile handles err for file nf, the last file added to the new index.
+	// Unless "continueOnError" is set, the backup fails. Otherwise the file is
+	// left out, or the version from the previous backup is kept. The returned
+	// error is for the walk.
+	failFile := func(path string, nf, of *file, info os.FileInfo, err error) error {
+		if !keepGoing {
+			log.Fatalf("%s: %s\n", path, err)
+		}
+		log.Printf("error: %s: %s, not backing it up\n", nf.name, err)
+		failures = append(failures, nf.name+": "+err.Error())
+		removeFile(nf, of, info)
+		keepPrevious(nf.name)
+		if nf.isDir {
+			// the contents from the previous backup have been kept too
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// skipped returns whether the file at matchPath is left out by "include",
+	// "exclude" or an ignore file. With maybeDir, for a file that could not be
+	// stat'ed, it is also left out if it would be as a directory.
+	skipped := func(matchPath string, isDir, maybeDir bool) bool {
+		includes, excludes := src.includes, src.excludes
 		if len(includes) > 0 {
 			match := matchAny(includes, matchPath)
-			if match && info.IsDir() {
+			if match && isDir {
 				whitelist = append(whitelist, matchPath)
 			}
-			if !match && !info.IsDir() {
+			if !match && !isDir {
 				keep := false
 				for _, white := range whitelist {
 					if strings.HasPrefix(matchPath, white) {
@@ -191,62 +348,237 @@ func backupCmd(args []string, name string) {
 					if *verbose {
 						log.Println(`no "include" match, skipping`, matchPath)
 					}
-					return nil
+					return true
 				}
 			}
 		}
 		if len(excludes) > 0 {
-			match := matchAny(excludes, matchPath)
+			match := matchAny(excludes, matchPath) || maybeDir && matchAny(excludes, matchPath+"/")
 			if match {
 				if *verbose {
 					log.Println(`"exclude" match, skipping`, matchPath)
 				}
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
+				return true
+			}
+		}
+		for len(ignores) > 0 && !strings.HasPrefix(matchPath, ignores[len(ignores)-1].dir) {
+			ignores = ignores[:len(ignores)-1]
+		}
+		if matchPath != "" && (ignored(ignores, matchPath, isDir) || maybeDir && ignored(ignores, matchPath+"/", true)) {
+			if *verbose {
+				log.Println(ignoreName+" match, skipping", matchPath)
+			}
+			return true
+		}
+		return false
+	}
+
+	walk := func(path string, info os.FileInfo, err error) error {
+		var unreadable error // for directories whose contents could not be read
+		if !strings.HasPrefix(path, src.dir) {
+			log.Printf("path not prefixed by dir? path %s, dir %s\n", path, src.dir)
+			return nil
+		}
+		walkHook(path)
+		relpath := path[len(src.dir):]
+		matchPath := relpath
+		if relpath == "" {
+			relpath = "."
+		}
+		if relpath == ".bolong.json" || strings.HasSuffix(relpath, "/.bolong.json") {
+			return nil
+		}
+		if src.name != "" {
+			// paths of sources are namespaced by the source name, the include/exclude regexps match without
+			if relpath == "." {
+				relpath = src.name
+			} else {
+				relpath = src.name + "/" + relpath
+			}
+		}
+		if err != nil && (info == nil || !info.IsDir() || vanished(err)) {
+			// the file could not be stat'ed, or is gone. only a problem if it would
+			// have been backed up. without stat, we don't know if it was a directory,
+			// being left out as either is enough.
+			isDir := info != nil && info.IsDir()
+			skipPath := matchPath
+			if isDir && matchPath != "" {
+				skipPath += "/"
+			}
+			if skipped(skipPath, isDir, info == nil && matchPath != "") {
 				return nil
 			}
+			if vanished(err) {
+				log.Printf("warning: %s vanished, not backing it up\n", path)
+				inconsistent = append(inconsistent, relpath+": vanished, skipped")
+				return nil
+			} else if !keepGoing {
+				log.Fatalf("error walking %s: %s\n", path, err)
+			}
+			log.Printf("error: %s, not backing it up\n", err)
+			failures = append(failures, relpath+": "+err.Error())
+			keepPrevious(relpath)
+			return nil
+		} else if err != nil {
+			// the directory itself is backed up below, for its contents the versions from the previous backup are kept
+			// the error is recorded below, unless the directory is excluded or its contents skipped
+			unreadable = err
+		}
+		if info.IsDir() && matchPath != "" {
+			matchPath += "/"
+		}
+		if skipped(matchPath, info.IsDir(), false) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// for mount points that are skipped, the directory is stored, so restore recreates it, but not its contents
+		var next error
+		if info.IsDir() && matchPath == "" {
+			src.dev, _ = fileDevice(info)
+		}
+		if info.IsDir() && matchPath != "" && skipMount(path, info) {
+			if *verbose {
+				log.Println("other file system, skipping contents of", matchPath)
+			}
+			next = filepath.SkipDir
+		} else if info.IsDir() && matchPath != "" && config.ExcludeCaches {
+			cache, err := cacheDir(path)
+			if err != nil && !keepGoing {
+				log.Fatalf("%s: %s\n", path, err)
+			} else if err != nil {
+				// probably the directory can't be read, which fails below
+				log.Printf("error: %s: %s\n", path, err)
+			}
+			if cache {
+				if *verbose {
+					log.Println("cache directory, skipping contents of", matchPath)
+				}
+				ncaches++
+				next = filepath.SkipDir
+			}
+		}
+		if unreadable != nil && next != nil {
+			// contents are skipped anyway
+			unreadable = nil
+		} else if unreadable != nil && !keepGoing {
+			log.Fatalf("error walking %s: %s\n", path, unreadable)
+		} else if unreadable != nil {
+			log.Printf("error: %s, not backing up its contents\n", unreadable)
+			failures = append(failures, relpath+": "+unreadable.Error())
+			next = filepath.SkipDir
+		}
+		if info.IsDir() && next == nil {
+			igf, err := readIgnoreFile(path, matchPath)
+			if err != nil && !keepGoing {
+				log.Fatalf("%s\n", err)
+			} else if err != nil {
+				log.Printf("error: %s, backing up directory without it\n", err)
+				failures = append(failures, relpath+": "+err.Error())
+			}
+			if igf != nil {
+				ignores = append(ignores, igf)
+			}
 		}
 
+		special := info.Mode() & (os.ModeNamedPipe | os.ModeSocket | os.ModeDevice | os.ModeCharDevice)
+		if info.Mode()&os.ModeIrregular != 0 || special != 0 && config.SkipSpecial {
+			if *verbose {
+				log.Println("special file, skipping", matchPath)
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			if maxSize > 0 && info.Size() > maxSize {
+				if *verbose {
+					log.Printf("larger than %dMB, skipping %s\n", config.MaxFileSize, matchPath)
+				}
+				nlarge++
+				largeSize += info.Size()
+				return nil
+			}
+			if _, ok := excludeExts[strings.ToLower(filepath.Ext(matchPath))]; ok {
+				if *verbose {
+					log.Println(`"excludeKinds" match, skipping`, matchPath)
+				}
+				nkind++
+				kindSize += info.Size()
+				return nil
+			}
+		}
 		size := int64(0)
-		if !info.IsDir() {
+		if !info.IsDir() && special == 0 {
 			size = info.Size()
 		}
 		owner, group := userGroupName(info)
 		nf := &file{
-			info.IsDir(),
-			info.Mode()&os.ModeSymlink != 0,
-			info.Mode() & os.ModePerm,
-			info.ModTime(),
-			size,
-			owner,
-			group,
-			-1, // data offset
-			-1, // previous index, possibly updated later
-			relpath,
+			isDir:         info.IsDir(),
+			isSymlink:     info.Mode()&os.ModeSymlink != 0,
+			permissions:   info.Mode() & os.ModePerm,
+			mtime:         info.ModTime(),
+			size:          size,
+			user:          owner,
+			group:         group,
+			dataOffset:    -1,
+			previousIndex: -1, // possibly updated later
+			name:          relpath,
+			special:       special, // for fifos, sockets and devices
+		}
+		if special&os.ModeDevice != 0 {
+			nf.major, nf.minor = deviceNumbers(info)
+		}
+		if dev, ino, ok := hardLinkID(info); ok {
+			id := [2]uint64{dev, ino}
+			if first, ok := links[id]; ok {
+				// contents are stored once, for the first path
+				nf.dataOffset = linkOffset
+				nf.link = first
+			} else {
+				links[id] = relpath
+			}
+		}
+		hashing := mode != "" && info.Mode().IsRegular() && !nf.hardLink() && (len(hashPaths) == 0 || matchAny(hashPaths, matchPath))
+		if hashing {
+			nf.ctime = fileCtime(info)
 		}
 
 		nidx.contents = append(nidx.contents, nf)
 		nfiles++
 
+		of := unseen[relpath] // from previous backup
+		delete(unseen, relpath)
+		if config.Xattrs {
+			nf.xattrs, err = readXattrs(path)
+			if vanished(err) {
+				dropFile(nf, of, info, "vanished")
+				return nil
+			} else if err != nil {
+				return failFile(path, nf, of, info, err)
+			}
+		}
+		if unreadable != nil {
+			keepPrevious(relpath)
+		}
 		if incremental {
-			of, ok := unseen[relpath]
-			if ok {
-				delete(unseen, relpath)
-				if !fileChanged(of, nf) {
-					if !nf.isDir {
-						nf.dataOffset = of.dataOffset
-						// these indices are against the index file from the previous incremental backup.
-						// we fix up these indices later on, after we know which previous backups are still referenced.
-						prevIndex := of.previousIndex
-						if prevIndex == -1 {
-							// files contained in the last index are now in the new previous-index-reference
-							prevIndex = len(earliers) - 1
-						}
-						nf.previousIndex = prevIndex
-						earliers[prevIndex].used = true
+			if of != nil {
+				changed := fileChanged(of, nf)
+				if !changed && hashing {
+					changed, err = contentsChanged(path, mode, of, nf)
+					if vanished(err) {
+						dropFile(nf, of, info, "vanished")
+						return nil
+					} else if err != nil {
+						return failFile(path, nf, of, info, fmt.Errorf("hashing: %w", err))
+					}
+					if changed && *verbose {
+						log.Println("contents changed, metadata did not:", relpath)
 					}
-					return nil
+				}
+				if !changed {
+					usePrevious(nf, of)
+					return next
 				}
 			} else {
 				nidx.add = append(nidx.add, relpath)
@@ -260,30 +592,102 @@ func backupCmd(args []string, name string) {
 			}
 		}
 
-		if nf.isDir {
-			return nil
+		if nf.isDir || nf.hardLink() || nf.special != 0 {
+			// no data to store
+			return next
 		}
-		nf.dataOffset = dataOffset
-		if nf.isSymlink {
-			p, err := os.Readlink(path)
-			check(err, "readlink")
-			buf := []byte(p)
-			n, err := data.Write(buf)
-			check(err, "write symlink data")
-			if n != len(buf) {
-				panic("did not write full buf")
-			}
-			nf.size = int64(n)
-		} else {
-			err := storeFile(path, nf.size, data)
-			if err != nil {
-				log.Fatalf("writing %s: %s\n", path, err)
+		var h hash.Hash
+		var n int64 // bytes read
+		for attempt := 1; ; attempt++ {
+			if hashing {
+				h = sha256.New()
+			}
+			if chunks != nil && !nf.isSymlink && nf.size >= chunkMin {
+				nf.chunks, n, err = chunks.storeFile(path, info, h)
+				nf.dataOffset = chunkedOffset
+			} else if nf.isSymlink {
+				var p string
+				p, err = os.Readlink(path)
+				if err != nil {
+					err = &readError{err}
+				} else {
+					err = sdata.checkpoint()
+					check(err, "writing data file")
+					nf.dataOffset = dataOffset
+					buf := []byte(p)
+					var nn int
+					nn, err = data.Write(buf)
+					check(err, "write symlink data")
+					if nn != len(buf) {
+						panic("did not write full buf")
+					}
+					n = int64(nn)
+					dataOffset += n
+				}
+			} else {
+				// restores can start reading at a checkpoint, instead of at the start of the data file
+				err = sdata.checkpoint()
+				check(err, "writing data file")
+				nf.dataOffset = dataOffset
+				n, err = storeFile(path, info, data, h)
+				// whatever was written is part of the data file, also if the file changed
+				dataOffset += n
+			}
+			if !errors.Is(err, errFileChanged) || config.OnChange != "retry" || attempt > changeRetries {
+				break
+			}
+			if *verbose {
+				log.Printf("%s changed while backing it up, retrying: %s\n", path, err)
+			}
+			ninfo, lerr := os.Lstat(path)
+			if lerr != nil {
+				err = lerr
+				break
+			}
+			info = ninfo
+			nf.size = info.Size()
+			nf.mtime = info.ModTime()
+			if hashing {
+				nf.ctime = fileCtime(info)
 			}
 		}
-		dataOffset += nf.size
-
+		switch {
+		case err == nil:
+		case errors.Is(err, errFileChanged) && config.OnChange == "skip":
+			// like for unreadable files, the version from the previous backup is kept
+			dropFile(nf, of, info, "changed while backing it up")
+			keepPrevious(relpath)
+			return nil
+		case errors.Is(err, errFileChanged) && tolerant:
+			// "record" and "retry": the index gets the size read, and the times after reading, so
+			// a next incremental backup stores the file again if the size read was off or it changes again
+			log.Printf("warning: %s changed while backing it up, storing %d bytes read: %s\n", path, n, err)
+			inconsistent = append(inconsistent, relpath+": changed, stored as read")
+			nf.size = n
+			if ninfo, err := os.Lstat(path); err == nil {
+				nf.mtime = ninfo.ModTime()
+				if hashing {
+					nf.ctime = fileCtime(ninfo)
+				}
+			}
+		case vanished(err):
+			dropFile(nf, of, info, "vanished")
+			return nil
+		case errors.As(err, new(*readError)):
+			return failFile(path, nf, of, info, err)
+		default:
+			log.Fatalf("writing %s: %s\n", path, err)
+		}
+		if h != nil {
+			nf.hash = h.Sum(nil)
+		}
 		return nil
-	})
+	}
+	for _, src = range sources {
+		whitelist = nil
+		ignores = nil
+		filepath.Walk(src.dir, walk)
+	}
 
 	if incremental {
 		// map previousIndex from last index file to those in index file we're making now.
@@ -313,6 +717,7 @@ func backupCmd(args []string, name string) {
 	check(err, "closing data file")
 
 	nidx.dataSize = dwc.size
+	nidx.checkpoints = sdata.checkpoints
 
 	kind := "full"
 	kindName := "full"
@@ -344,75 +749,219 @@ func backupCmd(args []string, name string) {
 			addDel = fmt.Sprintf(", +%d files, -%d files", len(nidx.add), len(nidx.delete))
 		}
 		log.Printf("total files %d, total size %s, backup size %s%s\n", nfiles, formatSize(dataOffset), formatSize(dwc.size+iwc.size), addDel)
+		if chunks != nil {
+			log.Printf("new chunks %d, size %s\n", chunks.nstored, formatSize(chunks.stored))
+		}
+	}
+	if config.ExcludeCaches || config.MaxFileSize > 0 || len(config.ExcludeKinds) > 0 {
+		log.Printf("skipped cache directories %d, large files %d (%s), files by kind %d (%s)\n", ncaches, nlarge, formatSize(largeSize), nkind, formatSize(kindSize))
 	}
 
-	if config.FullKeep > 0 || config.IncrementalForFullKeep > 0 {
-		backups, err := listBackups()
-		check(err, "listing backups for cleaning up old backups")
+	if len(inconsistent) > 0 {
+		log.Printf("%d files changed or vanished during the backup:\n", len(inconsistent))
+		for _, s := range inconsistent {
+			log.Printf("\t%s\n", s)
+		}
+	}
 
-		// cleanup full backups, and everything before that
-		fullSeen := 0
-		for i := len(backups) - 1; i > 0 && config.FullKeep > 0; i-- {
-			if backups[i].incremental {
-				continue
+	if len(failures) > 0 {
+		log.Printf("%d files could not be backed up, backup %s is partial:\n", len(failures), name)
+		for _, s := range failures {
+			log.Printf("\t%s\n", s)
+		}
+	}
+
+	// with mirrors, old backups are cleaned up on each mirror, based on the backups it has.
+	var failed []*mirror
+	stored := []*mirror{{name: "", store: store, fullKeep: config.FullKeep, incrementalForFullKeep: config.IncrementalForFullKeep}}
+	if m, ok := store.(*mirrored); ok {
+		stored = m.active()
+		failed = m.failed()
+	}
+	for _, m := range stored {
+		if m.fullKeep > 0 || m.incrementalForFullKeep > 0 {
+			cleanupBackups(m, *verbose)
+		}
+	}
+	if len(failed) > 0 {
+		for _, m := range failed {
+			log.Printf("backup %s failed on mirror %s: %s\n", name, m.name, m.err)
+		}
+		log.Fatalf("backup %s incomplete, stored on %d of %d mirrors\n", name, len(stored), len(stored)+len(failed))
+	}
+	return len(failures) > 0
+}
+
+// source is a directory to back up.
+type source struct {
+	name     string // for sources from the config, paths in the index start with the name
+	dir      string // ends with slash
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+	dev      uint64 // of dir, set while walking
+}
+
+// sourceDir checks that dir is a directory, and returns it ending with a slash, with "." resolved.
+func sourceDir(dir string) string {
+	info, err := os.Stat(dir)
+	check(err, "stat backup dir")
+	if !info.IsDir() {
+		log.Fatal("can only backup directories")
+	}
+	if dir == "." {
+		dir, err = os.Getwd()
+		check(err, `resolving "."`)
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir
+}
+
+func compileRegexps(field string, l []string) []*regexp.Regexp {
+	r := []*regexp.Regexp{}
+	for _, s := range l {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			log.Fatalf("bad %s regexp %s: %s", field, s, err)
+		}
+		r = append(r, re)
+	}
+	return r
+}
+
+// cleanupBackups removes old backups from the mirror, according to its configured number of backups to keep.
+func cleanupBackups(m *mirror, verbose bool) {
+	prefix := ""
+	if m.name != "" {
+		prefix = "mirror " + m.name + ": "
+	}
+	backups, err := listDestinationBackups(m.store)
+	if err != nil {
+		log.Printf("%slisting backups for cleaning up old backups: %s\n", prefix, err)
+		return
+	}
+
+	// chunks can only become unreferenced when an index file is removed
+	removed := false
+
+	// cleanup full backups, and everything before that
+	fullSeen := 0
+	for i := len(backups) - 1; i > 0 && m.fullKeep > 0; i-- {
+		if backups[i].incremental {
+			continue
+		}
+		fullSeen++
+		if fullSeen < m.fullKeep {
+			continue
+		}
+		// remove everything (both incr and full) before this latest full
+		for j := 0; j < i; j++ {
+			ext := "full"
+			kind := "full"
+			if backups[j].incremental {
+				ext = "incr"
+				kind = "incremental"
 			}
-			fullSeen++
-			if fullSeen < config.FullKeep {
-				continue
+			if verbose {
+				log.Printf("%scleaning up old %s backup %s\n", prefix, kind, backups[j].name)
 			}
-			// remove everything (both incr and full) before this latest full
-			for j := 0; j < i; j++ {
-				ext := "full"
-				kind := "full"
-				if backups[j].incremental {
-					ext = "incr"
-					kind = "incremental"
-				}
-				if *verbose {
-					log.Printf("cleaning up old %s backup %s\n", kind, backups[j].name)
-				}
-				err = store.Delete(backups[j].name + ".data")
-				if err != nil {
-					log.Println("removing old backup:", err)
-				}
-				err = store.Delete(backups[j].name + ".index1." + ext)
-				if err != nil {
-					log.Println("removing old backup:", err)
-				}
+			err = m.store.Delete(backups[j].name + ".data")
+			if err != nil {
+				log.Printf("%sremoving old backup: %s\n", prefix, err)
+			}
+			err = m.store.Delete(backups[j].name + ".index1." + ext)
+			if err != nil {
+				log.Printf("%sremoving old backup: %s\n", prefix, err)
+			} else {
+				removed = true
 			}
-			// we'll continue with removing incrementals on the remaining backups, those we kept
-			backups = backups[i:]
-			break
 		}
+		// we'll continue with removing incrementals on the remaining backups, those we kept
+		backups = backups[i:]
+		break
+	}
 
-		fullSeen = 0
-		for i := len(backups) - 1; i > 0; i-- {
-			if backups[i].incremental {
+	fullSeen = 0
+	for i := len(backups) - 1; i > 0; i-- {
+		if backups[i].incremental {
+			continue
+		}
+		fullSeen++
+		if fullSeen < m.incrementalForFullKeep {
+			continue
+		}
+		// remove all incrementals before this latest full backup we've just seen
+		for j := 0; j < i; j++ {
+			if !backups[j].incremental {
 				continue
 			}
-			fullSeen++
-			if fullSeen < config.IncrementalForFullKeep {
-				continue
+			if verbose {
+				log.Printf("%scleaning up old incremental backup %s\n", prefix, backups[j].name)
 			}
-			// remove all incrementals before this latest full backup we've just seen
-			for j := 0; j < i; j++ {
-				if !backups[j].incremental {
-					continue
-				}
-				if *verbose {
-					log.Println("cleaning up old incremental backup", backups[j].name)
-				}
-				err = store.Delete(backups[j].name + ".data")
-				if err != nil {
-					log.Println("removing old incremental backup:", err)
-				}
-				err = store.Delete(backups[j].name + ".index1.incr")
-				if err != nil {
-					log.Println("removing old incremental backup:", err)
-				}
+			err = m.store.Delete(backups[j].name + ".data")
+			if err != nil {
+				log.Printf("%sremoving old incremental backup: %s\n", prefix, err)
+			}
+			err = m.store.Delete(backups[j].name + ".index1.incr")
+			if err != nil {
+				log.Printf("%sremoving old incremental backup: %s\n", prefix, err)
+			} else {
+				removed = true
 			}
-			break
 		}
+		break
+	}
+
+	if removed {
+		cleanupChunks(m, verbose)
+	}
+}
+
+// cleanupChunks removes chunks from the mirror that are not referenced by any of its backups.
+// Nothing is removed if an index file cannot be read.
+func cleanupChunks(m *mirror, verbose bool) {
+	prefix := ""
+	if m.name != "" {
+		prefix = "mirror " + m.name + ": "
+	}
+	names, err := m.store.ListDir(chunkDir)
+	if err != nil {
+		log.Printf("%slisting chunks for cleaning up: %s\n", prefix, err)
+		return
+	}
+	var chunks []string
+	for _, name := range names {
+		if isChunk(name) {
+			chunks = append(chunks, chunkDir+"/"+name)
+		}
+	}
+	if len(chunks) == 0 {
+		return
+	}
+	backups, err := listDestinationBackups(m.store)
+	if err != nil {
+		log.Printf("%snot cleaning up chunks: %s\n", prefix, err)
+		return
+	}
+	refs, err := chunkReferences(m.store, backups)
+	if err != nil {
+		log.Printf("%snot cleaning up chunks: %s\n", prefix, err)
+		return
+	}
+	n := 0
+	for _, name := range chunks {
+		if refs[name] > 0 {
+			continue
+		}
+		if err := m.store.Delete(name); err != nil {
+			log.Printf("%sremoving unreferenced chunk: %s\n", prefix, err)
+			continue
+		}
+		n++
+	}
+	if verbose && n > 0 {
+		log.Printf("%scleaned up %d unreferenced chunks\n", prefix, n)
 	}
 }
 
@@ -435,13 +984,82 @@ func fileChanged(old, new *file) bool {
 		old.mtime.Unix() != new.mtime.Unix() ||
 		old.permissions != new.permissions ||
 		old.user != new.user ||
-		old.group != new.group
+		old.group != new.group ||
+		old.link != new.link ||
+		old.special != new.special ||
+		old.major != new.major ||
+		old.minor != new.minor ||
+		config.Xattrs && !xattrsEqual(old.xattrs, new.xattrs)
+}
+
+// contentsChanged returns whether the contents of a file with unchanged metadata
+// differ from the previous backup. With mode "ctime", the file is only read if
+// its ctime changed, e.g. because its mtime was set to an earlier value. Files
+// without hash in the previous backup are considered changed. The hash of the
+// previous backup is copied to nf if the contents are the same.
+func contentsChanged(path string, mode string, of, nf *file) (bool, error) {
+	if of.hash == nil {
+		return true, nil
+	}
+	if mode == "ctime" && !nf.ctime.IsZero() && nf.ctime.Equal(of.ctime) {
+		nf.hash = of.hash
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	sum := h.Sum(nil)
+	if !bytes.Equal(sum, of.hash) {
+		return true, nil
+	}
+	nf.hash = sum
+	return false, nil
+}
+
+// readError is an error reading a file that is being backed up, as opposed to
+// an error writing the backup.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+// sourceReader returns errors from reading r as readError.
+type sourceReader struct {
+	r io.Reader
 }
 
-func storeFile(path string, size int64, data io.Writer) (err error) {
+func (r sourceReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if err != nil && err != io.EOF {
+		err = &readError{err}
+	}
+	return n, err
+}
+
+// errFileChanged is returned, wrapped, for files that changed while they were stored.
+var errFileChanged = errors.New("file changed while reading")
+
+// storeFile writes the contents of the file at path, with FileInfo info from
+// before reading, to data, returning the number of bytes written. If h is not
+// nil, the contents are hashed too. If the file changed while reading, an error
+// wrapping errFileChanged is returned, along with the number of bytes written.
+func storeFile(path string, info os.FileInfo, data io.Writer, h hash.Hash) (n int64, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return 0, &readError{err}
 	}
 	defer func() {
 		err2 := f.Close()
@@ -449,12 +1067,32 @@ func storeFile(path string, size int64, data io.Writer) (err error) {
 			err = err2
 		}
 	}()
-	n, err := io.Copy(data, f)
+	if h != nil {
+		data = io.MultiWriter(data, h)
+	}
+	n, err = io.Copy(data, sourceReader{f})
+	if err != nil {
+		return n, err
+	}
+	return n, checkUnchanged(f, info, n)
+}
+
+// checkUnchanged returns an error wrapping errFileChanged if n, the bytes read
+// from f, is not the size in info. With "onChange" configured, it also checks
+// whether f's size or mtime changed since info.
+func checkUnchanged(f *os.File, info os.FileInfo, n int64) error {
+	if n != info.Size() {
+		return fmt.Errorf("%w: expected %d bytes, read %d", errFileChanged, info.Size(), n)
+	}
+	if config.OnChange == "" {
+		return nil
+	}
+	ninfo, err := f.Stat()
 	if err != nil {
-		return err
+		return &readError{err}
 	}
-	if n != size {
-		return fmt.Errorf("expected to write %d bytes, only wrote %d", size, n)
+	if ninfo.Size() != info.Size() || !ninfo.ModTime().Equal(info.ModTime()) {
+		return fmt.Errorf("%w: size or mtime changed", errFileChanged)
 	}
-	return
+	return nil
 }
@@ -0,0 +1,102 @@
+#!/usr/bin/env bash
+# Reference helper for the "exec" destination, storing files in the directory
+# $BOLONG_PATH. It implements the protocol described in the README, start from
+# this script when connecting bolong to your own storage. Requires GNU head,
+# which does not read beyond the requested bytes from a pipe.
+
+set -u
+dir="${BOLONG_PATH:?environment variable BOLONG_PATH must be set}"
+if ! cd "$dir"; then
+	exit 1
+fi
+
+echo "bolong-exec 1"
+
+while read -r cmd a b c; do
+	case "$cmd" in
+	list)
+		# a is the optional subdirectory, e.g. "chunks"
+		pattern="*"
+		if [ -n "$a" ]; then
+			pattern="$a/*"
+		fi
+		echo ok
+		for f in $pattern; do
+			# skips temporary files of interrupted creates, they start with a dot
+			if [ -f "$f" ]; then
+				echo "${f##*/}"
+			fi
+		done
+		echo .
+		;;
+	open)
+		# a is the path, b the offset, c the length, -1 for the rest of the file
+		if [ ! -f "$a" ]; then
+			echo "notfound $a does not exist"
+			continue
+		fi
+		size=$(wc -c < "$a")
+		n=$((size - b))
+		if [ "$n" -lt 0 ]; then
+			n=0
+		fi
+		if [ "$c" -ge 0 ] && [ "$c" -lt "$n" ]; then
+			n=$c
+		fi
+		echo "ok $n"
+		tail -c +$((b + 1)) -- "$a" | head -c "$n"
+		;;
+	create)
+		# data follows in chunks, each a line with the size followed by the data, ending with size 0
+		# files in a subdirectory, like chunks, get their temporary file there
+		sub=.
+		name="$a"
+		case "$a" in
+		*/*)
+			sub="${a%/*}"
+			name="${a##*/}"
+			;;
+		esac
+		tmp="$sub/.tmp-$name"
+		ok=yes
+		mkdir -p -- "$sub" && : > "$tmp" || ok=no
+		while read -r n; do
+			if [ "$n" = 0 ]; then
+				break
+			fi
+			if [ "$ok" = yes ]; then
+				head -c "$n" >> "$tmp" || ok=no
+			else
+				head -c "$n" > /dev/null
+			fi
+		done
+		if [ "$ok" = yes ] && mv -- "$tmp" "$a"; then
+			echo ok
+		else
+			rm -f -- "$tmp"
+			echo "error writing $a failed"
+		fi
+		;;
+	rename)
+		if [ ! -f "$a" ]; then
+			echo "notfound $a does not exist"
+		elif mv -- "$a" "$b"; then
+			echo ok
+		else
+			echo "error renaming $a failed"
+		fi
+		;;
+	delete)
+		if [ ! -f "$a" ]; then
+			echo "notfound $a does not exist"
+		elif rm -- "$a"; then
+			echo ok
+		else
+			echo "error removing $a failed"
+		fi
+		;;
+	*)
+		echo "error unknown command $cmd"
+		;;
+	esac
+done
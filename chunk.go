@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// With "dedup" enabled, the contents of larger files are split into chunks at
+// positions determined by the contents, with a rolling hash. Inserting or
+// removing data in a file only changes the chunks around the change. Each chunk
+// is stored in its own safe file in subdirectory "chunks", named by an
+// HMAC-SHA256 of its contents. A chunk is only stored if it isn't present at the
+// destination yet, so unchanged parts of files are not stored again, not even in
+// full backups. Chunks that are no longer referenced by any backup are removed
+// when cleaning up old backups.
+
+const (
+	chunkDir  = "chunks"        // subdirectory at the destination, keeps chunks out of listings of backups
+	chunkMin  = 512 * 1024      // files smaller than this are stored in the data file
+	chunkMax  = 8 * 1024 * 1024 // chunks are cut at this size, regardless of the contents
+	chunkMask = uint64(1<<20-1) << 44
+
+	chunkPrefetch = 4 // chunks read ahead when restoring, hiding the latency of opening each chunk
+
+	// dataOffset for files stored in chunks.
+	chunkedOffset = -2
+)
+
+// isChunk returns whether name, from a listing of the chunk directory, is a
+// chunk file. Chunks are written to a temporary file ending in ".tmp" first,
+// and renamed when complete.
+func isChunk(name string) bool {
+	return !strings.HasSuffix(name, ".tmp")
+}
+
+// chunkRef is a chunk of a file, as listed in an index file.
+type chunkRef struct {
+	size int64
+	id   string // hex hmac-sha256 of the contents
+}
+
+// name returns the path of the chunk at the destination.
+func (c chunkRef) name() string {
+	return chunkDir + "/" + c.id
+}
+
+// gearTable has a random value for each byte, for the rolling hash. It must never change, or existing chunks are no longer found.
+var gearTable = func() (t [256]uint64) {
+	for i := range t {
+		h := sha256.Sum256([]byte{byte(i)})
+		t[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return
+}()
+
+// chunker splits data from r into chunks.
+type chunker struct {
+	r    io.Reader
+	buf  []byte // of size chunkMax
+	n    int    // bytes in buf
+	last int    // size of the chunk returned by the previous call to next
+	err  error  // from reading r, returned when buf is empty
+}
+
+func newChunker(r io.Reader, buf []byte) *chunker {
+	return &chunker{r: r, buf: buf}
+}
+
+// next returns the next chunk, valid until the next call, or io.EOF after the last chunk.
+func (c *chunker) next() ([]byte, error) {
+	copy(c.buf, c.buf[c.last:c.n])
+	c.n -= c.last
+	c.last = 0
+	for c.n < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.n:])
+		c.n += n
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	c.last = chunkCut(c.buf[:c.n])
+	return c.buf[:c.last], nil
+}
+
+// chunkCut returns the size of the first chunk in data, which holds at most chunkMax bytes.
+// It uses a gear hash, its high bits depend on the last 64 bytes.
+func chunkCut(data []byte) int {
+	if len(data) <= chunkMin {
+		return len(data)
+	}
+	var h uint64
+	for i := chunkMin; i < len(data); i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunkIDKey returns the key for the hmac of chunks. It is derived from the
+// passphrase without random salt, because chunks must get the same id in each
+// backup.
+func chunkIDKey() []byte {
+	return pbkdf2.Key([]byte(config.Passphrase), []byte("bolong chunk ids"), 4096, 32, sha512.New)
+}
+
+// listChunks returns the paths of the chunks present at d. For mirrors, only
+// chunks present at all mirrors that have not failed are returned.
+func listChunks(d destination) (map[string]struct{}, error) {
+	stores := []destination{d}
+	if m, ok := d.(*mirrored); ok {
+		stores = nil
+		for _, mm := range m.active() {
+			stores = append(stores, mm.store)
+		}
+	}
+	var have map[string]struct{}
+	for _, d := range stores {
+		names, err := d.ListDir(chunkDir)
+		if err != nil {
+			return nil, fmt.Errorf("listing chunks: %s", err)
+		}
+		l := map[string]struct{}{}
+		for _, name := range names {
+			if !isChunk(name) {
+				continue
+			}
+			path := chunkDir + "/" + name
+			if _, ok := have[path]; have == nil || ok {
+				l[path] = struct{}{}
+			}
+		}
+		have = l
+	}
+	return have, nil
+}
+
+// chunkStore stores files as chunks during a backup.
+type chunkStore struct {
+	idKey     []byte
+	salt, key []byte              // used for all chunks written in this backup
+	have      map[string]struct{} // chunk paths present at the destination, listed for the first chunked file
+	buf       []byte              // for chunker
+	nstored   int                 // new chunks
+	stored    int64               // size of new chunks, after compression and encryption
+	partial   chan<- string       // paths written, removed when the backup is interrupted
+}
+
+func newChunkStore(partial chan<- string) (*chunkStore, error) {
+	salt, key, err := newSafeSalt()
+	if err != nil {
+		return nil, err
+	}
+	return &chunkStore{chunkIDKey(), salt, key, nil, make([]byte, chunkMax), 0, 0, partial}, nil
+}
+
+// storeFile stores the contents of the file at path, with FileInfo info from
+// before reading, in chunks, returning the chunks in order and the number of
+// bytes read. If h is not nil, the contents are hashed too. If the file changed
+// while reading, the chunks are returned with an error wrapping errFileChanged.
+func (cs *chunkStore) storeFile(path string, info os.FileInfo, h hash.Hash) (chunks []chunkRef, n int64, err error) {
+	if cs.have == nil {
+		cs.have, err = listChunks(store)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, &readError{err}
+	}
+	defer f.Close()
+	var r io.Reader = sourceReader{f}
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
+	c := newChunker(r, cs.buf)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, n, err
+		}
+		mac := hmac.New(sha256.New, cs.idKey)
+		mac.Write(data)
+		ref := chunkRef{int64(len(data)), hex.EncodeToString(mac.Sum(nil))}
+		if _, ok := cs.have[ref.name()]; !ok {
+			if err := cs.write(ref.name(), data); err != nil {
+				return nil, n, err
+			}
+			cs.have[ref.name()] = struct{}{}
+		}
+		chunks = append(chunks, ref)
+		n += ref.size
+	}
+	return chunks, n, checkUnchanged(f, info, n)
+}
+
+// write stores a new chunk. It is written to a temporary file first, so a
+// failed write never leaves a partial chunk under its final name.
+func (cs *chunkStore) write(name string, data []byte) error {
+	tmp := name + ".tmp"
+	cs.partial <- tmp
+	f, err := store.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating chunk: %s", err)
+	}
+	// remove removes the temporary file, which may have been written partially
+	remove := func() {
+		if err := store.Delete(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("removing partial chunk: %s\n", err)
+		}
+	}
+	wc := &writeCounter{f: f}
+	sf, err := newSafeSaltWriter(wc, cs.salt, cs.key)
+	if err != nil {
+		f.Close()
+		remove()
+		return err
+	}
+	if _, err := sf.Write(data); err != nil {
+		f.Close()
+		remove()
+		return fmt.Errorf("writing chunk: %s", err)
+	}
+	if err := sf.Close(); err != nil {
+		remove()
+		return fmt.Errorf("closing chunk: %s", err)
+	}
+	cs.partial <- name
+	if err := store.Rename(tmp, name); err != nil {
+		remove()
+		return fmt.Errorf("renaming chunk: %s", err)
+	}
+	cs.nstored++
+	cs.stored += wc.size
+	return nil
+}
+
+// readChunk writes the contents of chunk c, read from safe file rc, to w.
+// The contents are verified against the chunk id, so a chunk that was
+// replaced by another chunk is detected.
+func readChunk(w io.Writer, rc io.ReadCloser, idKey []byte, c chunkRef) error {
+	sf, err := newSafeReader(rc)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, idKey)
+	n, err := io.Copy(io.MultiWriter(w, mac), sf)
+	if err != nil {
+		return fmt.Errorf("reading chunk %s: %s", c.id, err)
+	}
+	if n != c.size {
+		return fmt.Errorf("chunk %s has size %d, expected %d", c.id, n, c.size)
+	}
+	if id, _ := hex.DecodeString(c.id); !bytes.Equal(mac.Sum(nil), id) {
+		return fmt.Errorf("chunk %s has unexpected contents", c.id)
+	}
+	return nil
+}
+
+// fetchedChunk is the contents of a chunk read by fetchChunks, or the error reading it.
+type fetchedChunk struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// fetchChunks reads and verifies chunks from d in the background, up to
+// chunkPrefetch at a time. The returned channel yields a channel for each chunk,
+// in order, that receives its contents. Bytes read are sent on transferred.
+func fetchChunks(d destination, idKey []byte, chunks []chunkRef, transferred chan int) <-chan chan fetchedChunk {
+	pending := make(chan chan fetchedChunk, chunkPrefetch-1)
+	go func() {
+		defer close(pending)
+		for _, c := range chunks {
+			result := make(chan fetchedChunk, 1)
+			pending <- result
+			go func(c chunkRef) {
+				rc, err := d.Open(c.name())
+				if err != nil {
+					result <- fetchedChunk{err: fmt.Errorf("open chunk: %s", err)}
+					return
+				}
+				buf := &bytes.Buffer{}
+				buf.Grow(int(c.size))
+				err = readChunk(buf, &readCounter{rc, transferred}, idKey, c)
+				rc.Close()
+				result <- fetchedChunk{buf, err}
+			}(c)
+		}
+	}()
+	return pending
+}
+
+// chunkReferences returns how often each chunk is referenced by the backups on d.
+func chunkReferences(d destination, backups []*backup) (map[string]int, error) {
+	refs := map[string]int{}
+	for _, b := range backups {
+		idx, err := readDestinationIndex(d, b)
+		if err != nil {
+			return nil, fmt.Errorf("reading index of %s: %s", b.name, err)
+		}
+		for _, f := range idx.contents {
+			for _, c := range f.chunks {
+				refs[c.name()]++
+			}
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func chunkSizes(t *testing.T, data []byte) (sizes []int, chunks map[string]bool) {
+	t.Helper()
+	chunks = map[string]bool{}
+	c := newChunker(bytes.NewReader(data), make([]byte, chunkMax))
+	var all []byte
+	for {
+		buf, err := c.next()
+		if err != nil {
+			break
+		}
+		all = append(all, buf...)
+		sizes = append(sizes, len(buf))
+		chunks[string(buf)] = true
+	}
+	if !bytes.Equal(all, data) {
+		t.Fatalf("chunks don't add up to data")
+	}
+	return
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	sizes, chunks := chunkSizes(t, data)
+	if len(sizes) < 4 {
+		t.Fatalf("only %d chunks", len(sizes))
+	}
+	for i, size := range sizes {
+		if size > chunkMax || size < chunkMin && i != len(sizes)-1 {
+			t.Errorf("chunk %d has bad size %d", i, size)
+		}
+	}
+
+	// inserting data only changes the chunks around the insert
+	ndata := append(append(append([]byte{}, data[:5*1024*1024]...), "inserted"...), data[5*1024*1024:]...)
+	nsizes, nchunks := chunkSizes(t, ndata)
+	same := 0
+	for buf := range nchunks {
+		if chunks[buf] {
+			same++
+		}
+	}
+	if same < len(nsizes)-2 {
+		t.Errorf("after insert, only %d of %d chunks the same", same, len(nsizes))
+	}
+
+	if sizes, _ := chunkSizes(t, nil); len(sizes) != 0 {
+		t.Errorf("chunks for empty data: %v", sizes)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	os.RemoveAll("testdir")
+	tcheck(t, os.MkdirAll("testdir/workdir", 0777), "making workdir")
+	setupTestConfig(t, configuration{Dedup: true, FullKeep: 1})
+
+	data := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	tcheck(t, ioutil.WriteFile("testdir/workdir/big.bin", data, 0666), "writing file")
+	tcheck(t, ioutil.WriteFile("testdir/workdir/small.txt", []byte("small"), 0666), "writing file")
+
+	// chunks returns the chunks of big.bin in the backup, and the chunk files present
+	chunks := func() (refs map[string]bool, present map[string]bool) {
+		t.Helper()
+		refs = map[string]bool{}
+		for _, f := range latestIndex(t).contents {
+			if f.name == "small.txt" && f.chunked() {
+				t.Errorf("small file stored in chunks")
+			}
+			if f.name == "big.bin" {
+				if !f.chunked() {
+					t.Fatalf("big file not stored in chunks")
+				}
+				for _, c := range f.chunks {
+					refs[c.name()] = true
+				}
+			}
+		}
+		names, err := store.List()
+		tcheck(t, err, "listing")
+		for _, name := range names {
+			if strings.HasPrefix(name, chunkDir) {
+				t.Errorf("listing backups returned chunk directory %s", name)
+			}
+		}
+		present = map[string]bool{}
+		names, err = store.ListDir(chunkDir)
+		tcheck(t, err, "listing chunks")
+		for _, name := range names {
+			if isChunk(name) {
+				present[chunkDir+"/"+name] = true
+			}
+		}
+		return
+	}
+
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	refs1, present := chunks()
+	if len(refs1) < 2 || len(present) != len(refs1) {
+		t.Fatalf("after first backup, %d chunks referenced, %d present", len(refs1), len(present))
+	}
+
+	// a new full backup stores no new chunks
+	tcheck(t, ioutil.WriteFile("testdir/workdir/small.txt", []byte("changed"), 0666), "writing file")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0002")
+	refs2, present := chunks()
+	if len(refs2) != len(refs1) || len(present) != len(refs1) {
+		t.Errorf("after second backup, %d chunks referenced, %d present, expected %d", len(refs2), len(present), len(refs1))
+	}
+
+	// changing the file adds a chunk, the old chunk is removed with the old backup
+	// a chunk still being written, e.g. by another backup, is left alone
+	tcheck(t, ioutil.WriteFile("testdir/backup/"+chunkDir+"/writing.tmp", []byte("x"), 0666), "writing temporary chunk")
+	copy(data[3*1024*1024:], "changed")
+	tcheck(t, ioutil.WriteFile("testdir/workdir/big.bin", data, 0666), "writing file")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0003")
+	if _, err := os.Stat("testdir/backup/" + chunkDir + "/writing.tmp"); err != nil {
+		t.Errorf("temporary chunk removed during cleanup: %s", err)
+	}
+	refs3, present := chunks()
+	same := 0
+	for name := range refs3 {
+		if refs1[name] {
+			same++
+		}
+	}
+	if same != len(refs3)-1 || len(present) != len(refs3) {
+		t.Errorf("after change, %d of %d chunks the same, %d present", same, len(refs3), len(present))
+	}
+	l, err := listBackups()
+	if err != nil || len(l) != 1 {
+		t.Errorf("expected 1 backup, got %v, %v", l, err)
+	}
+
+	tcheck(t, os.MkdirAll("testdir/restore", 0777), "making restore dir")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	buf, err := ioutil.ReadFile("testdir/restore/big.bin")
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("restored big file differs, error %v", err)
+	}
+	buf, err = ioutil.ReadFile("testdir/restore/small.txt")
+	if err != nil || string(buf) != "changed" {
+		t.Errorf("restored small file, got %q, %v", buf, err)
+	}
+
+	m := &mirror{name: "", store: store}
+	if !verifyMirror(m, true, false) {
+		t.Errorf("verify failed")
+	}
+	// a chunk replaced by another is detected when reading
+	var names []string
+	for name := range present {
+		names = append(names, name)
+	}
+	buf, err = ioutil.ReadFile("testdir/backup/" + names[0])
+	tcheck(t, err, "reading chunk")
+	tcheck(t, ioutil.WriteFile("testdir/backup/"+names[1], buf, 0666), "replacing chunk")
+	if !verifyMirror(m, false, false) {
+		t.Errorf("verify without reading failed")
+	}
+	if verifyMirror(m, true, false) {
+		t.Errorf("verify with replaced chunk succeeded")
+	}
+	tcheck(t, os.Remove("testdir/backup/"+names[1]), "removing chunk")
+	if verifyMirror(m, false, false) {
+		t.Errorf("verify with missing chunk succeeded")
+	}
+
+	// a failed write leaves no partial chunk behind
+	cs, err := newChunkStore(make(chan string, 2))
+	tcheck(t, err, "new chunk store")
+	store = &broken{destination: store, failAfter: 100}
+	if err := cs.write(chunkDir+"/partial", data[:1000]); err == nil {
+		t.Fatalf("chunk write succeeded")
+	}
+	files, err := ioutil.ReadDir("testdir/backup/" + chunkDir)
+	tcheck(t, err, "reading dir")
+	for _, fi := range files {
+		if strings.Contains(fi.Name(), "partial") {
+			t.Errorf("file %s left after failed chunk write", fi.Name())
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// +build linux openbsd dragonfly solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileCtime returns the time of the last status change of the file, or the zero time if unknown.
+func fileCtime(fi os.FileInfo) time.Time {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+}
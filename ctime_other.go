@@ -0,0 +1,13 @@
+// +build !linux,!openbsd,!dragonfly,!solaris,!darwin,!freebsd,!netbsd
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileCtime returns the zero time, the time of the last status change is not available on these systems.
+func fileCtime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -1,16 +1,119 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"strings"
 )
 
 type destination interface {
 	// List returns the names of backup files, those ending in .full, in ascending order, by name, which is a timestamp.
 	List() (names []string, err error)
+	// ListDir returns the names of the files in subdirectory dir, like List. A
+	// directory that does not exist has no files. Chunks are stored in a
+	// subdirectory, so listing backups does not return all chunks.
+	ListDir(dir string) (names []string, err error)
 
 	// open
 	Open(path string) (r io.ReadCloser, err error)
+	// OpenRange opens path for reading length bytes starting at offset.
+	// A length of -1 reads until the end of the file.
+	OpenRange(path string, offset, length int64) (r io.ReadCloser, err error)
 	Create(path string) (w io.WriteCloser, err error)
 	Rename(opath, npath string) (err error)
 	Delete(path string) (err error)
 }
+
+// splitDir returns the subdirectory of path, empty for files at the top, and
+// the name of the file in it.
+func splitDir(path string) (dir, name string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// httpStatusError is returned by http-based destinations for an unexpected response status.
+type httpStatusError struct {
+	op     string // eg "opening x", can be empty
+	expect int
+	code   int
+	detail string // error from the response body, can be empty
+}
+
+func (e *httpStatusError) Error() string {
+	s := fmt.Sprintf("status code not %d but %d", e.expect, e.code)
+	if e.op != "" {
+		s = e.op + ": " + s
+	}
+	if e.detail != "" {
+		s += ": " + e.detail
+	}
+	return s
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) work for missing files.
+func (e *httpStatusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.code == http.StatusNotFound
+}
+
+// temporary returns whether the request may succeed when retried.
+func (e *httpStatusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusTooManyRequests || e.code == http.StatusRequestTimeout
+}
+
+// httpRange returns the value for a Range header for reading length bytes from offset.
+// The empty string is returned when the whole file is requested.
+// Length must not be 0, an empty range cannot be expressed. The retrying
+// destination does not pass empty ranges on.
+func httpRange(offset, length int64) string {
+	if length < 0 {
+		if offset == 0 {
+			return ""
+		}
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// pipeWriter is returned by Create of destinations that stream the file in the
+// body of a single http request, sent by a goroutine reading from p.
+type pipeWriter struct {
+	p   *io.PipeWriter
+	err chan error // for waiting until request has completed
+}
+
+func (x *pipeWriter) Write(buf []byte) (int, error) {
+	return x.p.Write(buf)
+}
+
+func (x *pipeWriter) Close() error {
+	err := x.p.Close()
+	if err != nil {
+		return err
+	}
+	return <-x.err
+}
+
+// abort fails the request, so the file is not stored.
+func (x *pipeWriter) abort() {
+	x.p.CloseWithError(fmt.Errorf("write aborted"))
+	<-x.err
+}
+
+// limitReadCloser reads at most a limited number of bytes, for destinations that can only seek to the start of a range.
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newLimitReadCloser returns rc limited to length bytes, or rc itself for length -1.
+func newLimitReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+	return limitReadCloser{io.LimitReader(rc, length), rc}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// external is a destination implemented by a helper program, for storage we
+// don't support ourselves. We speak a line-based protocol with the helper over
+// its stdin and stdout, see the README for a description. A helper handles one
+// operation at a time. While a file is being read or written, further
+// operations start another instance of the helper.
+type external struct {
+	command []string // program and arguments
+	path    string   // passed to the helper as $BOLONG_PATH, can be empty
+
+	sync.Mutex
+	idle []*externalHelper
+}
+
+var _ destination = &external{}
+
+// first line written by a helper when it starts, for checking it speaks our protocol.
+const externalHello = "bolong-exec 1"
+
+// externalHelper is a running helper process.
+type externalHelper struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// get returns an idle helper, starting a new one if needed.
+func (e *external) get() (*externalHelper, error) {
+	e.Lock()
+	if n := len(e.idle); n > 0 {
+		h := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.Unlock()
+		return h, nil
+	}
+	e.Unlock()
+
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Stderr = os.Stderr
+	if e.path != "" {
+		cmd.Env = append(os.Environ(), "BOLONG_PATH="+e.path)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting helper: %s", err)
+	}
+	h := &externalHelper{cmd, stdin, bufio.NewReader(stdout)}
+	line, err := h.readLine()
+	if err == nil && line != externalHello {
+		err = fmt.Errorf("helper started with %q instead of %q", line, externalHello)
+	}
+	if err != nil {
+		h.kill()
+		return nil, err
+	}
+	return h, nil
+}
+
+// put makes h available for the next operation.
+func (e *external) put(h *externalHelper) {
+	e.Lock()
+	defer e.Unlock()
+	e.idle = append(e.idle, h)
+}
+
+// kill stops a helper that is in an unknown state, e.g. after a protocol error or a partial read.
+func (h *externalHelper) kill() {
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	h.cmd.Wait()
+}
+
+func (h *externalHelper) readLine() (string, error) {
+	line, err := h.stdout.ReadString('\n')
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading from helper: %w", err)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// response reads the response line to a command. For "ok", the remainder of the
+// line is returned. For "notfound" and "error", an error with the message from the helper.
+func (h *externalHelper) response() (string, error) {
+	line, err := h.readLine()
+	if err != nil {
+		return "", err
+	}
+	t := strings.SplitN(line, " ", 2)
+	msg := ""
+	if len(t) == 2 {
+		msg = t[1]
+	}
+	switch t[0] {
+	case "ok":
+		return msg, nil
+	case "notfound":
+		return "", &externalError{msg, true}
+	case "error":
+		return "", &externalError{msg, false}
+	}
+	return "", fmt.Errorf("bad response from helper: %q", line)
+}
+
+// externalError is an error reported by the helper. The helper can still be used for other operations.
+type externalError struct {
+	msg      string
+	notFound bool
+}
+
+func (e *externalError) Error() string {
+	return "helper: " + e.msg
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) work for missing files.
+func (e *externalError) Is(target error) bool {
+	return target == os.ErrNotExist && e.notFound
+}
+
+// externalPathOK returns whether path can be sent to a helper. Paths are separated by spaces in commands.
+func externalPathOK(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, c := range path {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// run runs a command without file data, returning the remainder of the "ok" response line.
+// On protocol errors, the helper is stopped, otherwise it is reused.
+func (e *external) run(args ...string) (string, *externalHelper, error) {
+	for _, a := range args[1:] {
+		if !externalPathOK(a) {
+			return "", nil, fmt.Errorf("%s: path %q cannot be passed to helper", args[0], a)
+		}
+	}
+	h, err := e.get()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := fmt.Fprintln(h.stdin, strings.Join(args, " ")); err != nil {
+		h.kill()
+		return "", nil, fmt.Errorf("writing to helper: %s", err)
+	}
+	rest, err := h.response()
+	if _, ok := err.(*externalError); err != nil && !ok {
+		h.kill()
+		return "", nil, err
+	}
+	return rest, h, err
+}
+
+// List returns filenames, ordered by name.
+func (e *external) List() (names []string, err error) {
+	return e.ListDir("")
+}
+
+func (e *external) ListDir(dir string) (names []string, err error) {
+	args := []string{"list"}
+	if dir != "" {
+		args = append(args, dir)
+	}
+	_, h, err := e.run(args...)
+	if h == nil {
+		return nil, err
+	}
+	if err != nil {
+		e.put(h)
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	for {
+		line, err := h.readLine()
+		if err != nil {
+			h.kill()
+			return nil, err
+		}
+		if line == "." {
+			break
+		}
+		names = append(names, line)
+	}
+	e.put(h)
+	sort.Strings(names)
+	return names, nil
+}
+
+func (e *external) Open(path string) (rc io.ReadCloser, err error) {
+	return e.OpenRange(path, 0, -1)
+}
+
+func (e *external) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	rest, h, err := e.run("open", path, fmt.Sprintf("%d", offset), fmt.Sprintf("%d", length))
+	if h == nil {
+		return nil, err
+	}
+	if err != nil {
+		e.put(h)
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	size, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil || size < 0 || length >= 0 && size > length {
+		h.kill()
+		return nil, fmt.Errorf("opening %s: bad size %q from helper", path, rest)
+	}
+	return &externalReader{e, h, size}, nil
+}
+
+// externalReader reads file data from a helper. The helper is reused if all data was read.
+type externalReader struct {
+	e         *external
+	h         *externalHelper
+	remaining int64
+}
+
+func (r *externalReader) Read(buf []byte) (int, error) {
+	if r.h == nil {
+		return 0, fmt.Errorf("read on closed file")
+	}
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > r.remaining {
+		buf = buf[:r.remaining]
+	}
+	n, err := r.h.stdout.Read(buf)
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *externalReader) Close() error {
+	if r.h == nil {
+		return nil
+	}
+	if r.remaining == 0 {
+		r.e.put(r.h)
+	} else {
+		// the rest of the data would have to be read first, quicker to start a new helper when needed
+		r.h.kill()
+	}
+	r.h = nil
+	return nil
+}
+
+// Create returns a writer that streams data to the helper in chunks. The helper responds after the last chunk.
+func (e *external) Create(path string) (w io.WriteCloser, err error) {
+	if !externalPathOK(path) {
+		return nil, fmt.Errorf("create: path %q cannot be passed to helper", path)
+	}
+	h, err := e.get()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(h.stdin, "create %s\n", path); err != nil {
+		h.kill()
+		return nil, fmt.Errorf("writing to helper: %s", err)
+	}
+	return &externalWriter{e, h, path}, nil
+}
+
+type externalWriter struct {
+	e    *external
+	h    *externalHelper
+	path string
+}
+
+func (w *externalWriter) Write(buf []byte) (int, error) {
+	if w.h == nil {
+		return 0, fmt.Errorf("writing %s: file already closed", w.path)
+	}
+	if len(buf) == 0 {
+		// an empty chunk would end the file
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(w.h.stdin, "%d\n", len(buf)); err != nil {
+		w.fail()
+		return 0, fmt.Errorf("writing %s to helper: %s", w.path, err)
+	}
+	n, err := w.h.stdin.Write(buf)
+	if err != nil {
+		w.fail()
+		return n, fmt.Errorf("writing %s to helper: %s", w.path, err)
+	}
+	return n, nil
+}
+
+func (w *externalWriter) fail() {
+	w.h.kill()
+	w.h = nil
+}
+
+func (w *externalWriter) Close() error {
+	if w.h == nil {
+		return fmt.Errorf("writing %s: file already closed", w.path)
+	}
+	h := w.h
+	w.h = nil
+	if _, err := fmt.Fprintf(h.stdin, "0\n"); err != nil {
+		h.kill()
+		return fmt.Errorf("writing %s to helper: %s", w.path, err)
+	}
+	_, err := h.response()
+	if _, ok := err.(*externalError); err != nil && !ok {
+		h.kill()
+		return fmt.Errorf("creating %s: %w", w.path, err)
+	}
+	w.e.put(h)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", w.path, err)
+	}
+	return nil
+}
+
+func (e *external) Rename(opath, npath string) (err error) {
+	_, h, err := e.run("rename", opath, npath)
+	if h != nil {
+		e.put(h)
+	}
+	if err != nil {
+		return fmt.Errorf("renaming %s: %w", opath, err)
+	}
+	return nil
+}
+
+func (e *external) Delete(path string) (err error) {
+	_, h, err := e.run("delete", path)
+	if h != nil {
+		e.put(h)
+	}
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return nil
+}
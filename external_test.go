@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exampleHelper returns the command for the reference helper, skipping the test if it cannot run.
+func exampleHelper(t *testing.T) []string {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available for running bolong-exec-example.sh")
+	}
+	path, err := filepath.Abs("bolong-exec-example.sh")
+	if err != nil {
+		t.Fatalf("abs: %s", err)
+	}
+	return []string{"bash", path}
+}
+
+func TestExternal(t *testing.T) {
+	command := exampleHelper(t)
+	dir, err := ioutil.TempDir("", "bolong-exec")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &external{command: command, path: dir}
+
+	write := func(path string, data ...string) {
+		t.Helper()
+		w, err := e.Create(path)
+		if err != nil {
+			t.Fatalf("create %s: %s", path, err)
+		}
+		for _, s := range data {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatalf("write %s: %s", path, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close %s: %s", path, err)
+		}
+	}
+	read := func(path string, offset, length int64) string {
+		t.Helper()
+		rc, err := e.OpenRange(path, offset, length)
+		if err != nil {
+			t.Fatalf("open %s: %s", path, err)
+		}
+		buf, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("read %s: %s", path, err)
+		}
+		rc.Close()
+		return string(buf)
+	}
+
+	// binary data, with newlines and nul bytes
+	data := "line\nwith\x00nul\n0\n" + strings.Repeat("0123456789", 10000)
+	write("20171222-0001.data", data[:5], "", data[5:])
+	write("20171222-0001.index1.full.tmp", "index")
+	write("empty")
+
+	names, err := e.List()
+	if err != nil || strings.Join(names, ",") != "20171222-0001.data,20171222-0001.index1.full.tmp,empty" {
+		t.Errorf("list, got %v, %v", names, err)
+	}
+	if s := read("20171222-0001.data", 0, -1); s != data {
+		t.Errorf("read, got %d bytes, expected %d", len(s), len(data))
+	}
+	if s := read("20171222-0001.data", 5, 10); s != data[5:15] {
+		t.Errorf("read range, got %q", s)
+	}
+	if s := read("20171222-0001.data", int64(len(data)-3), 10); s != data[len(data)-3:] {
+		t.Errorf("read range beyond end, got %q", s)
+	}
+	if s := read("empty", 0, -1); s != "" {
+		t.Errorf("read empty file, got %q", s)
+	}
+
+	// a partially read file stops that helper, a new one is started for other operations
+	rc, err := e.Open("20171222-0001.data")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if s := read("20171222-0001.index1.full.tmp", 0, -1); s != "index" {
+		t.Errorf("read while other file is open, got %q", s)
+	}
+	buf := make([]byte, 10)
+	if _, err := rc.Read(buf); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	rc.Close()
+
+	if _, err := e.Open("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("open of missing file, got %v, expected not exist", err)
+	}
+	if err := e.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+		t.Errorf("rename: %s", err)
+	}
+	if err := e.Delete("empty"); err != nil {
+		t.Errorf("delete: %s", err)
+	}
+	if err := e.Delete("empty"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("delete of missing file, got %v, expected not exist", err)
+	}
+	if _, err := e.Create("with space"); err == nil {
+		t.Errorf("create of path with space succeeded")
+	}
+	names, err = e.List()
+	if err != nil || strings.Join(names, ",") != "20171222-0001.data,20171222-0001.index1.full" {
+		t.Errorf("list, got %v, %v", names, err)
+	}
+	testDestinationDir(t, e)
+
+	// a helper that doesn't speak the protocol
+	e = &external{command: []string{"echo", "hi"}}
+	if _, err := e.List(); err == nil {
+		t.Errorf("list with bad helper succeeded")
+	}
+}
+
+// TestExternalBackups runs the backup tests with the example exec helper.
+func TestExternalBackups(t *testing.T) {
+	command := exampleHelper(t)
+	setMain := func(c *configuration) {
+		c.Kind = "exec"
+		c.Exec.Command = command
+		c.Exec.Path = "testdir/backup"
+		c.Retries = -1 // the helper failing to start is not temporary
+	}
+	removeMain := func() {
+		err := os.RemoveAll("testdir/backup")
+		if err != nil {
+			t.Errorf("removing tree: %s", err)
+		}
+	}
+	testBackups(t, setMain, removeMain)
+}
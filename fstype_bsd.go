@@ -0,0 +1,24 @@
+// +build darwin freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fsType returns the name of the type of file system that path is on.
+func fsType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", fmt.Errorf("statfs %s: %s", path, err)
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fsMagic maps the type of a file system, as returned by statfs, to its name.
+// Devtmpfs has the type of tmpfs, and nfs4 that of nfs.
+var fsMagic = map[uint32]string{
+	0x0187:     "autofs",
+	0x42494e4d: "binfmt_misc",
+	0xcafe4a11: "bpf",
+	0x9123683e: "btrfs",
+	0x27e0eb:   "cgroup",
+	0x63677270: "cgroup2",
+	0xff534d42: "cifs",
+	0x62656570: "configfs",
+	0x64626720: "debugfs",
+	0x1cd1:     "devpts",
+	0xde5e81e4: "efivarfs",
+	0xef53:     "ext4",
+	0x65735546: "fuse",
+	0x65735543: "fusectl",
+	0x958458f6: "hugetlbfs",
+	0x19800202: "mqueue",
+	0x6969:     "nfs",
+	0x6e736673: "nsfs",
+	0x794c7630: "overlay",
+	0x9fa0:     "proc",
+	0x6165676d: "pstore",
+	0x858458f6: "ramfs",
+	0x73636673: "securityfs",
+	0xfe534d42: "smb2",
+	0x73717368: "squashfs",
+	0x62656572: "sysfs",
+	0x01021994: "tmpfs",
+	0x74726163: "tracefs",
+	0x4d44:     "vfat",
+	0x58465342: "xfs",
+	0x2fc12fc1: "zfs",
+}
+
+// fsType returns the name of the type of file system that path is on.
+func fsType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", fmt.Errorf("statfs %s: %s", path, err)
+	}
+	magic := uint32(st.Type)
+	if name, ok := fsMagic[magic]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", magic), nil
+}
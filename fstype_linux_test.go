@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMountPoints(t *testing.T) {
+	// names returns the paths in the latest backup
+	names := func() map[string]bool {
+		t.Helper()
+		l := map[string]bool{}
+		for _, f := range latestIndex(t).contents {
+			l[f.name] = true
+		}
+		return l
+	}
+
+	if _, err := os.Stat("/proc/self"); err == nil {
+		if typ, err := fsType("/proc"); err != nil || typ != "proc" {
+			t.Errorf("file system type of /proc, got %q, %v", typ, err)
+		}
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"file": "data"})
+	tcheck(t, os.Mkdir("testdir/workdir/mnt", 0777), "making mount point")
+	if err := syscall.Mount("bolongtest", "testdir/workdir/mnt", "tmpfs", 0, ""); err != nil {
+		t.Skipf("cannot mount tmpfs: %s", err)
+	}
+	defer syscall.Unmount("testdir/workdir/mnt", 0)
+	writeTestFiles(t, "testdir/workdir/mnt", map[string]string{"file": "data"})
+
+	backup := func(c configuration, name string) {
+		t.Helper()
+		setupTestConfig(t, c)
+		backupCmd([]string{"testdir/workdir"}, name)
+	}
+
+	backup(configuration{}, "20171222-0001")
+	if l := names(); !l["mnt"] || !l["mnt/file"] {
+		t.Errorf("backup without skipping, got %v", l)
+	}
+
+	backup(configuration{SkipFilesystems: []string{"proc", "tmpfs"}}, "20171222-0002")
+	if l := names(); !l["file"] || !l["mnt"] || l["mnt/file"] {
+		t.Errorf("backup skipping tmpfs, got %v", l)
+	}
+	backup(configuration{SkipFilesystems: []string{"nfs"}}, "20171222-0003")
+	if l := names(); !l["mnt/file"] {
+		t.Errorf("backup skipping nfs, got %v", l)
+	}
+
+	backup(configuration{OneFileSystem: true}, "20171222-0004")
+	if l := names(); !l["file"] || !l["mnt"] || l["mnt/file"] {
+		t.Errorf("backup of one file system, got %v", l)
+	}
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if l, err := ioutil.ReadDir("testdir/restore/mnt"); err != nil || len(l) != 0 {
+		t.Errorf("restored mount point, got %v, %v", l, err)
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+)
+
+// fsType returns an error, file system types are not known on these systems.
+func fsType(path string) (string, error) {
+	return "", errors.New("file system types not supported on this system")
+}
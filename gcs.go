@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// default endpoints for gcs, overridden by the token_uri in the service account key file and the config file.
+	gcsEndpoint = "https://storage.googleapis.com"
+	gcsTokenURL = "https://oauth2.googleapis.com/token"
+
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// gcs is a destination for Google Cloud Storage, using its JSON API.
+// Requests are authorized with OAuth2 access tokens for a service account.
+type gcs struct {
+	endpoint string // eg "https://storage.googleapis.com", no trailing slash
+	auth     *gcsAuth
+	bucket   string
+	path     string // starts and ends with slash
+	partSize int    // in bytes, size of chunks of resumable uploads, a multiple of 256KB
+}
+
+var _ destination = &gcs{}
+
+// gcsServiceAccount is the JSON key file of a service account, as downloaded from the Google Cloud console.
+type gcsServiceAccount struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcsAuth gets access tokens with a JWT signed by the key of the service account, and caches them until they are about to expire.
+type gcsAuth struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURL string
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// parseGCSServiceAccount parses the JSON key file of a service account.
+// If tokenURL is empty, the token_uri from the key file is used, or the default.
+func parseGCSServiceAccount(buf []byte, tokenURL string) (*gcsAuth, error) {
+	var sa gcsServiceAccount
+	if err := json.Unmarshal(buf, &sa); err != nil {
+		return nil, fmt.Errorf("parsing service account key file: %s", err)
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, fmt.Errorf("not a service account key file")
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no pem-encoded private key in service account key file")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		key, ok = k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in service account key file is not an rsa key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parsing private key from service account key file: %s", err)
+	}
+	if tokenURL == "" {
+		tokenURL = sa.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = gcsTokenURL
+	}
+	return &gcsAuth{email: sa.ClientEmail, keyID: sa.PrivateKeyID, key: key, tokenURL: tokenURL}, nil
+}
+
+// jwt returns a signed assertion for requesting an access token.
+func (a *gcsAuth) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   a.email,
+		"scope": gcsScope,
+		"aud":   a.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	msg := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", fmt.Errorf("signing jwt: %s", err)
+	}
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// accessToken returns a cached access token, or requests a new one if it is about to expire.
+func (a *gcsAuth) accessToken() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	if a.token != "" && now.Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+	assertion, err := a.jwt(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := http.PostForm(a.tokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("requesting access token: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+	if resp.StatusCode != 200 {
+		detail := result.Error
+		if result.ErrorDescription != "" {
+			detail += ": " + result.ErrorDescription
+		}
+		return "", &httpStatusError{"requesting access token", 200, resp.StatusCode, detail}
+	}
+	if err != nil {
+		return "", fmt.Errorf("parsing access token response: %s", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("missing access token in response")
+	}
+	a.token = result.AccessToken
+	a.expires = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+// invalidate drops the cached access token, e.g. after it was refused.
+func (a *gcsAuth) invalidate() {
+	a.Lock()
+	defer a.Unlock()
+	a.token = ""
+}
+
+// objectURL returns the url of the metadata of path in our bucket.
+func (r *gcs) objectURL(path string) string {
+	return r.endpoint + "/storage/v1/b/" + url.PathEscape(r.bucket) + "/o/" + url.PathEscape(r.path[1:]+path)
+}
+
+// do executes an authorized request. On success, the response is returned and the
+// caller must close its body. On error, or if the status code is not one of
+// expectStatus, an error is returned and the response body is closed.
+func (r *gcs) do(method, u string, header http.Header, body []byte, expectStatus ...int) (*http.Response, error) {
+	token, err := r.auth.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expectStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		r.auth.invalidate()
+	}
+	var e struct {
+		Error struct {
+			Message string
+		}
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 16*1024)).Decode(&e)
+	return nil, &httpStatusError{"", expectStatus[0], resp.StatusCode, e.Error.Message}
+}
+
+// List returns filenames, ordered by name.
+// Only objects directly in our path are listed, not those in nested subpaths.
+func (r *gcs) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *gcs) ListDir(dir string) (names []string, err error) {
+	prefix := r.path[1:]
+	if dir != "" {
+		prefix += dir + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		query.Set("fields", "items(name),nextPageToken")
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		resp, err := r.do("GET", r.endpoint+"/storage/v1/b/"+url.PathEscape(r.bucket)+"/o?"+query.Encode(), nil, nil, 200)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", "/"+r.bucket+"/"+prefix, err)
+		}
+		var list struct {
+			Items []struct {
+				Name string
+			}
+			NextPageToken string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing directory contents json: %s", err)
+		}
+		for _, item := range list.Items {
+			if !strings.HasPrefix(item.Name, prefix) {
+				return nil, fmt.Errorf("listing %s: object %q does not have requested prefix", "/"+r.bucket+"/"+prefix, item.Name)
+			}
+			if item.Name == prefix {
+				// placeholder object for the directory, as created by some tools
+				continue
+			}
+			names = append(names, item.Name[len(prefix):])
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		if list.NextPageToken == token {
+			return nil, fmt.Errorf("listing %s: next page token did not change", "/"+r.bucket+"/"+prefix)
+		}
+		token = list.NextPageToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *gcs) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *gcs) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	var header http.Header
+	expect := 200
+	if rng := httpRange(offset, length); rng != "" {
+		header = http.Header{"Range": {rng}}
+		expect = 206
+	}
+	resp, err := r.do("GET", r.objectURL(path)+"?alt=media", header, nil, expect)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+// Create returns a writer for a new file. Files larger than a chunk are sent
+// with a resumable upload, one chunk at a time, so a failure halfway only
+// requires sending the rest of a chunk again. Smaller files are uploaded in a
+// single request.
+func (r *gcs) Create(path string) (w io.WriteCloser, err error) {
+	return &gcsWriter{r: r, path: path}, nil
+}
+
+func (r *gcs) uploadURL(path, uploadType string) string {
+	query := url.Values{"uploadType": {uploadType}, "name": {r.path[1:] + path}}
+	return r.endpoint + "/upload/storage/v1/b/" + url.PathEscape(r.bucket) + "/o?" + query.Encode()
+}
+
+// gcsWriter buffers a chunk of data, and sends it when full as part of a resumable upload.
+type gcsWriter struct {
+	r       *gcs
+	path    string
+	buf     []byte
+	session string // url of the resumable upload, once started
+	offset  int64  // of start of buf in the file
+	err     error  // first error, further writes fail
+}
+
+func (w *gcsWriter) Write(buf []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(buf) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.r.partSize)
+		}
+		m := w.r.partSize - len(w.buf)
+		if m > len(buf) {
+			m = len(buf)
+		}
+		w.buf = append(w.buf, buf[:m]...)
+		buf = buf[m:]
+		n += m
+		if len(w.buf) == w.r.partSize {
+			if err := w.upload(false); err != nil {
+				w.err = err
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *gcsWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	// any further writes or closes are errors
+	defer func() {
+		w.err = fmt.Errorf("writing %s: file already closed", w.path)
+	}()
+
+	if w.session == "" {
+		buf := w.buf
+		if buf == nil {
+			buf = []byte{}
+		}
+		resp, err := w.r.do("POST", w.r.uploadURL(w.path, "media"), nil, buf, 200)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", w.path, err)
+		}
+		return resp.Body.Close()
+	}
+	return w.upload(true)
+}
+
+// abort cancels the resumable upload, if started, so no partial file is stored.
+func (w *gcsWriter) abort() {
+	w.err = fmt.Errorf("writing %s: upload aborted", w.path)
+	if w.session == "" {
+		return
+	}
+	// gcs responds with status 499 to a cancelled upload. best effort, the
+	// original error is more interesting, and unfinished uploads expire.
+	resp, err := w.r.do("DELETE", w.session, nil, nil, 499, 204)
+	if err == nil {
+		resp.Body.Close()
+	}
+	w.session = ""
+}
+
+// upload sends the buffered chunk, starting the resumable upload if needed.
+// The final chunk completes the upload. After a failure, we ask the server how much it
+// has received, and continue from there.
+func (w *gcsWriter) upload(final bool) error {
+	if w.session == "" {
+		resp, err := w.r.do("POST", w.r.uploadURL(w.path, "resumable"), nil, []byte{}, 200)
+		if err != nil {
+			return fmt.Errorf("starting resumable upload for %s: %w", w.path, err)
+		}
+		resp.Body.Close()
+		w.session = resp.Header.Get("Location")
+		if w.session == "" {
+			return fmt.Errorf("starting resumable upload for %s: missing location in response", w.path)
+		}
+	}
+
+	retries, delay := retrySettings()
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("uploading chunk of %s failed, retrying in %s: %s", w.path, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+
+			var done bool
+			done, err = w.send(nil, "bytes */*")
+			if err != nil {
+				continue
+			}
+			if done {
+				return nil
+			}
+		}
+
+		size := "*"
+		if final {
+			size = fmt.Sprintf("%d", w.offset+int64(len(w.buf)))
+		}
+		rng := fmt.Sprintf("bytes */%s", size)
+		if len(w.buf) > 0 {
+			rng = fmt.Sprintf("bytes %d-%d/%s", w.offset, w.offset+int64(len(w.buf))-1, size)
+		}
+		var done bool
+		done, err = w.send(w.buf, rng)
+		if err == nil && final && !done {
+			err = fmt.Errorf("upload not complete after final chunk")
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("uploading %s: %w", w.path, err)
+}
+
+// send puts buf to the upload session, with contentRange, and returns whether the upload is complete.
+// The data the server has received is removed from the buffer.
+func (w *gcsWriter) send(buf []byte, contentRange string) (done bool, err error) {
+	header := http.Header{"Content-Range": {contentRange}}
+	if buf == nil {
+		buf = []byte{}
+	}
+	resp, err := w.r.do("PUT", w.session, header, buf, 200, 201, 308)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 308 {
+		w.offset += int64(len(w.buf))
+		w.buf = w.buf[:0]
+		return true, nil
+	}
+
+	// Range is absent if the server has nothing yet, otherwise "bytes=0-<last>".
+	var received int64
+	if rng := resp.Header.Get("Range"); rng != "" {
+		if !strings.HasPrefix(rng, "bytes=0-") {
+			return false, fmt.Errorf("bad range %q in response", rng)
+		}
+		last, err := strconv.ParseInt(rng[len("bytes=0-"):], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("bad range %q in response", rng)
+		}
+		received = last + 1
+	}
+	if received < w.offset || received > w.offset+int64(len(w.buf)) {
+		return false, fmt.Errorf("server received %d bytes, outside of chunk at %d with %d bytes", received, w.offset, len(w.buf))
+	}
+	n := copy(w.buf, w.buf[received-w.offset:])
+	w.buf = w.buf[:n]
+	w.offset = received
+	return false, nil
+}
+
+// Rename copies the file to the new name at the server, then removes the original.
+// Large objects may take multiple requests to copy.
+func (r *gcs) Rename(opath, npath string) (err error) {
+	token := ""
+	for {
+		u := r.objectURL(opath) + "/rewriteTo/b/" + url.PathEscape(r.bucket) + "/o/" + url.PathEscape(r.path[1:]+npath)
+		if token != "" {
+			u += "?rewriteToken=" + url.QueryEscape(token)
+		}
+		resp, err := r.do("POST", u, nil, []byte{}, 200)
+		if err != nil {
+			return fmt.Errorf("copying resource: %w", err)
+		}
+		var result struct {
+			Done         bool
+			RewriteToken string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("copying resource: parsing response: %s", err)
+		}
+		if result.Done {
+			break
+		}
+		if result.RewriteToken == "" {
+			return fmt.Errorf("copying resource: not done, but no rewrite token")
+		}
+		token = result.RewriteToken
+	}
+
+	err = r.Delete(opath)
+	if err != nil {
+		return fmt.Errorf("deleting original resource after copying: %w", err)
+	}
+	return nil
+}
+
+func (r *gcs) Delete(path string) (err error) {
+	resp, err := r.do("DELETE", r.objectURL(path), nil, nil, 204)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
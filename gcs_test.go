@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCSJSON is a minimal server for the JSON API of Google Cloud Storage, for a
+// single bucket, and the OAuth2 token endpoint at /token. Assertions for tokens
+// must be signed by the service account key, requests need a token.
+type fakeGCSJSON struct {
+	key        *rsa.PrivateKey
+	email      string
+	bucket     string
+	maxResults int
+
+	sync.Mutex
+	tokens        map[string]bool
+	tokenRequests int
+	objects       map[string][]byte
+	sessions      map[string][]byte // data received for resumable uploads, by upload id
+	nextID        int
+	failChunks    int // number of chunks that fail after the server received half of the data
+	rewriteSteps  int // number of rewrite requests that are not done yet
+	down          bool
+}
+
+func newFakeGCSJSON(t *testing.T) *fakeGCSJSON {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	return &fakeGCSJSON{
+		key:        key,
+		email:      "backup@project.iam.gserviceaccount.com",
+		bucket:     "bucket",
+		maxResults: 1000,
+		tokens:     map[string]bool{},
+		objects:    map[string][]byte{},
+		sessions:   map[string][]byte{},
+	}
+}
+
+// writeKeyFile writes a service account key file to dir, with tokenURL as token_uri, and returns its path.
+func (s *fakeGCSJSON) writeKeyFile(t *testing.T, dir, tokenURL string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(s.key)
+	if err != nil {
+		t.Fatalf("marshal key: %s", err)
+	}
+	sa := gcsServiceAccount{
+		Type:         "service_account",
+		ClientEmail:  s.email,
+		PrivateKeyID: "key1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenURL,
+	}
+	buf, err := json.Marshal(sa)
+	if err != nil {
+		t.Fatalf("marshal key file: %s", err)
+	}
+	path := dir + "/service-account.json"
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("writing key file: %s", err)
+	}
+	return path
+}
+
+func (s *fakeGCSJSON) error(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, msg)
+}
+
+// token verifies the jwt assertion and returns a new access token.
+func (s *fakeGCSJSON) token(w http.ResponseWriter, r *http.Request) {
+	s.tokenRequests++
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	t := strings.Split(r.FormValue("assertion"), ".")
+	if len(t) != 3 {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t[2])
+	h := sha256.Sum256([]byte(t[0] + "." + t[1]))
+	if err != nil || rsa.VerifyPKCS1v15(&s.key.PublicKey, crypto.SHA256, h[:], sig) != nil {
+		http.Error(w, `{"error": "invalid_grant", "error_description": "bad signature"}`, http.StatusBadRequest)
+		return
+	}
+	var claims struct {
+		Iss, Scope, Aud string
+		Exp             int64
+	}
+	buf, _ := base64.RawURLEncoding.DecodeString(t[1])
+	if json.Unmarshal(buf, &claims) != nil || claims.Iss != s.email || claims.Scope != gcsScope || claims.Aud != "http://"+r.Host+"/token" || claims.Exp < time.Now().Unix() {
+		http.Error(w, `{"error": "invalid_grant", "error_description": "bad claims"}`, http.StatusBadRequest)
+		return
+	}
+	token := fmt.Sprintf("token%d", s.tokenRequests)
+	s.tokens[token] = true
+	fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3600, "token_type": "Bearer"}`, token)
+}
+
+func (s *fakeGCSJSON) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "reading body")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.down {
+		s.error(w, http.StatusServiceUnavailable, "down")
+		return
+	}
+	if r.URL.Path == "/token" && r.Method == "POST" {
+		s.token(w, r)
+		return
+	}
+	if !s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		s.error(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	// object names are escaped as a single path element, with slashes as %2F
+	var elems []string
+	for _, e := range strings.Split(r.URL.EscapedPath(), "/")[1:] {
+		ue, err := url.PathUnescape(e)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "bad path")
+			return
+		}
+		elems = append(elems, ue)
+	}
+	q := r.URL.Query()
+	path := strings.Join(elems, "|")
+	bucketPrefix := "storage|v1|b|" + s.bucket + "|o"
+	uploadPrefix := "upload|storage|v1|b|" + s.bucket + "|o"
+
+	switch {
+	case r.Method == "GET" && path == bucketPrefix:
+		prefix := q.Get("prefix")
+		delim := q.Get("delimiter")
+		var names []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, prefix) && k >= q.Get("pageToken") && (delim == "" || !strings.Contains(k[len(prefix):], delim)) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		type item struct {
+			Name string `json:"name"`
+		}
+		var result struct {
+			Items         []item `json:"items,omitempty"`
+			NextPageToken string `json:"nextPageToken,omitempty"`
+		}
+		if len(names) > s.maxResults {
+			// page tokens are opaque, we use the first name of the next page
+			result.NextPageToken = names[s.maxResults]
+			names = names[:s.maxResults]
+		}
+		for _, name := range names {
+			result.Items = append(result.Items, item{name})
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && len(elems) == 6 && path == bucketPrefix+"|"+elems[5] && q.Get("alt") == "media":
+		buf, ok := s.objects[elems[5]]
+		if !ok {
+			s.error(w, http.StatusNotFound, "no such object")
+			return
+		}
+		// handles range requests
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	case r.Method == "POST" && path == uploadPrefix && q.Get("uploadType") == "media":
+		s.objects[q.Get("name")] = body
+		fmt.Fprintf(w, `{"name": %q}`, q.Get("name"))
+	case r.Method == "POST" && path == uploadPrefix && q.Get("uploadType") == "resumable":
+		s.nextID++
+		id := fmt.Sprintf("%s|upload%d", q.Get("name"), s.nextID)
+		s.sessions[id] = []byte{}
+		w.Header().Set("Location", "http://"+r.Host+"/upload/storage/v1/b/"+s.bucket+"/o?"+url.Values{"uploadType": {"resumable"}, "upload_id": {id}}.Encode())
+	case r.Method == "PUT" && path == uploadPrefix && q.Get("upload_id") != "":
+		id := q.Get("upload_id")
+		buf, ok := s.sessions[id]
+		if !ok {
+			s.error(w, http.StatusNotFound, "no such upload")
+			return
+		}
+		var start, end, total int64 = -1, -1, -1
+		cr := r.Header.Get("Content-Range")
+		if strings.HasPrefix(cr, "bytes */") {
+			fmt.Sscanf(cr, "bytes */%d", &total)
+		} else if n, _ := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total); n < 2 || end-start+1 != int64(len(body)) {
+			s.error(w, http.StatusBadRequest, "bad content-range")
+			return
+		}
+		if start >= 0 {
+			if start > int64(len(buf)) {
+				s.error(w, http.StatusBadRequest, "chunk starts beyond received data")
+				return
+			}
+			data := body[int64(len(buf))-start:]
+			if s.failChunks > 0 && len(data) > 1 {
+				s.failChunks--
+				s.sessions[id] = append(buf, data[:len(data)/2]...)
+				s.error(w, http.StatusServiceUnavailable, "lost connection")
+				return
+			}
+			buf = append(buf, data...)
+			s.sessions[id] = buf
+		}
+		if total >= 0 && total == int64(len(buf)) {
+			delete(s.sessions, id)
+			s.objects[strings.SplitN(id, "|", 2)[0]] = buf
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		if len(buf) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(buf)-1))
+		}
+		w.WriteHeader(308)
+	case r.Method == "DELETE" && path == uploadPrefix && q.Get("upload_id") != "":
+		id := q.Get("upload_id")
+		if _, ok := s.sessions[id]; !ok {
+			s.error(w, http.StatusNotFound, "no such upload")
+			return
+		}
+		delete(s.sessions, id)
+		w.WriteHeader(499)
+	case r.Method == "POST" && len(elems) == 11 && path == bucketPrefix+"|"+elems[5]+"|rewriteTo|b|"+s.bucket+"|o|"+elems[10]:
+		buf, ok := s.objects[elems[5]]
+		if !ok {
+			s.error(w, http.StatusNotFound, "no such object")
+			return
+		}
+		if s.rewriteSteps > 0 {
+			s.rewriteSteps--
+			fmt.Fprintf(w, `{"done": false, "rewriteToken": "step%d"}`, s.rewriteSteps)
+			return
+		}
+		s.objects[elems[10]] = buf
+		fmt.Fprint(w, `{"done": true}`)
+	case r.Method == "DELETE" && len(elems) == 6 && path == bucketPrefix+"|"+elems[5]:
+		if _, ok := s.objects[elems[5]]; !ok {
+			s.error(w, http.StatusNotFound, "no such object")
+			return
+		}
+		delete(s.objects, elems[5])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusBadRequest, "bad request")
+	}
+}
+
+func TestGCS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-gcs")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeGCSJSON(t)
+	fake.maxResults = 2 // force paginated listings
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	buf, err := ioutil.ReadFile(fake.writeKeyFile(t, dir, server.URL+"/token"))
+	if err != nil {
+		t.Fatalf("reading key file: %s", err)
+	}
+	auth, err := parseGCSServiceAccount(buf, "")
+	if err != nil {
+		t.Fatalf("parsing key file: %s", err)
+	}
+	r := &gcs{server.URL, auth, fake.bucket, "/host/", 10}
+
+	defer func(d time.Duration) {
+		retryDelayUnit = d
+	}(retryDelayUnit)
+	retryDelayUnit = time.Millisecond
+	defer func(n int) {
+		config.Retries = n
+	}(config.Retries)
+	config.Retries = 0
+
+	fake.objects["host/nested/ignored"] = []byte("x")
+	fake.objects["elsewhere"] = []byte("x")
+	fake.objects["host/"] = []byte{}
+
+	write := func(path, data string) {
+		t.Helper()
+		w, err := r.Create(path)
+		if err != nil {
+			t.Fatalf("create %s: %s", path, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("write %s: %s", path, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close %s: %s", path, err)
+		}
+	}
+
+	// resumable uploads, with chunks that fail after the server received part of them
+	data := "0123456789abcdefghijklmnopqrstuvwxyz"
+	fake.failChunks = 1
+	write("20171222-0001.data", "")
+	write("20171222-0002.data", "0123456789") // exactly one chunk, completed with an empty final chunk
+	write("20171222-0003.data", data[:10])
+	fake.failChunks = 2
+	w, err := r.Create("20171222-0004.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := w.Write([]byte(data[i:end])); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if string(fake.objects["host/20171222-0004.data"]) != data || len(fake.sessions) != 0 || fake.failChunks != 0 {
+		t.Errorf("resumable upload, got %q, %d sessions left, %d chunks to fail", fake.objects["host/20171222-0004.data"], len(fake.sessions), fake.failChunks)
+	}
+	if string(fake.objects["host/20171222-0002.data"]) != "0123456789" || string(fake.objects["host/20171222-0003.data"]) != "0123456789" {
+		t.Errorf("single chunk uploads, got %q and %q", fake.objects["host/20171222-0002.data"], fake.objects["host/20171222-0003.data"])
+	}
+
+	// an aborted upload does not store a partial file
+	w, err = r.Create("20171222-0005.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if len(fake.sessions) != 1 {
+		t.Fatalf("got %d upload sessions, expected 1", len(fake.sessions))
+	}
+	w.(aborter).abort()
+	if _, ok := fake.objects["host/20171222-0005.data"]; ok || len(fake.sessions) != 0 {
+		t.Errorf("aborted upload, object stored %v, %d sessions left", ok, len(fake.sessions))
+	}
+	if err := w.Close(); err == nil {
+		t.Errorf("close after abort succeeded")
+	}
+
+	write("20171222-0004.index1.full.tmp", "small+file")
+	write("name with space", "x")
+
+	names, err := r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	exp := []string{"20171222-0001.data", "20171222-0002.data", "20171222-0003.data", "20171222-0004.data", "20171222-0004.index1.full.tmp", "name with space"}
+	if strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Errorf("list, got %v, expected %v", names, exp)
+	}
+
+	rc, err := r.OpenRange("20171222-0004.data", 10, 5)
+	if err != nil {
+		t.Fatalf("open range: %s", err)
+	}
+	buf, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "abcde" {
+		t.Errorf("read range, got %q, %v", buf, err)
+	}
+
+	fake.rewriteSteps = 2
+	if err := r.Rename("20171222-0004.index1.full.tmp", "20171222-0004.index1.full"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if _, err := r.Open("20171222-0004.index1.full.tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("open of renamed file, got %v, expected not found", err)
+	}
+	if err := r.Delete("name with space"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if string(fake.objects["host/20171222-0004.index1.full"]) != "small+file" || fake.objects["host/name with space"] != nil {
+		t.Errorf("unexpected objects at server after rename and delete")
+	}
+
+	// tokens are reused, and a refused token is replaced
+	if fake.tokenRequests != 1 {
+		t.Errorf("got %d token requests, expected 1", fake.tokenRequests)
+	}
+	fake.tokens = map[string]bool{}
+	if _, err := r.List(); err == nil {
+		t.Errorf("list with revoked token succeeded")
+	}
+	if _, err := r.List(); err != nil || fake.tokenRequests != 2 {
+		t.Errorf("list after revoked token, got %v, %d token requests", err, fake.tokenRequests)
+	}
+
+	testDestinationDir(t, r)
+
+	// assertions signed with another key are refused
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	r.auth = &gcsAuth{email: fake.email, key: other, tokenURL: server.URL + "/token"}
+	if _, err := r.List(); err == nil {
+		t.Errorf("list with token for wrong key succeeded")
+	}
+}
+
+// TestGCSBackups runs the backup tests against the fake GCS server.
+func TestGCSBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-gcs")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFakeGCSJSON(t)
+	fake.maxResults = 3 // force paginated listings
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	keyFile := fake.writeKeyFile(t, dir, "https://oauth2.googleapis.com/token")
+	setMain := func(c *configuration) {
+		c.Kind = "gcs"
+		c.GCS.Endpoint = server.URL
+		c.GCS.TokenURL = server.URL + "/token"
+		c.GCS.KeyFile = keyFile
+		c.GCS.Bucket = fake.bucket
+		c.GCS.Path = "/host/"
+		c.Retries = -1 // the server going down is not temporary
+	}
+	testBackups(t, setMain, markDown(fake, &fake.down))
+}
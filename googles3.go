@@ -1,37 +1,115 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sort"
+	"strings"
 	"time"
 )
 
+// default endpoint for googleS3, the XML API of Google Cloud Storage.
+const googleS3Endpoint = "https://storage.googleapis.com"
+
 type googleS3 struct {
-	bucket string // no slashes
-	path   string // starts and ends with slash
+	endpoint  string // eg "https://storage.googleapis.com", no trailing slash
+	accessKey string
+	secret    string
+	bucket    string // no slashes
+	path      string // starts and ends with slash
+	partSize  int    // in bytes, for multipart uploads of data files
+	inFlight  int    // max number of parts uploading concurrently
 }
 
 var _ destination = &googleS3{}
+var _ multipartUploader = &googleS3{}
 
 // Make HTTP authorization header for AWS-style authentication.
 func (r *googleS3) authorize(msg string) string {
-	h := hmac.New(sha1.New, []byte(config.GoogleS3.Secret))
+	h := hmac.New(sha1.New, []byte(r.secret))
 	h.Write([]byte(msg))
 	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	return fmt.Sprintf("AWS %s:%s", config.GoogleS3.AccessKey, sig)
+	return fmt.Sprintf("AWS %s:%s", r.accessKey, sig)
 }
 
 // List returns filenames, ordered by name.
+// Listings are returned in pages of at most 1000 objects, we follow the markers until we have all names.
+// Only objects directly in our path are listed, not those in nested subpaths.
 func (r *googleS3) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *googleS3) ListDir(dir string) (names []string, err error) {
+	prefix := r.path[1:]
+	if dir != "" {
+		prefix += dir + "/"
+	}
+	marker := ""
+	for {
+		page, err := r.listPage(prefix, marker)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page.Key {
+			// the marker is exclusive, so keys must be beyond it
+			if !strings.HasPrefix(key, prefix) || key <= marker || strings.Contains(key[len(prefix):], "/") {
+				return nil, fmt.Errorf("listing %s: inconsistent listing, unexpected key %q after marker %q", "/"+r.bucket+"/"+prefix, key, marker)
+			}
+			marker = key
+			if key == prefix {
+				// placeholder object for the directory, as created by some tools
+				continue
+			}
+			names = append(names, key[len(prefix):])
+		}
+		if !page.IsTruncated {
+			break
+		}
+		// NextMarker is only returned when a delimiter is used, but we can always fall back to the last key.
+		if page.NextMarker != "" {
+			if page.NextMarker < marker {
+				return nil, fmt.Errorf("listing %s: inconsistent listing, next marker %q before last key %q", "/"+r.bucket+"/"+prefix, page.NextMarker, marker)
+			}
+			marker = page.NextMarker
+		} else if len(page.Key) == 0 {
+			return nil, fmt.Errorf("listing %s: inconsistent listing, truncated without keys or next marker", "/"+r.bucket+"/"+prefix)
+		}
+	}
+	// names should already be sorted, but let's be sure...
+	sort.Strings(names)
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			return nil, fmt.Errorf("listing %s: inconsistent listing, duplicate name %q", "/"+r.bucket+"/"+prefix, names[i])
+		}
+	}
+	return names, nil
+}
+
+type googleS3ListPage struct {
+	Key         []string `xml:"Contents>Key"`
+	IsTruncated bool
+	NextMarker  string
+}
+
+// listPage fetches a single page of the listing, for keys following marker.
+func (r *googleS3) listPage(prefix, marker string) (*googleS3ListPage, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("delimiter", "/")
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://storage.googleapis.com/"+r.bucket+"/?prefix="+url.QueryEscape(r.path[1:]), nil)
+	req, err := http.NewRequest("GET", r.endpoint+"/"+r.bucket+"/?"+query.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -51,42 +129,37 @@ func (r *googleS3) List() (names []string, err error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, fmt.Errorf("listing %s: status code not 200 but %d", "/"+r.bucket+r.path, resp.StatusCode)
+		return nil, &httpStatusError{"listing " + "/" + r.bucket + r.path, 200, resp.StatusCode, ""}
 	}
 
-	var list struct {
-		Key []string `xml:"Contents>Key"`
-	}
-	err = xml.NewDecoder(resp.Body).Decode(&list)
+	page := &googleS3ListPage{}
+	err = xml.NewDecoder(resp.Body).Decode(page)
 	if err != nil {
 		return nil, fmt.Errorf("parsing directory contents xml: %s", err)
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		return nil, fmt.Errorf("closing http reponse: %s", err)
-	}
-	prefix := len(r.path[1:])
-	for i, name := range list.Key {
-		list.Key[i] = name[prefix:]
-	}
-	// names should already be sorted, but let's be sure...
-	sort.Slice(list.Key, func(i, j int) bool {
-		return list.Key[i] < list.Key[j]
-	})
-	return list.Key, nil
+	return page, nil
 }
 
 func (r *googleS3) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *googleS3) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://storage.googleapis.com/"+r.bucket+url.PathEscape(r.path+path), nil)
+	req, err := http.NewRequest("GET", r.endpoint+"/"+r.bucket+url.PathEscape(r.path+path), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	date := time.Now().UTC().Format(time.RFC1123Z)
 	req.Header.Add("Date", date)
+	expect := 200
+	if rng := httpRange(offset, length); rng != "" {
+		req.Header.Add("Range", rng)
+		expect = 206
+	}
 
 	msg := "GET\n"
 	msg += "\n"
@@ -100,33 +173,23 @@ func (r *googleS3) Open(path string) (rc io.ReadCloser, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != expect {
 		resp.Body.Close()
-		return nil, fmt.Errorf("opening %s: status code not 200 but %d", path, resp.StatusCode)
+		return nil, &httpStatusError{"opening " + path, expect, resp.StatusCode, ""}
 	}
 	return resp.Body, nil
 }
 
-type s3writer struct {
-	p   *io.PipeWriter
-	err chan error // for waiting until request has completed
-}
-
-func (x *s3writer) Write(buf []byte) (int, error) {
-	return x.p.Write(buf)
-}
-
-func (x *s3writer) Close() error {
-	err := x.p.Close()
-	if err != nil {
-		return err
+// Create returns a writer for a new file. Data files are uploaded in parts,
+// so a failure halfway a large upload only requires sending that part again.
+// Other (small) files are streamed in a single request.
+func (r *googleS3) Create(path string) (w io.WriteCloser, err error) {
+	if strings.HasSuffix(path, ".data") {
+		return newMultipartWriter(r, path, r.partSize, r.inFlight), nil
 	}
-	return <-x.err
-}
 
-func (r *googleS3) Create(path string) (w io.WriteCloser, err error) {
 	client := &http.Client{}
-	req, err := http.NewRequest("PUT", "https://storage.googleapis.com/"+r.bucket+url.PathEscape(r.path+path), nil)
+	req, err := http.NewRequest("PUT", r.endpoint+"/"+r.bucket+url.PathEscape(r.path+path), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -146,28 +209,29 @@ func (r *googleS3) Create(path string) (w io.WriteCloser, err error) {
 	pr, pw := io.Pipe()
 	req.Body = pr
 
-	s3w := &s3writer{p: pw}
-	s3w.err = make(chan error, 1)
+	upload := &pipeWriter{pw, make(chan error, 1)}
 	go func() {
 		resp, err := client.Do(req)
 		if err != nil {
 			pr.CloseWithError(err)
-			s3w.err <- err
+			upload.err <- err
 			return
 		}
+		resp.Body.Close()
 		if resp.StatusCode != 200 {
-			pr.CloseWithError(fmt.Errorf("creating %s: status code not 200 but %d", path, resp.StatusCode))
-			s3w.err <- err
+			err := &httpStatusError{"creating " + path, 200, resp.StatusCode, ""}
+			pr.CloseWithError(err)
+			upload.err <- err
 			return
 		}
-		s3w.err <- nil
+		upload.err <- nil
 	}()
-	return s3w, nil
+	return upload, nil
 }
 
 func (r *googleS3) Rename(opath, npath string) (err error) {
 	client := &http.Client{}
-	req, err := http.NewRequest("PUT", "https://storage.googleapis.com/"+r.bucket+url.PathEscape(r.path+npath), nil)
+	req, err := http.NewRequest("PUT", r.endpoint+"/"+r.bucket+url.PathEscape(r.path+npath), nil)
 	if err != nil {
 		return fmt.Errorf("creating http request: %s", err)
 	}
@@ -191,20 +255,21 @@ func (r *googleS3) Rename(opath, npath string) (err error) {
 	if err != nil {
 		return fmt.Errorf("http request for copying resource: %s", err)
 	}
+	resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("copying resource, http status not 200 but %d", resp.StatusCode)
+		return &httpStatusError{"copying resource", 200, resp.StatusCode, ""}
 	}
 
 	err = r.Delete(opath)
 	if err != nil {
-		return fmt.Errorf("deleting original resource after copying: %s", err)
+		return fmt.Errorf("deleting original resource after copying: %w", err)
 	}
 	return nil
 }
 
 func (r *googleS3) Delete(path string) (err error) {
 	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", "https://storage.googleapis.com/"+r.bucket+url.PathEscape(r.path+path), nil)
+	req, err := http.NewRequest("DELETE", r.endpoint+"/"+r.bucket+url.PathEscape(r.path+path), nil)
 	if err != nil {
 		return err
 	}
@@ -226,7 +291,120 @@ func (r *googleS3) Delete(path string) (err error) {
 	}
 	err = resp.Body.Close()
 	if resp.StatusCode != 204 {
-		return fmt.Errorf("deleting %s: status code not 204 but %d", path, resp.StatusCode)
+		return &httpStatusError{"deleting " + path, 204, resp.StatusCode, ""}
 	}
 	return err
 }
+
+// do executes a signed request for path with an optional subresource (query
+// string, with parameters ordered by name) and body, as used for multipart
+// uploads. If the response status is not expectStatus, an error is returned
+// and the response closed.
+func (r *googleS3) do(method, path, subresource string, body []byte, expectStatus int) (*http.Response, error) {
+	resource := "/" + r.bucket + url.PathEscape(r.path+path)
+	if subresource != "" {
+		resource += "?" + subresource
+	}
+	req, err := http.NewRequest(method, r.endpoint+resource, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	date := time.Now().UTC().Format(time.RFC1123Z)
+	req.Header.Add("Date", date)
+
+	msg := method + "\n"
+	msg += "\n"
+	msg += "\n"
+	msg += date + "\n"
+	msg += resource
+
+	req.Header.Add("Authorization", r.authorize(msg))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectStatus {
+		resp.Body.Close()
+		return nil, &httpStatusError{"", expectStatus, resp.StatusCode, ""}
+	}
+	return resp, nil
+}
+
+func (r *googleS3) putObject(path string, buf []byte) error {
+	if buf == nil {
+		buf = []byte{}
+	}
+	resp, err := r.do("PUT", path, "", buf, 200)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
+
+func (r *googleS3) initUpload(path string) (uploadID string, err error) {
+	resp, err := r.do("POST", path, "uploads", nil, 200)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = s3CheckBody(resp, &result)
+	if err == nil && result.UploadID == "" {
+		err = fmt.Errorf("missing upload id in response")
+	}
+	return result.UploadID, err
+}
+
+func (r *googleS3) uploadPart(path, uploadID string, partNumber int, buf []byte) (etag string, err error) {
+	resp, err := r.do("PUT", path, fmt.Sprintf("partNumber=%d&uploadId=%s", partNumber, url.QueryEscape(uploadID)), buf, 200)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	etag = resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("missing etag in response")
+	}
+	return etag, nil
+}
+
+func (r *googleS3) completeUpload(path, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	buf, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do("POST", path, "uploadId="+url.QueryEscape(uploadID), buf, 200)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3CheckBody(resp, nil)
+}
+
+func (r *googleS3) abortUpload(path, uploadID string) error {
+	resp, err := r.do("DELETE", path, "uploadId="+url.QueryEscape(uploadID), nil, 204)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
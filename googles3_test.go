@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS is a minimal server for the XML API of Google Cloud Storage, for a single bucket.
+// It verifies the (AWS version 2 style) signature of each request.
+type fakeGCS struct {
+	bucket    string
+	accessKey string
+	secret    string
+	maxKeys   int
+
+	sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+	down    bool // if set, all requests fail with a server error
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{
+		bucket:    "bucket",
+		accessKey: "GOOGTESTKEY",
+		secret:    "testsecret",
+		maxKeys:   1000,
+		objects:   map[string][]byte{},
+		uploads:   map[string]map[int][]byte{},
+	}
+}
+
+func (s *fakeGCS) verify(r *http.Request) error {
+	date, err := time.Parse(time.RFC1123Z, r.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("bad date header: %s", err)
+	}
+	if d := time.Since(date); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("date too far off")
+	}
+
+	msg := r.Method + "\n"
+	msg += r.Header.Get("Content-MD5") + "\n"
+	msg += r.Header.Get("Content-Type") + "\n"
+	msg += r.Header.Get("Date") + "\n"
+	var amz []string
+	for k, v := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amz = append(amz, k+":"+strings.Join(v, ","))
+		}
+	}
+	sort.Strings(amz)
+	for _, h := range amz {
+		msg += h + "\n"
+	}
+	msg += r.URL.EscapedPath()
+	// subresources are part of the signed resource, other query parameters are not
+	q := r.URL.Query()
+	if q["uploads"] != nil || q.Get("uploadId") != "" {
+		msg += "?" + r.URL.RawQuery
+	}
+
+	h := hmac.New(sha1.New, []byte(s.secret))
+	h.Write([]byte(msg))
+	exp := fmt.Sprintf("AWS %s:%s", s.accessKey, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if auth := r.Header.Get("Authorization"); auth != exp {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "reading body", http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.verify(r); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", err)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+s.bucket+"/") {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := r.URL.Path[len("/"+s.bucket+"/"):]
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && key == "":
+		prefix := q.Get("prefix")
+		delim := q.Get("delimiter")
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, prefix) && k > q.Get("marker") && (delim == "" || !strings.Contains(k[len(prefix):], delim)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var result struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Key         []string `xml:"Contents>Key"`
+			IsTruncated bool
+			NextMarker  string `xml:",omitempty"`
+		}
+		if len(keys) > s.maxKeys {
+			keys = keys[:s.maxKeys]
+			result.IsTruncated = true
+			if delim != "" {
+				result.NextMarker = keys[len(keys)-1]
+			}
+		}
+		result.Key = keys
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET":
+		buf, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		// handles range requests
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, "bad xml", http.StatusBadRequest)
+			return
+		}
+		var buf []byte
+		for i, p := range complete.Part {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"%d"`, p.PartNumber) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>bad part</Message></Error>")
+				return
+			}
+			buf = append(buf, parts[p.PartNumber]...)
+		}
+		delete(s.uploads, q.Get("uploadId"))
+		s.objects[key] = buf
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "POST" && q["uploads"] != nil:
+		s.nextID++
+		id := fmt.Sprintf("upload%d", s.nextID)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var n int
+		fmt.Sscan(q.Get("partNumber"), &n)
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		src, err := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		if err != nil || !strings.HasPrefix(src, "/"+s.bucket+"/") {
+			http.Error(w, "bad copy source", http.StatusBadRequest)
+			return
+		}
+		buf, ok := s.objects[src[len("/"+s.bucket+"/"):]]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		s.objects[key] = buf
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+	case r.Method == "PUT":
+		s.objects[key] = body
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		if _, ok := s.objects[key]; !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func TestGoogleS3(t *testing.T) {
+	fake := newFakeGCS()
+	fake.maxKeys = 2 // force paginated listings
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	r := &googleS3{server.URL, fake.accessKey, fake.secret, fake.bucket, "/backups/", 10, 2}
+
+	fake.objects["backups/nested/ignored"] = []byte("x")
+	fake.objects["elsewhere/ignored"] = []byte("x")
+
+	write := func(path, data string) {
+		t.Helper()
+		w, err := r.Create(path)
+		if err != nil {
+			t.Fatalf("create %s: %s", path, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("write %s: %s", path, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close %s: %s", path, err)
+		}
+	}
+
+	data := "0123456789abcdefghijklmnopqrstuvwxyz" // multipart upload, 4 parts
+	write("20171222-0001.data", data)
+	if len(fake.uploads) != 0 || fake.nextID != 1 {
+		t.Errorf("multipart upload not used, or not completed")
+	}
+	write("20171222-0001.index1.full.tmp", "small+file")
+	write("20171222-0002.data", "")
+	write("name with space", "x")
+
+	names, err := r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	exp := []string{"20171222-0001.data", "20171222-0001.index1.full.tmp", "20171222-0002.data", "name with space"}
+	if strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Errorf("list, got %v, expected %v", names, exp)
+	}
+
+	rc, err := r.OpenRange("20171222-0001.data", 10, 5)
+	if err != nil {
+		t.Fatalf("open range: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "abcde" {
+		t.Errorf("read range, got %q, %v", buf, err)
+	}
+
+	if err := r.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if _, err := r.Open("20171222-0001.index1.full.tmp"); err == nil {
+		t.Errorf("open of renamed file succeeded")
+	}
+	if err := r.Delete("name with space"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if string(fake.objects["backups/20171222-0001.index1.full"]) != "small+file" || fake.objects["backups/name with space"] != nil {
+		t.Errorf("unexpected objects at server after rename and delete")
+	}
+	testDestinationDir(t, r)
+
+	r.secret = "bad"
+	if _, err := r.List(); err == nil {
+		t.Errorf("list with bad secret succeeded")
+	}
+}
+
+// TestGoogleS3ListPages checks that listings follow the markers across pages,
+// as returned by the server, and that inconsistent listings are errors.
+func TestGoogleS3ListPages(t *testing.T) {
+	type page struct {
+		keys       []string
+		nextMarker string // page is truncated if set
+		truncated  bool
+	}
+	var pages map[string]page // by requested marker
+	var markers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("prefix") != "backups/" || q.Get("delimiter") != "/" {
+			http.Error(w, "bad prefix or delimiter", http.StatusBadRequest)
+			return
+		}
+		marker := q.Get("marker")
+		markers = append(markers, marker)
+		p, ok := pages[marker]
+		if !ok {
+			http.Error(w, "unexpected marker", http.StatusBadRequest)
+			return
+		}
+		var result struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Key         []string `xml:"Contents>Key"`
+			IsTruncated bool
+			NextMarker  string `xml:",omitempty"`
+		}
+		result.Key = p.keys
+		result.IsTruncated = p.truncated || p.nextMarker != ""
+		result.NextMarker = p.nextMarker
+		xml.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+	r := &googleS3{server.URL, "key", "secret", "bucket", "/backups/", 10, 2}
+
+	// the next marker can be a common prefix beyond the last key, without it the last key is used
+	pages = map[string]page{
+		"":                {[]string{"backups/", "backups/a", "backups/b"}, "backups/b", false},
+		"backups/b":       {[]string{"backups/c"}, "backups/nested/", false},
+		"backups/nested/": {[]string{"backups/x"}, "", true},
+		"backups/x":       {[]string{"backups/z"}, "", false},
+	}
+	names, err := r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if s := strings.Join(names, ","); s != "a,b,c,x,z" {
+		t.Errorf("list across pages, got %q, expected %q", s, "a,b,c,x,z")
+	}
+	if s := strings.Join(markers, ","); s != ",backups/b,backups/nested/,backups/x" {
+		t.Errorf("markers requested, got %q", s)
+	}
+
+	inconsistent := []map[string]page{
+		// next marker before the last key
+		{"": {[]string{"backups/a", "backups/b"}, "backups/a", false}},
+		// key not beyond the marker
+		{"": {[]string{"backups/a", "backups/b"}, "backups/b", false}, "backups/b": {[]string{"backups/b"}, "", false}},
+		// truncated without keys or next marker
+		{"": {nil, "", true}},
+	}
+	for i, p := range inconsistent {
+		pages = p
+		markers = nil
+		if names, err := r.List(); err == nil || !strings.Contains(err.Error(), "inconsistent listing") {
+			t.Errorf("inconsistent listing %d, got %q, %v, expected error", i, names, err)
+		}
+	}
+}
+
+// TestGoogleS3Backups runs the backup tests against the fake S3 server.
+func TestGoogleS3Backups(t *testing.T) {
+	fake := newFakeGCS()
+	fake.maxKeys = 3 // force paginated listings
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	setMain := func(c *configuration) {
+		c.Kind = "googles3"
+		c.GoogleS3.Endpoint = server.URL
+		c.GoogleS3.AccessKey = fake.accessKey
+		c.GoogleS3.Secret = fake.secret
+		c.GoogleS3.Bucket = fake.bucket
+		c.GoogleS3.Path = "/backups/"
+		c.Retries = -1 // the server going down is not temporary
+	}
+	testBackups(t, setMain, markDown(fake, &fake.down))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Directories can have a file ".bolongignore", with patterns for files and
+// directories in that directory and below that are not backed up, with the
+// syntax of gitignore: blank lines and lines starting with "#" are skipped.
+// Patterns are globs, with "*", "?", "[...]" and "**". A pattern with a slash
+// at the start or in the middle is relative to the directory of the ignore
+// file, others match at any depth. A pattern ending in a slash only matches
+// directories. A pattern starting with "!" includes a path again that was
+// ignored by an earlier pattern, but not when a parent directory is ignored.
+// The last matching pattern wins, patterns from deeper ignore files take
+// precedence.
+
+const ignoreName = ".bolongignore"
+
+type ignorePattern struct {
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp // against the path relative to the directory of the ignore file, without trailing slash
+}
+
+// ignoreFile holds the patterns from a .bolongignore file.
+type ignoreFile struct {
+	dir      string // matchPath of the directory, "" or ending with slash
+	patterns []ignorePattern
+}
+
+// readIgnoreFile reads the ignore file in directory path, which has matchPath
+// dir. If there is no ignore file, nil is returned.
+func readIgnoreFile(path, dir string) (*ignoreFile, error) {
+	name := filepath.Join(path, ignoreName)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if os.IsPermission(err) && !listsName(path, ignoreName) {
+		// the directory can be listed but not searched, its entries fail on their own
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	igf := &ignoreFile{dir: dir}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		p, err := parseIgnorePattern(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+		}
+		if p != nil {
+			igf.patterns = append(igf.patterns, *p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", name, err)
+	}
+	return igf, nil
+}
+
+// listsName returns whether directory path can be listed, and has an entry name.
+func listsName(path, name string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIgnorePattern parses a line from an ignore file, returning nil for blank lines and comments.
+func parseIgnorePattern(line string) (*ignorePattern, error) {
+	// trailing spaces are ignored, unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	p := &ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	re := "^"
+	if !anchored {
+		re += "(?:.*/)?"
+	}
+	re += globRegexp(line) + "$"
+	var err error
+	p.re, err = regexp.Compile(re)
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %s", line, err)
+	}
+	return p, nil
+}
+
+// globRegexp returns the regular expression for a glob pattern.
+func globRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			// zero or more directories
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && (i == 0 || glob[i-1] == '/'):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end == 0 || end == 1 && glob[i+1] == '!' {
+				// "]" directly after the opening bracket is part of the class
+				if e := strings.Index(glob[i+end+2:], "]"); e >= 0 {
+					end += e + 1
+				} else {
+					end = -1
+				}
+			}
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			i += 1 + end
+			re.WriteString("[")
+			if strings.HasPrefix(class, "!") {
+				re.WriteString("^")
+				class = class[1:]
+			}
+			re.WriteString(strings.NewReplacer(`[`, `\[`, `]`, `\]`).Replace(class))
+			re.WriteString("]")
+		default:
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return re.String()
+}
+
+// ignored returns whether matchPath is ignored by the ignore files, which
+// are from the directories of matchPath, outermost first.
+func ignored(files []*ignoreFile, matchPath string, isDir bool) bool {
+	name := strings.TrimSuffix(matchPath, "/")
+	ignore := false
+	for _, f := range files {
+		rel := name[len(f.dir):]
+		for _, p := range f.patterns {
+			if p.dirOnly && !isDir {
+				continue
+			}
+			if p.re.MatchString(rel) {
+				ignore = !p.negate
+			}
+		}
+	}
+	return ignore
+}
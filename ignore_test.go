@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"*.o", "main.o", false, true},
+		{"*.o", "src/main.o", false, true},
+		{"*.o", "main.c", false, false},
+		{"/*.o", "src/main.o", false, false},
+		{"/*.o", "main.o", false, true},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"doc/build", "src/doc/build", true, false},
+		{"doc/build", "doc/build", false, true},
+		{"**/node_modules", "a/b/node_modules", true, true},
+		{"**/node_modules", "node_modules", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "ab/b", false, false},
+		{"a/**", "a/x/y", false, true},
+		{"a/**", "a", true, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file/.txt", false, false},
+		{"file[0-9].txt", "file1.txt", false, true},
+		{"file[!0-9].txt", "file1.txt", false, false},
+		{"file[!0-9].txt", "filex.txt", false, true},
+		{"[]x]", "]", false, true},
+		{"a[b", "a[b", false, true},
+		{"\\#notcomment", "#notcomment", false, true},
+		{"\\!important", "!important", false, true},
+		{"trailing   ", "trailing", false, true},
+		{"space\\ ", "space ", false, true},
+		{"a.b", "axb", false, false},
+		{"# comment", "# comment", false, false},
+	}
+	for _, tt := range tests {
+		p, err := parseIgnorePattern(tt.pattern)
+		if err != nil {
+			t.Errorf("pattern %q: %s", tt.pattern, err)
+			continue
+		}
+		var files []*ignoreFile
+		if p != nil {
+			files = []*ignoreFile{{"", []ignorePattern{*p}}}
+		}
+		if r := ignored(files, tt.path, tt.isDir); r != tt.ignored {
+			t.Errorf("pattern %q, path %q, dir %v: got %v, expected %v", tt.pattern, tt.path, tt.isDir, r, tt.ignored)
+		}
+	}
+
+	// negation, and deeper files taking precedence
+	parse := func(dir string, lines ...string) *ignoreFile {
+		f := &ignoreFile{dir: dir}
+		for _, line := range lines {
+			p, err := parseIgnorePattern(line)
+			if err != nil {
+				t.Fatalf("pattern %q: %s", line, err)
+			}
+			f.patterns = append(f.patterns, *p)
+		}
+		return f
+	}
+	files := []*ignoreFile{parse("", "*.log", "!keep.log"), parse("src/", "keep.log", "!debug.log")}
+	for path, exp := range map[string]bool{
+		"x.log":         true,
+		"keep.log":      false,
+		"src/keep.log":  true,
+		"src/debug.log": false,
+		"src/x.log":     true,
+	} {
+		if r := ignored(files, path, false); r != exp {
+			t.Errorf("path %q: got %v, expected %v", path, r, exp)
+		}
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{
+		".bolongignore":       "node_modules/\n*.o\n",
+		"main.o":              "",
+		"main.go":             "",
+		"node_modules/x/a.js": "",
+		"src/.bolongignore":   "/build/\n!keep.o\n",
+		"src/keep.o":          "",
+		"src/lib/lib.o":       "",
+		"src/build/out":       "",
+		"srcx/x.txt":          "",
+	})
+	setupTestConfig(t, configuration{Exclude: []string{"^srcx/"}})
+
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	exp := ". .bolongignore main.go src src/.bolongignore src/keep.o src/lib"
+	if got := latestNames(t); got != exp {
+		t.Errorf("backed up %q, expected %q", got, exp)
+	}
+}
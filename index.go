@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -20,24 +23,60 @@ i 20170102-122334 13144534
 i 20170103-122334 2423422
 - path/removed
 + path/to/file
+c 4194400 1317232
+c 8390000 2629044
 = d 755 1506578834 0 mjl mjl 0 -1 path/to
 = f 644 1506578834 1234 mjl mjl 0 1 path/to/file
+h 1506578834123456789 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
 = f 644 1506578834 100 mjl mjl 0 0 path/to/another-file
 = f 644 1506578834 123123123 mjl mjl 100 0 path/to/another-file
 = f 644 1506578834 23424 mjl mjl 100 -1 path/to/new/file
+= f 644 1506578834 1800000 mjl mjl -2 -1 path/to/chunked/file
+k 1048576 0b1f3e0b1c9e6a0c7e3d5a8c4e2f1a6b9d8c7e6f5a4b3c2d1e0f9a8b7c6d5e4f
+k 751424 5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f
+= f 644 1506578834 1234 mjl mjl -3 -1 path/to/hardlink
+l path/to/file
+= f 755 1506578834 23424 mjl mjl 100 -1 path/to/binary
+x AQAAAgAgAAAAAAAAAAAAAAAAAAA= security.capability
+= p 644 1506578834 0 mjl mjl -1 -1 path/to/fifo
+= c 666 1506578834 0 root root -1 -1 dev/null
+r 1 3
 = s 644 1506578834 23424 mjl mjl 100 -1 path/to/new/symlink
 .
 
 */
 
 type index struct {
-	dataSize int64
-	previous []previous
-	add      []string
-	delete   []string
-	contents []*file
+	dataSize    int64
+	previous    []previous
+	add         []string
+	delete      []string
+	checkpoints []checkpoint // for the data file of this backup, in ascending order
+	contents    []*file
 }
 
+// checkpoint is a position in a data file where decompression can start.
+// Restores use them to fetch only the parts of a data file they need.
+// Older versions of bolong don't write checkpoints, and ignore them when reading.
+type checkpoint struct {
+	offset     int64 // in the uncompressed data, as used for file.dataOffset
+	compressed int64 // in the compressed data, before encryption
+}
+
+// Files can be followed by an "h" line with the ctime (in nanoseconds) and
+// SHA-256 of the contents, when hashing is enabled. Older versions of bolong
+// ignore these lines.
+// Files stored in chunks, with dedup enabled, have data offset -2 and are
+// followed by "k" lines with the size and id of each chunk. Older versions of
+// bolong refuse to read such index files, instead of restoring wrong data.
+// Extended attributes, when enabled, follow the file in "x" lines with the
+// base64-encoded value and the name. Older versions of bolong ignore them.
+// FIFOs ("p"), sockets ("o") and block ("b") and character ("c") devices have
+// no data. Devices are followed by an "r" line with the major and minor number.
+// Older versions of bolong don't know these kinds, and fail to read index
+// files with them.
+// Hard links to a file earlier in the index have data offset -3 and are
+// followed by an "l" line with the path of that file.
 type file struct {
 	isDir         bool
 	isSymlink     bool
@@ -49,6 +88,34 @@ type file struct {
 	dataOffset    int64
 	previousIndex int
 	name          string
+	hash          []byte      // sha256 of contents, nil if not hashed
+	ctime         time.Time   // status change time when the hash was computed, zero if unknown
+	chunks        []chunkRef  // for dataOffset chunkedOffset
+	link          string      // for dataOffset linkOffset, path of the file this is a hard link to
+	xattrs        []xattr     // sorted by name
+	special       os.FileMode // for FIFOs, sockets and devices, the type bits of their mode; they have no data
+	major, minor  uint64      // for devices
+}
+
+// specialKinds are the file kinds in index files for FIFOs, sockets, and block and character devices.
+var specialKinds = map[string]os.FileMode{
+	"p": os.ModeNamedPipe,
+	"o": os.ModeSocket,
+	"b": os.ModeDevice,
+	"c": os.ModeDevice | os.ModeCharDevice,
+}
+
+// linkOffset is the dataOffset of hard links, their contents are those of the file they link to.
+const linkOffset = -3
+
+// hardLink returns whether the file is a hard link to another file in the index.
+func (f *file) hardLink() bool {
+	return f.dataOffset == linkOffset
+}
+
+// chunked returns whether the contents of the file are stored in chunks, instead of in a data file.
+func (f *file) chunked() bool {
+	return f.dataOffset == chunkedOffset
 }
 
 type previous struct {
@@ -88,6 +155,63 @@ func parsePrevious(s string) (p previous, err error) {
 	return
 }
 
+func parseCheckpoint(s string) (c checkpoint, err error) {
+	t := strings.Split(s, " ")
+	if len(t) != 2 {
+		err = fmt.Errorf("bad number of tokens for checkpoint line, got %d, expected 2", len(t))
+		return
+	}
+	c.offset, err = strconv.ParseInt(t[0], 10, 64)
+	if err == nil {
+		c.compressed, err = strconv.ParseInt(t[1], 10, 64)
+	}
+	if err != nil {
+		err = fmt.Errorf("bad offset in checkpoint: %s", err)
+	} else if c.offset < 0 || c.compressed < 0 {
+		err = fmt.Errorf("negative offset in checkpoint")
+	}
+	return
+}
+
+func parseHash(f *file, s string) error {
+	t := strings.Split(s, " ")
+	if len(t) != 2 {
+		return fmt.Errorf("bad number of tokens for hash line, got %d, expected 2", len(t))
+	}
+	ctime, err := strconv.ParseInt(t[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid ctime %s: %s", t[0], err)
+	}
+	hash, err := hex.DecodeString(t[1])
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid sha256 hash %s", t[1])
+	}
+	if ctime != 0 {
+		f.ctime = time.Unix(0, ctime)
+	}
+	f.hash = hash
+	return nil
+}
+
+func parseChunk(s string) (c chunkRef, err error) {
+	t := strings.Split(s, " ")
+	if len(t) != 2 {
+		err = fmt.Errorf("bad number of tokens for chunk line, got %d, expected 2", len(t))
+		return
+	}
+	c.size, err = strconv.ParseInt(t[0], 10, 64)
+	if err != nil || c.size <= 0 || c.size > chunkMax {
+		err = fmt.Errorf("invalid chunk size %s", t[0])
+		return
+	}
+	if id, xerr := hex.DecodeString(t[1]); xerr != nil || len(id) != sha256.Size {
+		err = fmt.Errorf("invalid chunk id %s", t[1])
+		return
+	}
+	c.id = t[1]
+	return
+}
+
 func parseFile(nprevious int, line string) (*file, error) {
 	t := strings.SplitN(line, " ", 9)
 	if len(t) != 9 {
@@ -105,7 +229,11 @@ func parseFile(nprevious int, line string) (*file, error) {
 	case "d":
 		f.isDir = true
 	default:
-		return nil, fmt.Errorf("invalid file type %s", t[0])
+		m, ok := specialKinds[t[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid file type %s", t[0])
+		}
+		f.special = m
 	}
 	f.permissions = os.FileMode(perm0)
 
@@ -127,7 +255,7 @@ func parseFile(nprevious int, line string) (*file, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid offset %s: %s", t[6], err)
 	}
-	if f.dataOffset < 0 && f.dataOffset != -1 {
+	if f.dataOffset < 0 && f.dataOffset != -1 && (f.dataOffset != chunkedOffset && f.dataOffset != linkOffset || t[0] != "f") {
 		return nil, fmt.Errorf("invalid offset %s: %s", t[6], err)
 	}
 	err = verifyPath(t[7])
@@ -142,27 +270,47 @@ func parseFile(nprevious int, line string) (*file, error) {
 		return nil, fmt.Errorf("previousIndex invalid")
 	}
 	f.name = t[8]
+	if f.special != 0 && f.dataOffset != -1 {
+		return nil, fmt.Errorf("special file with data offset")
+	}
 	return f, nil
 }
 
+// specialKind returns the kind of a special file, as written in the index file.
+func (f file) specialKind() string {
+	for k, m := range specialKinds {
+		if m == f.special {
+			return k
+		}
+	}
+	return ""
+}
+
 func (f file) indexString() string {
 	kind := "f"
 	if f.isDir {
 		kind = "d"
 	} else if f.isSymlink {
 		kind = "s"
+	} else if f.special != 0 {
+		kind = f.specialKind()
 	}
 	return fmt.Sprintf("%s %o %d %d %s %s %d %d %s", kind, f.permissions, f.mtime.Unix(), f.size, f.user, f.group, f.dataOffset, f.previousIndex, f.name)
 }
 
 func readIndex(b *backup) (idx *index, err error) {
+	return readDestinationIndex(store, b)
+}
+
+// readDestinationIndex reads the index file of backup b from d.
+func readDestinationIndex(d destination, b *backup) (idx *index, err error) {
 	kindName := "full"
 	if b.incremental {
 		kindName = "incr"
 	}
 	path := fmt.Sprintf("%s.index1.%s", b.name, kindName)
 	var f io.ReadCloser
-	f, err = store.Open(path)
+	f, err = d.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("open index file: %s", err)
 	}
@@ -221,17 +369,93 @@ func readIndex(b *backup) (idx *index, err error) {
 			idx.delete = append(idx.delete, line[2:])
 		} else if strings.HasPrefix(line, "+ ") {
 			idx.add = append(idx.add, line[2:])
+		} else if strings.HasPrefix(line, "c ") {
+			c, err := parseCheckpoint(line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("parsing checkpoint-line: %s", err)
+			}
+			if n := len(idx.checkpoints); n > 0 && (c.offset <= idx.checkpoints[n-1].offset || c.compressed <= idx.checkpoints[n-1].compressed) {
+				return nil, fmt.Errorf("checkpoints not in ascending order")
+			}
+			idx.checkpoints = append(idx.checkpoints, c)
 		} else if strings.HasPrefix(line, "= ") {
 			file, err := parseFile(len(idx.previous), line[2:])
 			if err != nil {
 				return nil, fmt.Errorf("parsing file-line: %s", err)
 			}
 			idx.contents = append(idx.contents, file)
+		} else if strings.HasPrefix(line, "k ") {
+			n := len(idx.contents)
+			if n == 0 || !idx.contents[n-1].chunked() {
+				return nil, fmt.Errorf("chunk-line not after chunked file")
+			}
+			c, err := parseChunk(line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("parsing chunk-line: %s", err)
+			}
+			idx.contents[n-1].chunks = append(idx.contents[n-1].chunks, c)
+		} else if strings.HasPrefix(line, "r ") {
+			n := len(idx.contents)
+			if n == 0 || idx.contents[n-1].special&os.ModeDevice == 0 {
+				return nil, fmt.Errorf("device-line not after device")
+			}
+			f := idx.contents[n-1]
+			if _, err := fmt.Sscanf(line, "r %d %d", &f.major, &f.minor); err != nil {
+				return nil, fmt.Errorf("parsing device-line: %s", err)
+			}
+		} else if strings.HasPrefix(line, "x ") {
+			n := len(idx.contents)
+			if n == 0 {
+				return nil, fmt.Errorf("xattr-line not after file")
+			}
+			t := strings.SplitN(line[2:], " ", 2)
+			if len(t) != 2 || t[1] == "" {
+				return nil, fmt.Errorf("bad xattr-line")
+			}
+			value, err := base64.StdEncoding.DecodeString(t[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value in xattr-line: %s", err)
+			}
+			idx.contents[n-1].xattrs = append(idx.contents[n-1].xattrs, xattr{t[1], value})
+		} else if strings.HasPrefix(line, "l ") {
+			n := len(idx.contents)
+			if n == 0 || !idx.contents[n-1].hardLink() || idx.contents[n-1].link != "" {
+				return nil, fmt.Errorf("link-line not after hard link")
+			}
+			idx.contents[n-1].link = line[2:]
+		} else if strings.HasPrefix(line, "h ") {
+			n := len(idx.contents)
+			if n == 0 || idx.contents[n-1].isDir || idx.contents[n-1].isSymlink || idx.contents[n-1].hash != nil {
+				return nil, fmt.Errorf("hash-line not after regular file")
+			}
+			err := parseHash(idx.contents[n-1], line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("parsing hash-line: %s", err)
+			}
 		}
 	}
 	if scanner.Scan() {
 		return nil, fmt.Errorf("data after closing dot")
 	}
+	files := map[string]*file{}
+	for _, f := range idx.contents {
+		if f.hardLink() {
+			if lf, ok := files[f.link]; !ok || lf.isDir || lf.isSymlink || lf.hardLink() {
+				return nil, fmt.Errorf("hard link %s does not link to an earlier regular file", f.name)
+			}
+		}
+		files[f.name] = f
+		if !f.chunked() {
+			continue
+		}
+		var size int64
+		for _, c := range f.chunks {
+			size += c.size
+		}
+		if size != f.size {
+			return nil, fmt.Errorf("chunks of %s have size %d, expected %d", f.name, size, f.size)
+		}
+	}
 	return idx, scanner.Err()
 }
 
@@ -252,13 +476,72 @@ func writeIndex(index io.Writer, idx *index) error {
 	for _, name := range idx.delete {
 		handle(fmt.Fprintf(index, "- %s\n", name))
 	}
+	for _, c := range idx.checkpoints {
+		handle(fmt.Fprintf(index, "c %d %d\n", c.offset, c.compressed))
+	}
 	for _, f := range idx.contents {
 		handle(fmt.Fprintf(index, "= %s\n", f.indexString()))
+		if f.hash != nil {
+			var ctime int64
+			if !f.ctime.IsZero() {
+				ctime = f.ctime.UnixNano()
+			}
+			handle(fmt.Fprintf(index, "h %d %x\n", ctime, f.hash))
+		}
+		for _, c := range f.chunks {
+			handle(fmt.Fprintf(index, "k %d %s\n", c.size, c.id))
+		}
+		if f.hardLink() {
+			handle(fmt.Fprintf(index, "l %s\n", f.link))
+		}
+		if f.special&os.ModeDevice != 0 {
+			handle(fmt.Fprintf(index, "r %d %d\n", f.major, f.minor))
+		}
+		for _, x := range f.xattrs {
+			handle(fmt.Fprintf(index, "x %s %s\n", base64.StdEncoding.EncodeToString(x.value), x.name))
+		}
 	}
 	handle(fmt.Fprintf(index, ".\n"))
 	return xerr
 }
 
+// linkCopy returns a copy of f for hard link l, for restoring l without f.
+func (f *file) linkCopy(l *file) *file {
+	nf := *f
+	nf.name = l.name
+	return &nf
+}
+
+// selectRoot keeps only the files of the source named root, with the name of the source removed from their paths.
+// Hard links to files outside the source become copies of those files.
+func (idx *index) selectRoot(root string) error {
+	files := map[string]*file{}
+	var l []*file
+	for _, f := range idx.contents {
+		files[f.name] = f
+		if f.name == root && f.isDir {
+			f.name = "."
+		} else if strings.HasPrefix(f.name, root+"/") {
+			f.name = f.name[len(root)+1:]
+		} else {
+			continue
+		}
+		if f.hardLink() {
+			if strings.HasPrefix(f.link, root+"/") {
+				f.link = f.link[len(root)+1:]
+			} else {
+				f = files[f.link].linkCopy(f)
+			}
+		}
+		l = append(l, f)
+	}
+	if len(l) == 0 {
+		return fmt.Errorf("no source %q in backup", root)
+	}
+	idx.contents = l
+	return nil
+}
+
 func verifyPath(path string) error {
 	if path == "." {
 		return nil
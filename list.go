@@ -24,8 +24,13 @@ func (b backup) GoString() string {
 
 // return backups in order of timestamp
 func listBackups() ([]*backup, error) {
+	return listDestinationBackups(store)
+}
+
+// listDestinationBackups returns the backups in d, in order of timestamp.
+func listDestinationBackups(d destination) ([]*backup, error) {
 	var r []*backup
-	l, err := store.List()
+	l, err := d.List()
 	if err != nil {
 		return nil, fmt.Errorf("listing remote: %s", err)
 	}
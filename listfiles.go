@@ -11,6 +11,7 @@ func listfiles(args []string) {
 	fs := flag.NewFlagSet("listfiles", flag.ExitOnError)
 	name := fs.String("name", "latest", "name of backup to list files for")
 	verbose := fs.Bool("verbose", false, "verbose printing, including permissions and size")
+	root := fs.String("root", "", "only list the files of this source, relative to the source")
 	fs.Usage = func() {
 		log.Println("usage: bolong [flags] listfiles [flags]")
 		fs.PrintDefaults()
@@ -26,6 +27,10 @@ func listfiles(args []string) {
 	check(err, "finding backup")
 	idx, err := readIndex(backups[0])
 	check(err, "parsing index")
+	if *root != "" {
+		err = idx.selectRoot(*root)
+		check(err, "selecting source")
+	}
 	for _, f := range idx.contents {
 		name := f.name
 		if f.isDir {
@@ -40,6 +45,14 @@ func listfiles(args []string) {
 				kind = "f"
 				if f.isSymlink {
 					kind = "s"
+				} else if f.hardLink() {
+					kind = "l"
+					name += " => " + f.link
+				} else if f.special&os.ModeDevice != 0 {
+					kind = f.specialKind()
+					name += fmt.Sprintf(" (%d, %d)", f.major, f.minor)
+				} else if f.special != 0 {
+					kind = f.specialKind()
 				}
 				size = fmt.Sprintf("%10d", f.size)
 			}
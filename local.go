@@ -1,26 +1,68 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
+	"sync"
 )
 
+// files are first written to a temporary file with this prefix, then renamed into place.
+const localTempPrefix = ".tmp-"
+
 type local struct {
 	path string
+
+	sync.Mutex
+	writers map[*localWriter]struct{} // in progress, for removing their temporary files when interrupted
+	warned  bool                      // whether leftover temporary files have been reported
 }
 
 var _ destination = &local{}
 
 // List returns filenames sorted by name.
+// Leftover temporary files, from writes that were interrupted, are not
+// returned, but reported once.
 func (l *local) List() (names []string, err error) {
-	files, err := ioutil.ReadDir(l.path)
-	if err != nil {
+	return l.ListDir("")
+}
+
+func (l *local) ListDir(dir string) (names []string, err error) {
+	path := l.path
+	if dir != "" {
+		path += dir + "/"
+	}
+	files, err := ioutil.ReadDir(path)
+	if dir != "" && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
-	names = make([]string, len(files), len(files))
-	for i, info := range files {
-		names[i] = info.Name()
+	names = make([]string, 0, len(files))
+	var temps []string
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), localTempPrefix) {
+			temps = append(temps, info.Name())
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	l.Lock()
+	warn := len(temps) > 0 && !l.warned
+	if warn {
+		l.warned = true
+	}
+	l.Unlock()
+	if warn {
+		log.Printf("leftover temporary files from interrupted writes in %s, remove them when no backup is running: %s\n", path, strings.Join(temps, " "))
 	}
 	return names, nil
 }
@@ -29,14 +71,195 @@ func (l *local) Open(path string) (r io.ReadCloser, err error) {
 	return os.Open(l.path + path)
 }
 
+func (l *local) OpenRange(path string, offset, length int64) (r io.ReadCloser, err error) {
+	f, err := os.Open(l.path + path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newLimitReadCloser(f, length), nil
+}
+
+// Create returns a file that is written to a temporary file. On close, it is
+// synced to disk and renamed into place, so a file never exists partially
+// written under its final name, not even after a crash.
 func (l *local) Create(path string) (w io.WriteCloser, err error) {
-	return os.Create(l.path + path)
+	dir, name := l.split(path)
+	f, err := createTemp(dir, name)
+	if os.IsNotExist(err) && dir != l.path {
+		// first file in a subdirectory, e.g. for chunks
+		if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if err := syncDir(l.path); err != nil {
+			return nil, err
+		}
+		f, err = createTemp(dir, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lw := &localWriter{f: f, l: l, path: path}
+	l.Lock()
+	if l.writers == nil {
+		l.writers = map[*localWriter]struct{}{}
+	}
+	l.writers[lw] = struct{}{}
+	l.Unlock()
+	return lw, nil
+}
+
+// createNew is like Create, but closing fails with an error wrapping
+// os.ErrExist if a file named path exists by then.
+func (l *local) createNew(path string) (w io.WriteCloser, err error) {
+	w, err = l.Create(path)
+	if err == nil {
+		w.(*localWriter).noReplace = true
+	}
+	return
+}
+
+// split returns the directory of path, ending with a slash, and the name of
+// the file in it.
+func (l *local) split(path string) (dir, name string) {
+	i := strings.LastIndex(path, "/")
+	return l.path + path[:i+1], path[i+1:]
+}
+
+// createTemp creates a new temporary file in dir for a file named path. Unlike
+// with ioutil.TempFile, the mode is 0666 minus umask, like for os.Create, so
+// the file gets the usual permissions when renamed into place.
+func createTemp(dir, path string) (*os.File, error) {
+	for i := 0; ; i++ {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(dir+localTempPrefix+path+"-"+hex.EncodeToString(buf), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// abortWrites removes the temporary files of writes in progress, e.g. when the backup is interrupted.
+func (l *local) abortWrites() {
+	l.Lock()
+	writers := l.writers
+	l.writers = nil
+	l.Unlock()
+	for w := range writers {
+		w.abort()
+	}
+}
+
+// abortLocalWrites aborts the writes in progress to local destinations of d.
+func abortLocalWrites(d destination) {
+	switch d := d.(type) {
+	case *local:
+		d.abortWrites()
+	case *mirrored:
+		for _, m := range d.mirrors {
+			abortLocalWrites(m.store)
+		}
+	}
 }
 
 func (l *local) Rename(opath, npath string) (err error) {
-	return os.Rename(l.path+opath, l.path+npath)
+	err = os.Rename(l.path+opath, l.path+npath)
+	if err == nil {
+		err = l.syncDirs(opath, npath)
+	}
+	return
+}
+
+// syncDirs syncs the directories of opath and npath after a rename.
+func (l *local) syncDirs(opath, npath string) error {
+	odir, _ := l.split(opath)
+	ndir, _ := l.split(npath)
+	if odir != ndir {
+		if err := syncDir(odir); err != nil {
+			return err
+		}
+	}
+	return syncDir(ndir)
+}
+
+// renameNoReplace is like Rename, but fails with an error wrapping os.ErrExist
+// if npath exists. Hard linking fails atomically for an existing file, unlike
+// checking before a rename.
+func (l *local) renameNoReplace(opath, npath string) (err error) {
+	err = os.Link(l.path+opath, l.path+npath)
+	if err == nil {
+		err = os.Remove(l.path + opath)
+	}
+	if err == nil {
+		err = l.syncDirs(opath, npath)
+	}
+	return
 }
 
 func (l *local) Delete(path string) (err error) {
 	return os.Remove(l.path + path)
 }
+
+type localWriter struct {
+	f         *os.File // temporary file
+	l         *local
+	path      string // final name
+	noReplace bool   // fail instead of replacing an existing file
+}
+
+func (w *localWriter) Write(buf []byte) (int, error) {
+	return w.f.Write(buf)
+}
+
+// done unregisters w as in progress.
+func (w *localWriter) done() {
+	w.l.Lock()
+	delete(w.l.writers, w)
+	w.l.Unlock()
+}
+
+func (w *localWriter) Close() (err error) {
+	w.done()
+	defer func() {
+		if err != nil {
+			os.Remove(w.f.Name())
+			err = fmt.Errorf("writing %s: %w", w.path, err)
+		}
+	}()
+	err = w.f.Sync()
+	err2 := w.f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if w.noReplace {
+		err = os.Link(w.f.Name(), w.l.path+w.path)
+		if err == nil {
+			err = os.Remove(w.f.Name())
+		}
+	} else {
+		err = os.Rename(w.f.Name(), w.l.path+w.path)
+	}
+	if err != nil {
+		return err
+	}
+	dir, _ := w.l.split(w.path)
+	return syncDir(dir)
+}
+
+// abort removes the temporary file, for a write that did not complete.
+func (w *localWriter) abort() {
+	w.done()
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
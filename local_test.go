@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-local")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	l := &local{path: dir + "/"}
+
+	f, err := l.Create("x.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := f.Write([]byte("test")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// not yet present under its final name, and the temporary file is not listed
+	if _, err := os.Stat(dir + "/x.data"); !os.IsNotExist(err) {
+		t.Errorf("file present before close, stat err %v", err)
+	}
+	names, err := l.List()
+	if err != nil || len(names) != 0 {
+		t.Errorf("list with only temporary file, got %v, %v", names, err)
+	}
+	if !l.warned {
+		t.Errorf("temporary file not reported")
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if err := l.Rename("x.data", "y.data"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 || files[0].Name() != "y.data" {
+		t.Fatalf("files after close and rename, got %v, %v", files, err)
+	}
+	names, err = l.List()
+	if err != nil || fmt.Sprint(names) != "[y.data]" {
+		t.Errorf("list, got %v, %v", names, err)
+	}
+	buf, err := ioutil.ReadFile(dir + "/y.data")
+	if err != nil || string(buf) != "test" {
+		t.Errorf("contents, got %q, %v", buf, err)
+	}
+
+	// the mode is not that of a temporary file
+	tcheck(t, ioutil.WriteFile(dir+"/plain", nil, 0666), "writing file")
+	plain, err := os.Stat(dir + "/plain")
+	tcheck(t, err, "stat")
+	info, err := os.Stat(dir + "/y.data")
+	tcheck(t, err, "stat")
+	if info.Mode() != plain.Mode() {
+		t.Errorf("mode of written file, got %v, expected %v", info.Mode(), plain.Mode())
+	}
+
+	// interrupted writes leave no temporary files
+	f, err = l.Create("z.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	abortLocalWrites(&mirrored{[]*mirror{{name: "main", store: l}}})
+	if err := f.Close(); err == nil {
+		t.Errorf("close after abort succeeded")
+	}
+	files, err = ioutil.ReadDir(dir)
+	if err != nil || len(files) != 2 {
+		t.Errorf("files after aborted write, got %v, %v", files, err)
+	}
+
+	testDestinationDir(t, l)
+}
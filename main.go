@@ -1,28 +1,119 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path"
 	"strings"
 	"time"
 )
 
-type configuration struct {
+// destinationConfig configures where backups are stored.
+type destinationConfig struct {
+	Name  string // for selecting a mirror to read from, defaults to "main" and "mirror1", "mirror2", etc
 	Kind  string
 	Local struct {
 		Path string
 	}
 	GoogleS3 struct {
+		Endpoint, // defaults to https://storage.googleapis.com
 		AccessKey,
 		Secret,
 		Bucket,
 		Path string
+		PartSize      int // in MB
+		PartsInFlight int
+	}
+	GCS struct {
+		Endpoint, // defaults to https://storage.googleapis.com
+		TokenURL, // defaults to token_uri from the key file
+		KeyFile, // json key file of a service account
+		Bucket,
+		Path string
+		PartSize int // in MB
 	}
+	S3 struct {
+		Endpoint,
+		Region,
+		AccessKey,
+		Secret,
+		Bucket,
+		Path string
+		PathStyle     bool
+		PartSize      int // in MB
+		PartsInFlight int
+	}
+	SFTP struct {
+		Address,
+		User,
+		KeyFile,
+		KeyPassphrase,
+		KnownHostsFile,
+		Path string
+	}
+	WebDAV struct {
+		URL,
+		User,
+		Password string
+	}
+	Rest struct {
+		URL, // of a repository served by "bolong serve-repo", with path "/"
+		User,
+		Password string
+	}
+	Exec struct {
+		Command []string // helper program and its arguments
+		Path    string   // passed to the helper in $BOLONG_PATH
+	}
+	AzureBlob struct {
+		Endpoint, // defaults to https://<account>.blob.core.windows.net
+		Account,
+		Key, // shared key of the storage account, base64
+		SAS, // shared access signature, instead of key
+		Container,
+		Path string
+		PartSize      int // in MB
+		PartsInFlight int
+	}
+	FullKeep               int // for mirrors, 0 means the top-level "fullKeep"
+	IncrementalForFullKeep int // for mirrors, 0 means the top-level "incrementalForFullKeep"
+}
+
+// sourceConfig is a directory to back up, stored in the backup under its name.
+type sourceConfig struct {
+	Name    string
+	Path    string
+	Include []string // in addition to the top-level "include"
+	Exclude []string // in addition to the top-level "exclude"
+}
+
+type configuration struct {
+	destinationConfig
+	Mirrors                []destinationConfig // backups are also written to these destinations
+	Sources                []sourceConfig      // if set, these directories are backed up, instead of a single directory
 	Include                []string
 	Exclude                []string
+	Hash                   string   // "", "ctime" or "always", for detecting changed files by their contents
+	HashPaths              []string // if non-empty, only files matching one of these regexps are hashed
+	Dedup                  bool     // store larger files in chunks, each chunk stored once
+	Xattrs                 bool     // store extended attributes, including ACLs
+	SkipSpecial            bool     // skip FIFOs, sockets and devices, instead of storing them without data
+	OneFileSystem          bool     // don't descend into directories on other file systems than the source directory
+	SkipFilesystems        []string // don't descend into directories on file systems of these types, e.g. "proc"
+	ExcludeCaches          bool     // skip the contents of directories with a CACHEDIR.TAG file
+	MaxFileSize            int      // in MB, larger files are skipped, 0 means no limit
+	ExcludeKinds           []string // skip files of these kinds, e.g. "video", or with these extensions, e.g. ".iso"
+	ContinueOnError        bool     // leave out files that cannot be read, instead of failing the backup
+	OnChange               string   // "", "fail", "record", "retry" or "skip", for files that change or vanish while being backed up
+	ChangeRetries          int      // for "onChange" "retry", 0 means default
+	Retries                int      // for remote destinations, 0 means default, -1 disables retries
+	RetryDelay             int      // in seconds, before the first retry
 	IncrementalsPerFull    int
 	FullKeep               int
 	IncrementalForFullKeep int
@@ -32,11 +123,16 @@ type configuration struct {
 var (
 	version    = "dev"
 	configPath = flag.String("config", "", "path to config file")
-	remotePath = flag.String("path", "", "path at remote storage, overrides config file")
+	remotePath = flag.String("path", "", "path at remote storage, overrides config file; not allowed with mirrors")
+	readFrom   = flag.String("destination", "", "name of mirror to read from first, other mirrors are tried if it fails")
 	config     configuration
 	store      destination
+	mirrors    []*mirror // all destinations, in order of preference for reading
 )
 
+// exitPartial is the exit status of a backup that left out files because of errors, with "continueOnError".
+const exitPartial = 3
+
 func check(err error, msg string) {
 	if err == nil {
 		return
@@ -54,8 +150,11 @@ func main() {
 		log.Println("bolong [flags] backup [flags] [directory]")
 		log.Println("bolong [flags] restore [flags] destination [path-regexp ...]")
 		log.Println("bolong [flags] list")
+		log.Println("bolong [flags] prune [flags]")
+		log.Println("bolong [flags] verify [flags]")
 		log.Println("bolong [flags] listfiles [flags]")
 		log.Println("bolong [flags] dumpindex [name]")
+		log.Println("bolong serve-repo [flags] directory")
 		log.Println("bolong [flags] version")
 		log.Println("bolong [flags] help")
 		flag.PrintDefaults()
@@ -74,7 +173,9 @@ func main() {
 		parseConfig()
 		// create name from timestamp now, for simpler testcode
 		name := time.Now().UTC().Format("20060102-150405")
-		backupCmd(args, name)
+		if backupCmd(args, name) {
+			os.Exit(exitPartial)
+		}
 	case "restore":
 		parseConfig()
 		restoreCmd(args)
@@ -87,6 +188,14 @@ func main() {
 	case "dumpindex":
 		parseConfig()
 		dumpindex(args)
+	case "prune":
+		parseConfig()
+		prune(args)
+	case "verify":
+		parseConfig()
+		verify(args)
+	case "serve-repo":
+		serveRepo(args)
 	case "version":
 		_version(args)
 	case "help":
@@ -107,48 +216,328 @@ func parseConfig() {
 	err = json.NewDecoder(f).Decode(&config)
 	check(err, "parsing config file")
 
-	switch config.Kind {
+	if *remotePath != "" && len(config.Mirrors) > 0 {
+		// mirrors would keep their own paths, and get backups of different directories mixed up
+		log.Fatalln(`flag "-path" cannot be used with mirrors`)
+	}
+	mirrors = nil
+	names := map[string]bool{}
+	for i := -1; i < len(config.Mirrors); i++ {
+		dc := &config.destinationConfig
+		prefix := ""
+		name := "main"
+		if i >= 0 {
+			dc = &config.Mirrors[i]
+			prefix = fmt.Sprintf("mirrors[%d].", i)
+			name = fmt.Sprintf("mirror%d", i+1)
+		}
+		if dc.Name != "" {
+			name = dc.Name
+		}
+		if names[name] {
+			log.Fatalf(`duplicate destination name "%s"`, name)
+		}
+		names[name] = true
+		m := &mirror{name: name, store: newDestination(dc, prefix), fullKeep: config.FullKeep, incrementalForFullKeep: config.IncrementalForFullKeep}
+		if dc.FullKeep > 0 {
+			m.fullKeep = dc.FullKeep
+		}
+		if dc.IncrementalForFullKeep > 0 {
+			m.incrementalForFullKeep = dc.IncrementalForFullKeep
+		}
+		if m.incrementalForFullKeep > m.fullKeep && m.fullKeep > 0 {
+			log.Fatalf("%sincrementalForFullKeep > %sfullKeep does not make sense", prefix, prefix)
+		}
+		if name == *readFrom {
+			mirrors = append([]*mirror{m}, mirrors...)
+		} else {
+			mirrors = append(mirrors, m)
+		}
+	}
+	if *readFrom != "" && !names[*readFrom] {
+		log.Fatalf(`no destination named "%s"`, *readFrom)
+	}
+	if len(mirrors) == 1 {
+		store = mirrors[0].store
+	} else {
+		store = &mirrored{mirrors}
+	}
+	if config.Passphrase == "" {
+		log.Fatalln("passphrase cannot be empty")
+	}
+	sourceNames := map[string]bool{}
+	for i, sc := range config.Sources {
+		if sc.Name == "" || sc.Name == "." || sc.Name == ".." || strings.Contains(sc.Name, "/") || strings.ContainsAny(sc.Name, "\n\r") {
+			log.Fatalf(`field "sources[%d].name" must be set, and be a valid file name`, i)
+		}
+		if sourceNames[sc.Name] {
+			log.Fatalf(`duplicate source name "%s"`, sc.Name)
+		}
+		sourceNames[sc.Name] = true
+		if sc.Path == "" {
+			log.Fatalf(`field "sources[%d].path" must be set`, i)
+		}
+	}
+	if config.Hash != "" && config.Hash != "ctime" && config.Hash != "always" {
+		log.Fatalln(`field "hash" must be empty, "ctime" or "always"`)
+	}
+	switch config.OnChange {
+	case "", "fail", "record", "retry", "skip":
+	default:
+		log.Fatalln(`field "onChange" must be empty, "fail", "record", "retry" or "skip"`)
+	}
+	if config.ChangeRetries < 0 {
+		log.Fatalln(`field "changeRetries" must be 0 or positive`)
+	}
+	if config.MaxFileSize < 0 {
+		log.Fatalln(`field "maxFileSize" must be 0 or positive (MB)`)
+	}
+	for _, k := range config.ExcludeKinds {
+		if _, ok := fileKinds[k]; !ok && (!strings.HasPrefix(k, ".") || len(k) == 1) {
+			log.Fatalf(`field "excludeKinds" has unknown kind "%s", must be "video", "audio", "image", "archive", "diskimage", "object", or an extension starting with a dot`, k)
+		}
+	}
+}
+
+// newDestination returns the destination configured by dc. Field names in error
+// messages start with prefix, to indicate which mirror they are about.
+func newDestination(dc *destinationConfig, prefix string) (d destination) {
+	switch dc.Kind {
 	default:
-		log.Fatalf(`unknown remote kind "%s"`, config.Kind)
+		log.Fatalf(`unknown remote kind "%s" in field "%skind"`, dc.Kind, prefix)
 	case "":
-		log.Print(`missing field "kind", must be "local" or "googles3"`)
+		log.Printf(`missing field "%skind", must be "local", "googles3", "gcs", "s3", "azureblob", "sftp", "webdav", "rest" or "exec"`, prefix)
 		printExampleConfig()
 		os.Exit(2)
 	case "local":
 		if *remotePath != "" {
-			config.Local.Path = *remotePath
+			dc.Local.Path = *remotePath
 		}
-		if config.Local.Path == "" {
-			log.Print(`field "local" must be set for kind "local"`)
+		if dc.Local.Path == "" {
+			log.Printf(`field "%slocal" must be set for kind "local"`, prefix)
 			printExampleConfig()
 			os.Exit(2)
 		}
-		path := config.Local.Path
+		path := dc.Local.Path
 		if !strings.HasSuffix(path, "/") {
 			path += "/"
 		}
-		store = &local{path}
+		d = &local{path: path}
 	case "googles3":
 		if *remotePath != "" {
-			config.GoogleS3.Path = *remotePath
+			dc.GoogleS3.Path = *remotePath
 		}
-		if config.GoogleS3.AccessKey == "" || config.GoogleS3.Secret == "" || config.GoogleS3.Bucket == "" || config.GoogleS3.Path == "" {
-			log.Print(`fields "googles3.accessKey", "googles3.secret", googles3.bucket" and  "googles3.path" must be set`)
+		if dc.GoogleS3.AccessKey == "" || dc.GoogleS3.Secret == "" || dc.GoogleS3.Bucket == "" || dc.GoogleS3.Path == "" {
+			log.Printf(`fields "%sgoogles3.accessKey", "%sgoogles3.secret", "%sgoogles3.bucket" and "%sgoogles3.path" must be set`, prefix, prefix, prefix, prefix)
 			printExampleConfig()
 			os.Exit(2)
 		}
-		path := config.GoogleS3.Path
+		path := dc.GoogleS3.Path
 		if !strings.HasPrefix(path, "/") || !strings.HasSuffix(path, "/") {
-			log.Fatal(`field "googles3.path" must start and end with a slash`)
+			log.Fatalf(`field "%sgoogles3.path" must start and end with a slash`, prefix)
 		}
-		store = &googleS3{config.GoogleS3.Bucket, path}
-	}
-	if config.Passphrase == "" {
-		log.Fatalln("passphrase cannot be empty")
+		partSize := s3DefaultPart
+		if dc.GoogleS3.PartSize > 0 {
+			partSize = dc.GoogleS3.PartSize * 1024 * 1024
+		}
+		if partSize < 5*1024*1024 {
+			log.Fatalf(`field "%sgoogles3.partSize" must be at least 5 (MB)`, prefix)
+		}
+		inFlight := dc.GoogleS3.PartsInFlight
+		if inFlight <= 0 {
+			inFlight = defaultPartsInFlight
+		}
+		endpoint := googleS3Endpoint
+		if dc.GoogleS3.Endpoint != "" {
+			u, err := url.Parse(dc.GoogleS3.Endpoint)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				log.Fatalf(`field "%sgoogles3.endpoint" must be an http or https url without path, eg "https://storage.googleapis.com"`, prefix)
+			}
+			endpoint = u.Scheme + "://" + u.Host
+		}
+		d = &googleS3{endpoint, dc.GoogleS3.AccessKey, dc.GoogleS3.Secret, dc.GoogleS3.Bucket, path, partSize, inFlight}
+	case "gcs":
+		if *remotePath != "" {
+			dc.GCS.Path = *remotePath
+		}
+		c := dc.GCS
+		if c.KeyFile == "" || c.Bucket == "" || c.Path == "" {
+			log.Printf(`fields "%sgcs.keyFile", "%sgcs.bucket" and "%sgcs.path" must be set`, prefix, prefix, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		if !strings.HasPrefix(c.Path, "/") || !strings.HasSuffix(c.Path, "/") {
+			log.Fatalf(`field "%sgcs.path" must start and end with a slash`, prefix)
+		}
+		endpoint := gcsEndpoint
+		if c.Endpoint != "" {
+			u, err := url.Parse(c.Endpoint)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				log.Fatalf(`field "%sgcs.endpoint" must be an http or https url without path, eg "https://storage.googleapis.com"`, prefix)
+			}
+			endpoint = u.Scheme + "://" + u.Host
+		}
+		if c.TokenURL != "" {
+			u, err := url.Parse(c.TokenURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				log.Fatalf(`field "%sgcs.tokenURL" must be an http or https url, eg "https://oauth2.googleapis.com/token"`, prefix)
+			}
+		}
+		buf, err := ioutil.ReadFile(c.KeyFile)
+		check(err, fmt.Sprintf(`reading field "%sgcs.keyFile"`, prefix))
+		auth, err := parseGCSServiceAccount(buf, c.TokenURL)
+		check(err, fmt.Sprintf(`field "%sgcs.keyFile"`, prefix))
+		partSize := s3DefaultPart
+		if c.PartSize > 0 {
+			partSize = c.PartSize * 1024 * 1024
+		}
+		d = &gcs{endpoint, auth, c.Bucket, c.Path, partSize}
+	case "s3":
+		if *remotePath != "" {
+			dc.S3.Path = *remotePath
+		}
+		c := dc.S3
+		if c.AccessKey == "" || c.Secret == "" || c.Bucket == "" || c.Path == "" {
+			log.Printf(`fields "%ss3.accessKey", "%ss3.secret", "%ss3.bucket" and "%ss3.path" must be set`, prefix, prefix, prefix, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		if !strings.HasPrefix(c.Path, "/") || !strings.HasSuffix(c.Path, "/") {
+			log.Fatalf(`field "%ss3.path" must start and end with a slash`, prefix)
+		}
+		if c.Region == "" {
+			c.Region = "us-east-1"
+		}
+		if c.Endpoint == "" {
+			c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+		}
+		endpoint, err := url.Parse(c.Endpoint)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" || (endpoint.Path != "" && endpoint.Path != "/") {
+			log.Fatalf(`field "%ss3.endpoint" must be an http or https url without path, eg "https://s3.eu-west-1.amazonaws.com"`, prefix)
+		}
+		partSize := s3DefaultPart
+		if c.PartSize > 0 {
+			partSize = c.PartSize * 1024 * 1024
+		}
+		if partSize < 5*1024*1024 {
+			log.Fatalf(`field "%ss3.partSize" must be at least 5 (MB)`, prefix)
+		}
+		inFlight := c.PartsInFlight
+		if inFlight <= 0 {
+			inFlight = defaultPartsInFlight
+		}
+		d = &s3{endpoint, c.Region, c.Bucket, c.Path, c.PathStyle, c.AccessKey, c.Secret, partSize, inFlight}
+	case "azureblob":
+		if *remotePath != "" {
+			dc.AzureBlob.Path = *remotePath
+		}
+		c := dc.AzureBlob
+		if c.Account == "" || c.Container == "" || c.Path == "" || (c.Key == "") == (c.SAS == "") {
+			log.Printf(`fields "%sazureblob.account", "%sazureblob.container", "%sazureblob.path" and one of "%sazureblob.key" or "%sazureblob.sas" must be set`, prefix, prefix, prefix, prefix, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		if !strings.HasPrefix(c.Path, "/") || !strings.HasSuffix(c.Path, "/") {
+			log.Fatalf(`field "%sazureblob.path" must start and end with a slash`, prefix)
+		}
+		if c.Endpoint == "" {
+			c.Endpoint = "https://" + c.Account + ".blob.core.windows.net"
+		}
+		endpoint, err := url.Parse(c.Endpoint)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" || endpoint.RawQuery != "" {
+			log.Fatalf(`field "%sazureblob.endpoint" must be an http or https url, eg "https://account.blob.core.windows.net"`, prefix)
+		}
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+		endpoint.RawPath = ""
+		var key []byte
+		var sas url.Values
+		if c.Key != "" {
+			key, err = base64.StdEncoding.DecodeString(c.Key)
+			check(err, fmt.Sprintf(`parsing field "%sazureblob.key"`, prefix))
+		} else {
+			sas, err = url.ParseQuery(strings.TrimPrefix(c.SAS, "?"))
+			if err == nil && sas.Get("sig") == "" {
+				err = fmt.Errorf(`missing parameter "sig"`)
+			}
+			check(err, fmt.Sprintf(`parsing field "%sazureblob.sas"`, prefix))
+		}
+		if c.PartSize > 4000 {
+			log.Fatalf(`field "%sazureblob.partSize" must be at most 4000 (MB)`, prefix)
+		}
+		partSize := s3DefaultPart
+		if c.PartSize > 0 {
+			partSize = c.PartSize * 1024 * 1024
+		}
+		inFlight := c.PartsInFlight
+		if inFlight <= 0 {
+			inFlight = defaultPartsInFlight
+		}
+		d = &azureBlob{endpoint, c.Account, key, sas, c.Container, c.Path, partSize, inFlight}
+	case "sftp":
+		if *remotePath != "" {
+			dc.SFTP.Path = *remotePath
+		}
+		c := dc.SFTP
+		if c.Address == "" || c.User == "" || c.Path == "" {
+			log.Printf(`fields "%ssftp.address", "%ssftp.user" and "%ssftp.path" must be set`, prefix, prefix, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		var err error
+		d, err = newSftp(c.Address, c.User, c.KeyFile, c.KeyPassphrase, c.KnownHostsFile, c.Path)
+		check(err, prefix+"sftp configuration")
+	case "webdav":
+		if dc.WebDAV.URL == "" {
+			log.Printf(`field "%swebdav.url" must be set`, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		u, err := url.Parse(dc.WebDAV.URL)
+		check(err, fmt.Sprintf(`parsing field "%swebdav.url"`, prefix))
+		if *remotePath != "" {
+			u.Path = *remotePath
+		}
+		err = checkWebdavURL(u)
+		check(err, fmt.Sprintf(`field "%swebdav.url"`, prefix))
+		d = &webdav{base: u, user: dc.WebDAV.User, password: dc.WebDAV.Password}
+	case "rest":
+		c := dc.Rest
+		if c.URL == "" || c.User == "" || c.Password == "" {
+			log.Printf(`fields "%srest.url", "%srest.user" and "%srest.password" must be set`, prefix, prefix, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		if *remotePath != "" {
+			// run a repository server for each path instead
+			log.Fatalf(`flag "-path" not supported for %skind "rest", the repository server has a single namespace`, prefix)
+		}
+		u, err := url.Parse(c.URL)
+		check(err, fmt.Sprintf(`parsing field "%srest.url"`, prefix))
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		err = checkWebdavURL(u)
+		if err == nil && u.Path != "/" {
+			err = fmt.Errorf("path must be /")
+		}
+		check(err, fmt.Sprintf(`field "%srest.url"`, prefix))
+		d = &rest{u, c.User, c.Password}
+	case "exec":
+		if *remotePath != "" {
+			dc.Exec.Path = *remotePath
+		}
+		if len(dc.Exec.Command) == 0 || dc.Exec.Command[0] == "" {
+			log.Printf(`field "%sexec.command" must be set`, prefix)
+			printExampleConfig()
+			os.Exit(2)
+		}
+		d = &external{command: dc.Exec.Command, path: dc.Exec.Path}
 	}
-	if config.IncrementalForFullKeep > config.FullKeep && config.FullKeep > 0 {
-		log.Fatalln("incrementalForFullKeep > fullKeep does not make sense")
+	if dc.Kind != "local" && config.Retries >= 0 {
+		retries, delay := retrySettings()
+		d = &retrying{d, retries, delay}
 	}
+	return d
 }
 
 func printExampleConfig() {
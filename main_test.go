@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFile struct {
@@ -26,6 +31,90 @@ type testTree struct {
 }
 
 func TestMain(t *testing.T) {
+	setMain := func(c *configuration) {
+		c.Kind = "local"
+		c.Local.Path = "testdir/backup"
+	}
+	removeMain := func() {
+		err := os.RemoveAll("testdir/backup")
+		if err != nil {
+			t.Errorf("removing tree: %s", err)
+		}
+	}
+	testBackups(t, setMain, removeMain)
+}
+
+// testDestinationDir checks that d stores files in a subdirectory, as used for
+// chunks, and that they are not listed with the top-level files.
+func testDestinationDir(t *testing.T, d destination) {
+	t.Helper()
+
+	names, err := d.ListDir("missing")
+	if err != nil || len(names) != 0 {
+		t.Errorf("listing missing subdirectory, got %v, %v", names, err)
+	}
+
+	f, err := d.Create("sub/a.tmp")
+	if err != nil {
+		t.Fatalf("create in subdirectory: %s", err)
+	}
+	if _, err := f.Write([]byte("sub")); err != nil {
+		t.Fatalf("write in subdirectory: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close in subdirectory: %s", err)
+	}
+	if err := d.Rename("sub/a.tmp", "sub/a"); err != nil {
+		t.Fatalf("rename in subdirectory: %s", err)
+	}
+
+	names, err = d.ListDir("sub")
+	if err != nil || len(names) != 1 || names[0] != "a" {
+		t.Errorf("listing subdirectory, got %v, %v", names, err)
+	}
+	names, err = d.List()
+	if err != nil {
+		t.Errorf("list: %s", err)
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "sub") {
+			t.Errorf("list returned %q from subdirectory", name)
+		}
+	}
+
+	rc, err := d.Open("sub/a")
+	if err != nil {
+		t.Fatalf("open in subdirectory: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "sub" {
+		t.Errorf("read in subdirectory, got %q, %v", buf, err)
+	}
+
+	if err := d.Delete("sub/a"); err != nil {
+		t.Errorf("delete in subdirectory: %s", err)
+	}
+	names, err = d.ListDir("sub")
+	if err != nil || len(names) != 0 {
+		t.Errorf("listing subdirectory after delete, got %v, %v", names, err)
+	}
+}
+
+// markDown returns a removeMain for testBackups, that makes a fake server respond
+// as if it is down.
+func markDown(mu sync.Locker, down *bool) func() {
+	return func() {
+		mu.Lock()
+		*down = true
+		mu.Unlock()
+	}
+}
+
+// testBackups runs backups and restores with the main destination configured by
+// setMain, and a local mirror. Near the end, removeMain is called to make the main
+// destination unavailable, after which restores must be done from the mirror.
+func testBackups(t *testing.T, setMain func(c *configuration), removeMain func()) {
 	// create config file, make a few backups, some full, some incremental.  with changed files.
 	// test that all files are properly restored, that old incrementals are removed. the inclusion/exclusion.
 
@@ -50,7 +139,6 @@ func TestMain(t *testing.T) {
 
 	writeConfig := func() {
 		c := configuration{
-			Kind: "local",
 			Include: []string{
 				"\\.txt$",
 				"^a/b/$",
@@ -63,7 +151,10 @@ func TestMain(t *testing.T) {
 			IncrementalForFullKeep: 1,
 			Passphrase:             "test1234",
 		}
-		c.Local.Path = "testdir/backup"
+		setMain(&c)
+		c.Mirrors = make([]destinationConfig, 1)
+		c.Mirrors[0].Kind = "local"
+		c.Mirrors[0].Local.Path = "testdir/backup-mirror"
 		f, err := os.Create("testdir/workdir/.bolong.json")
 		test(err, "creating .bolong.json")
 		err = json.NewEncoder(f).Encode(&c)
@@ -199,6 +290,7 @@ func TestMain(t *testing.T) {
 
 	xremoveAll("testdir")
 	xmkdirAll("testdir/backup")
+	xmkdirAll("testdir/backup-mirror")
 	xmkdirAll("testdir/workdir")
 
 	writeConfig()
@@ -350,4 +442,468 @@ func TestMain(t *testing.T) {
 		},
 	}
 	compareTree(xExpTree3, fsTree("testdir/restore/"), true)
+
+	// the mirror has the same backups, old backups were cleaned up there too
+	ml, err := listDestinationBackups(mirrors[1].store)
+	test(err, "listing backups on mirror")
+	l, err = listBackups()
+	test(err, "listing backups")
+	if fmt.Sprintf("%#v", ml) != fmt.Sprintf("%#v", l) {
+		t.Errorf("backups on mirror differ, %#v != %#v", ml, l)
+	}
+
+	// reading from the mirror first
+	*readFrom = "mirror1"
+	parseConfig()
+	*readFrom = ""
+	resetRestoreDir()
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	compareTree(expTree3, fsTree("testdir/restore/"), true)
+
+	// falling back to the mirror, with the main destination gone
+	parseConfig()
+	removeMain()
+	resetRestoreDir()
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	compareTree(expTree3, fsTree("testdir/restore/"), true)
+}
+
+// tcheck fails the test if err is set.
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+// setupTestConfig writes c to testdir/bolong.json and loads it. Without kind, the
+// destination is the local directory testdir/backup. Directories for local
+// destinations are created.
+func setupTestConfig(t *testing.T, c configuration) {
+	t.Helper()
+	if c.Kind == "" {
+		c.Kind = "local"
+		c.Local.Path = "testdir/backup"
+	}
+	if c.Passphrase == "" {
+		c.Passphrase = "test1234"
+	}
+	for _, dc := range append([]destinationConfig{c.destinationConfig}, c.Mirrors...) {
+		if dc.Kind == "local" {
+			tcheck(t, os.MkdirAll(dc.Local.Path, 0777), "making backup dir")
+		}
+	}
+	buf, err := json.Marshal(&c)
+	tcheck(t, err, "marshal config")
+	tcheck(t, ioutil.WriteFile("testdir/bolong.json", buf, 0666), "writing config")
+	*configPath = "testdir/bolong.json"
+	parseConfig()
+}
+
+// latestIndex returns the index of the latest backup.
+func latestIndex(t *testing.T) *index {
+	t.Helper()
+	b, err := findBackup("latest")
+	tcheck(t, err, "finding backup")
+	idx, err := readIndex(b)
+	tcheck(t, err, "reading index")
+	return idx
+}
+
+// writeTestFiles writes files, by path relative to dir, making directories as needed.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		tcheck(t, os.MkdirAll(filepath.Dir(path), 0777), "making dir")
+		tcheck(t, ioutil.WriteFile(path, []byte(contents), 0666), "writing file")
+	}
+}
+
+// latestNames returns the sorted paths in the latest backup, separated by spaces.
+func latestNames(t *testing.T) string {
+	t.Helper()
+	var names []string
+	for _, f := range latestIndex(t).contents {
+		names = append(names, f.name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// TestHash checks that with hashing enabled, changed files are backed up even if their size and mtime are the same.
+func TestHash(t *testing.T) {
+	os.RemoveAll("testdir")
+	tcheck(t, os.MkdirAll("testdir/workdir", 0777), "making workdir")
+	setupTestConfig(t, configuration{Hash: "ctime", IncrementalsPerFull: 10})
+
+	// like rsync -t, contents change, but size and mtime stay the same
+	mtime := time.Date(2017, 12, 22, 12, 0, 0, 0, time.UTC)
+	write := func(contents string) {
+		t.Helper()
+		tcheck(t, ioutil.WriteFile("testdir/workdir/file.txt", []byte(contents), 0666), "writing file")
+		tcheck(t, os.Chtimes("testdir/workdir/file.txt", mtime, mtime), "setting mtime")
+	}
+	// stored returns whether file.txt was stored in the latest backup, and its hash
+	stored := func() (bool, string) {
+		t.Helper()
+		for _, f := range latestIndex(t).contents {
+			if f.name == "file.txt" {
+				return f.previousIndex == -1, fmt.Sprintf("%x", f.hash)
+			}
+		}
+		t.Fatalf("file.txt not in latest backup")
+		return false, ""
+	}
+
+	write("aaaa")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	_, hash1 := stored()
+	if hash1 == "" {
+		t.Fatalf("no hash in full backup")
+	}
+
+	write("bbbb")
+	backupCmd([]string{"-hash", "none", "testdir/workdir"}, "20171222-0002")
+	if ok, hash := stored(); ok || hash != "" {
+		t.Errorf("without hashing, changed file stored %v, hash %q", ok, hash)
+	}
+
+	// previous backup has no hash, so the file is stored again
+	backupCmd([]string{"testdir/workdir"}, "20171222-0003")
+	ok, hash3 := stored()
+	if !ok || hash3 == "" || hash3 == hash1 {
+		t.Errorf("file without previous hash, stored %v, hash %q", ok, hash3)
+	}
+
+	// ctime unchanged, not read again
+	backupCmd([]string{"testdir/workdir"}, "20171222-0004")
+	if ok, hash := stored(); ok || hash != hash3 {
+		t.Errorf("unchanged file, stored %v, hash %q, expected %q", ok, hash, hash3)
+	}
+	backupCmd([]string{"-hash", "always", "testdir/workdir"}, "20171222-0005")
+	if ok, hash := stored(); ok || hash != hash3 {
+		t.Errorf("unchanged file with hash always, stored %v, hash %q, expected %q", ok, hash, hash3)
+	}
+
+	write("cccc")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0006")
+	if ok, _ := stored(); !ok {
+		t.Errorf("changed file with same size and mtime not stored")
+	}
+	tcheck(t, os.MkdirAll("testdir/restore", 0777), "making restore dir")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	buf, err := ioutil.ReadFile("testdir/restore/file.txt")
+	if err != nil || string(buf) != "cccc" {
+		t.Errorf("restored file, got %q, %v, expected %q", buf, err, "cccc")
+	}
+}
+
+// TestSources checks backups of multiple directories, and restoring a single one.
+func TestSources(t *testing.T) {
+	read := func(path string) string {
+		t.Helper()
+		buf, err := ioutil.ReadFile(path)
+		tcheck(t, err, "reading restored file")
+		return string(buf)
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir", map[string]string{
+		"etc/hosts":           "127.0.0.1 localhost",
+		"etc/cache/x":         "excluded for etc",
+		"home/mjl/notes":      "notes",
+		"home/mjl/cache/x":    "not excluded for home",
+		"home/mjl/secret.key": "globally excluded",
+	})
+	setupTestConfig(t, configuration{
+		Sources: []sourceConfig{
+			{Name: "etc", Path: "testdir/etc", Exclude: []string{"^cache/"}},
+			{Name: "home", Path: "testdir/home"},
+		},
+		Exclude:             []string{"\\.key$"},
+		IncrementalsPerFull: 1,
+	})
+
+	backupCmd(nil, "20171222-0001")
+	writeTestFiles(t, "testdir", map[string]string{"home/mjl/notes": "more notes"})
+	backupCmd(nil, "20171222-0002")
+
+	for _, f := range latestIndex(t).contents {
+		// only the changed file is stored in the incremental backup
+		if (f.name == "home/mjl/notes") != (f.previousIndex == -1) && !f.isDir {
+			t.Errorf("file %s has previous index %d", f.name, f.previousIndex)
+		}
+	}
+	expect := "etc etc/hosts home home/mjl home/mjl/cache home/mjl/cache/x home/mjl/notes"
+	if got := latestNames(t); got != expect {
+		t.Errorf("files in index, got %s, expected %s", got, expect)
+	}
+
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if s := read("testdir/restore/etc/hosts"); s != "127.0.0.1 localhost" {
+		t.Errorf("restored etc/hosts, got %q", s)
+	}
+	if s := read("testdir/restore/home/mjl/notes"); s != "more notes" {
+		t.Errorf("restored home/mjl/notes, got %q", s)
+	}
+
+	restoreCmd([]string{"-quiet", "-root", "home", "testdir/restore-home"})
+	if s := read("testdir/restore-home/mjl/notes"); s != "more notes" {
+		t.Errorf("restored mjl/notes, got %q", s)
+	}
+	if _, err := os.Stat("testdir/restore-home/hosts"); err == nil {
+		t.Errorf("file from other source restored")
+	}
+}
+
+// TestHardLinks checks that hard linked files are stored once, and restored as hard links.
+func TestHardLinks(t *testing.T) {
+	sameFile := func(p1, p2 string) bool {
+		t.Helper()
+		fi1, err := os.Stat(p1)
+		tcheck(t, err, "stat")
+		fi2, err := os.Stat(p2)
+		tcheck(t, err, "stat")
+		return os.SameFile(fi1, fi2)
+	}
+	// links returns the hard links in the latest backup
+	links := func() map[string]string {
+		t.Helper()
+		l := map[string]string{}
+		for _, f := range latestIndex(t).contents {
+			if f.hardLink() {
+				l[f.name] = f.link
+			}
+		}
+		return l
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"a": "linked", "e": "linked"})
+	tcheck(t, os.Mkdir("testdir/workdir/c", 0777), "making dir")
+	tcheck(t, os.Link("testdir/workdir/a", "testdir/workdir/b"), "linking")
+	tcheck(t, os.Link("testdir/workdir/a", "testdir/workdir/c/d"), "linking")
+	if !sameFile("testdir/workdir/a", "testdir/workdir/b") {
+		t.Skip("file system does not support hard links")
+	}
+	setupTestConfig(t, configuration{IncrementalsPerFull: 2})
+
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	if l := links(); fmt.Sprint(l) != "map[b:a c/d:a]" {
+		t.Errorf("links in full backup, got %v", l)
+	}
+	var stored int64
+	for _, f := range latestIndex(t).contents {
+		if f.dataOffset >= 0 {
+			stored += f.size
+		}
+	}
+	if stored != int64(len("linked")*2) {
+		t.Errorf("stored %d bytes, expected contents of a and e only", stored)
+	}
+
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if !sameFile("testdir/restore/a", "testdir/restore/b") || !sameFile("testdir/restore/a", "testdir/restore/c/d") {
+		t.Errorf("hard links not restored")
+	}
+	if sameFile("testdir/restore/a", "testdir/restore/e") {
+		t.Errorf("independent file restored as hard link")
+	}
+
+	// without the file it links to, a link is restored as regular file
+	restoreCmd([]string{"-quiet", "testdir/restore-b", "^b$"})
+	if buf, err := ioutil.ReadFile("testdir/restore-b/b"); err != nil || string(buf) != "linked" {
+		t.Errorf("restoring link without its file, got %q, %v", buf, err)
+	}
+
+	// unchanged links stay, and when the first path is removed, the next path gets the contents
+	backupCmd([]string{"testdir/workdir"}, "20171222-0002")
+	if l := links(); fmt.Sprint(l) != "map[b:a c/d:a]" {
+		t.Errorf("links in incremental backup, got %v", l)
+	}
+	tcheck(t, os.Remove("testdir/workdir/a"), "removing file")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0003")
+	if l := links(); fmt.Sprint(l) != "map[c/d:b]" {
+		t.Errorf("links after removing first path, got %v", l)
+	}
+	tcheck(t, os.RemoveAll("testdir/restore"), "removing restore dir")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if !sameFile("testdir/restore/b", "testdir/restore/c/d") {
+		t.Errorf("hard links not restored")
+	}
+	if buf, err := ioutil.ReadFile("testdir/restore/c/d"); err != nil || string(buf) != "linked" {
+		t.Errorf("restored link, got %q, %v", buf, err)
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	defer func(onChange string) {
+		config.OnChange = onChange
+	}(config.OnChange)
+
+	os.RemoveAll("testdir")
+	tcheck(t, os.MkdirAll("testdir", 0777), "making testdir")
+	tcheck(t, ioutil.WriteFile("testdir/log", []byte("line 1\n"), 0666), "writing file")
+	info, err := os.Lstat("testdir/log")
+	tcheck(t, err, "stat")
+
+	var buf bytes.Buffer
+	n, err := storeFile("testdir/log", info, &buf, nil)
+	if err != nil || n != 7 || buf.String() != "line 1\n" {
+		t.Fatalf("storing unchanged file, got %d, %q, %v", n, buf.String(), err)
+	}
+
+	// the file grows after the stat, like a log file
+	f, err := os.OpenFile("testdir/log", os.O_APPEND|os.O_WRONLY, 0)
+	tcheck(t, err, "open")
+	_, err = f.Write([]byte("line 2\n"))
+	tcheck(t, err, "append")
+	tcheck(t, f.Close(), "close")
+	buf.Reset()
+	n, err = storeFile("testdir/log", info, &buf, nil)
+	if !errors.Is(err, errFileChanged) || n != 14 || buf.Len() != 14 {
+		t.Errorf("storing grown file, got %d, %d bytes, %v", n, buf.Len(), err)
+	}
+
+	// only the mtime changes, only checked with "onChange" configured
+	info, err = os.Lstat("testdir/log")
+	tcheck(t, err, "stat")
+	tcheck(t, os.Chtimes("testdir/log", time.Now(), info.ModTime().Add(time.Second)), "chtimes")
+	config.OnChange = ""
+	buf.Reset()
+	if _, err := storeFile("testdir/log", info, &buf, nil); err != nil {
+		t.Errorf("storing file with changed mtime without onChange, got %v", err)
+	}
+	config.OnChange = "fail"
+	buf.Reset()
+	if _, err := storeFile("testdir/log", info, &buf, nil); !errors.Is(err, errFileChanged) {
+		t.Errorf("storing file with changed mtime, got %v", err)
+	}
+
+	tcheck(t, os.Remove("testdir/log"), "remove")
+	if _, err := storeFile("testdir/log", info, &buf, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("storing vanished file, got %v", err)
+	}
+}
+
+// TestOnChange checks backups with files that change or vanish while being backed up.
+func TestOnChange(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func() {
+		walkHook = func(path string) {}
+	}()
+
+	// changes is called by the walk for each path, changing files before they are read
+	var changes map[string]func()
+	walkHook = func(path string) {
+		if fn, ok := changes[path]; ok {
+			delete(changes, path)
+			fn()
+		}
+	}
+	appendLine := func() {
+		f, err := os.OpenFile("testdir/workdir/log", os.O_APPEND|os.O_WRONLY, 0)
+		tcheck(t, err, "open")
+		_, err = f.Write([]byte("line\n"))
+		tcheck(t, err, "append")
+		tcheck(t, f.Close(), "close")
+	}
+	// backup makes a backup with onChange, and returns the summary of inconsistent files
+	backup := func(onChange, name string) string {
+		t.Helper()
+		setupTestConfig(t, configuration{OnChange: onChange, IncrementalsPerFull: 10, Exclude: []string{`\.tmp$`}})
+		logs.Reset()
+		if partial := backupCmd([]string{"testdir/workdir"}, name); partial {
+			t.Fatalf("backup %s is partial", name)
+		}
+		if len(changes) > 0 {
+			t.Fatalf("files not visited during backup %s: %v", name, changes)
+		}
+		s := logs.String()
+		if i := strings.Index(s, "changed or vanished during the backup:\n"); i >= 0 {
+			return s[i:]
+		}
+		return ""
+	}
+	// stored returns the size of the log file in the latest backup, and whether its data is in that backup
+	stored := func() (int64, bool) {
+		t.Helper()
+		for _, f := range latestIndex(t).contents {
+			if f.name == "log" {
+				return f.size, f.previousIndex == -1
+			}
+		}
+		t.Fatalf("log not in latest backup")
+		return 0, false
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"log": "line\n", "a": "a", "gone": "gone", "gone.tmp": "excluded"})
+	if s := backup("record", "20171222-0001"); s != "" {
+		t.Errorf("summary for unchanged files, got %q", s)
+	}
+
+	// "record" stores the file as read, with the mtime after reading
+	appendLine()
+	mtime := time.Date(2017, 12, 22, 0, 0, 0, 0, time.UTC)
+	changes = map[string]func(){"testdir/workdir/log": func() {
+		appendLine()
+		tcheck(t, os.Chtimes("testdir/workdir/log", mtime, mtime), "chtimes")
+	}}
+	s := backup("record", "20171222-0002")
+	if size, ok := stored(); size != 15 || !ok {
+		t.Errorf("recorded file, got size %d, stored %v", size, ok)
+	}
+	for _, f := range latestIndex(t).contents {
+		if f.name == "log" && !f.mtime.Equal(mtime) {
+			t.Errorf("recorded file, got mtime %s, expected %s", f.mtime, mtime)
+		}
+	}
+	if !strings.Contains(s, "\tlog: changed, stored as read\n") {
+		t.Errorf("summary for recorded file, got %q", s)
+	}
+
+	// "skip" keeps the version of the previous backup
+	appendLine()
+	changes = map[string]func(){"testdir/workdir/log": appendLine}
+	s = backup("skip", "20171222-0003")
+	if size, ok := stored(); size != 15 || ok {
+		t.Errorf("skipped file, got size %d, stored %v, expected previous version", size, ok)
+	}
+	if !strings.Contains(s, "\tlog: changed while backing it up, skipped\n") {
+		t.Errorf("summary for skipped file, got %q", s)
+	}
+
+	// "retry" reads the file again
+	appendLine()
+	changes = map[string]func(){"testdir/workdir/log": appendLine}
+	s = backup("retry", "20171222-0004")
+	if size, ok := stored(); size != 35 || !ok {
+		t.Errorf("retried file, got size %d, stored %v", size, ok)
+	}
+	if s != "" {
+		t.Errorf("summary for file stored after retry, got %q", s)
+	}
+
+	// files vanishing before they are visited or while they are read are left out, excluded files are not reported
+	writeTestFiles(t, "testdir/workdir", map[string]string{"a": "changed"})
+	changes = map[string]func(){
+		"testdir/workdir/": func() {
+			tcheck(t, os.Remove("testdir/workdir/gone"), "remove")
+			tcheck(t, os.Remove("testdir/workdir/gone.tmp"), "remove")
+		},
+		"testdir/workdir/a": func() {
+			tcheck(t, os.Remove("testdir/workdir/a"), "remove")
+		},
+	}
+	s = backup("record", "20171222-0005")
+	if names := latestNames(t); names != ". log" {
+		t.Errorf("backup with vanished files, got %q", names)
+	}
+	if !strings.HasPrefix(s, "changed or vanished during the backup:\n") || !strings.Contains(s, "\ta: vanished, skipped\n") || !strings.Contains(s, "\tgone: vanished, skipped\n") || strings.Contains(s, "gone.tmp") {
+		t.Errorf("summary for vanished files, got %q", s)
+	}
 }
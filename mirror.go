@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// mirror is one of the configured destinations.
+type mirror struct {
+	name    string
+	store   destination
+	err     error    // first error while writing, no further writes are done after an error
+	created []string // paths created during this run, e.g. the data file of a backup, removed again after an error
+
+	fullKeep               int // number of backups to keep, from the config of the mirror or the top-level config
+	incrementalForFullKeep int
+}
+
+// mirrored is a destination that writes to all mirrors, and reads from the first mirror that works.
+// All mirrors get exactly the same (encrypted) files, so any mirror can be read from.
+// When writing to a mirror fails, the mirror is dropped, and writing continues to
+// the others. Only when all mirrors failed is an error returned. The caller
+// must check for failed mirrors with failed() when done.
+type mirrored struct {
+	mirrors []*mirror // in order of preference for reading
+}
+
+var _ destination = &mirrored{}
+
+// fail marks m as failed with err, and tries to remove the files created on it.
+func (r *mirrored) fail(m *mirror, err error) {
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	log.Printf("mirror %s failed, continuing without it: %s\n", m.name, err)
+	for _, path := range m.created {
+		if err := m.store.Delete(path); err != nil {
+			log.Printf("mirror %s: cleaning up %s: %s\n", m.name, path, err)
+		}
+	}
+	m.created = nil
+}
+
+// active returns the mirrors that have not failed.
+func (r *mirrored) active() []*mirror {
+	var l []*mirror
+	for _, m := range r.mirrors {
+		if m.err == nil {
+			l = append(l, m)
+		}
+	}
+	return l
+}
+
+// failed returns the mirrors that failed.
+func (r *mirrored) failed() []*mirror {
+	var l []*mirror
+	for _, m := range r.mirrors {
+		if m.err != nil {
+			l = append(l, m)
+		}
+	}
+	return l
+}
+
+// missing returns the first active mirror that does not have all backups of
+// chain, and the first backup it does not have. An incremental backup based on
+// chain could not be restored from such a mirror, e.g. because it failed during
+// an earlier backup. Mirrors that cannot be listed are marked as failed.
+func (r *mirrored) missing(chain []*backup) (*mirror, *backup) {
+	for _, m := range r.active() {
+		l, err := listDestinationBackups(m.store)
+		if err != nil {
+			r.fail(m, fmt.Errorf("listing backups: %w", err))
+			continue
+		}
+		have := map[backup]bool{}
+		for _, b := range l {
+			have[*b] = true
+		}
+		for _, b := range chain {
+			if !have[*b] {
+				return m, b
+			}
+		}
+	}
+	return nil, nil
+}
+
+// read calls fn for each mirror until it succeeds.
+func (r *mirrored) read(op string, fn func(d destination) error) error {
+	var errs []string
+	for _, m := range r.mirrors {
+		err := fn(m.store)
+		if err == nil {
+			return nil
+		}
+		log.Printf("%s from mirror %s failed, trying next mirror: %s\n", op, m.name, err)
+		errs = append(errs, fmt.Sprintf("mirror %s: %s", m.name, err))
+	}
+	return fmt.Errorf("%s failed on all mirrors: %s", op, strings.Join(errs, "; "))
+}
+
+func (r *mirrored) List() (names []string, err error) {
+	err = r.read("listing files", func(d destination) error {
+		names, err = d.List()
+		return err
+	})
+	return
+}
+
+func (r *mirrored) ListDir(dir string) (names []string, err error) {
+	err = r.read("listing files in "+dir, func(d destination) error {
+		names, err = d.ListDir(dir)
+		return err
+	})
+	return
+}
+
+func (r *mirrored) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *mirrored) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	err = r.read("opening "+path, func(d destination) error {
+		rc, err = d.OpenRange(path, offset, length)
+		return err
+	})
+	return
+}
+
+// write calls fn for each active mirror, marking mirrors for which it fails as failed.
+func (r *mirrored) write(fn func(m *mirror) error) error {
+	ok := false
+	var errs []string
+	for _, m := range r.active() {
+		err := fn(m)
+		if err != nil {
+			r.fail(m, err)
+			errs = append(errs, fmt.Sprintf("mirror %s: %s", m.name, err))
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("failed on all mirrors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *mirrored) Create(path string) (w io.WriteCloser, err error) {
+	tw := &teeWriter{r: r, path: path}
+	err = r.write(func(m *mirror) error {
+		f, err := m.store.Create(path)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", path, err)
+		}
+		m.created = append(m.created, path)
+		tw.files = append(tw.files, teeFile{m, f, path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tw, nil
+}
+
+func (r *mirrored) Rename(opath, npath string) (err error) {
+	return r.write(func(m *mirror) error {
+		err := m.store.Rename(opath, npath)
+		if err != nil {
+			return err
+		}
+		for i, p := range m.created {
+			if p == opath {
+				m.created[i] = npath
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes path from all mirrors. A mirror that doesn't have the file
+// does not fail, it may have missed a backup. Only if no mirror had the file is
+// the not-exist error returned.
+func (r *mirrored) Delete(path string) (err error) {
+	var notExist error
+	deleted := false
+	err = r.write(func(m *mirror) error {
+		err := m.store.Delete(path)
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			notExist = err
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		deleted = true
+		for i, p := range m.created {
+			if p == path {
+				m.created = append(m.created[:i], m.created[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	if err == nil && !deleted && notExist != nil {
+		return notExist
+	}
+	return err
+}
+
+type teeFile struct {
+	m    *mirror
+	f    io.WriteCloser
+	path string
+}
+
+// aborter is implemented by writers that can stop a write without storing the file.
+type aborter interface {
+	abort()
+}
+
+// discard stops writing tf, for a mirror that failed. Closing would store a
+// partial file, so the write is aborted, or the file removed after closing.
+func discard(tf teeFile) {
+	if a, ok := tf.f.(aborter); ok {
+		a.abort()
+		return
+	}
+	tf.f.Close()
+	if err := tf.m.store.Delete(tf.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("mirror %s: cleaning up %s: %s\n", tf.m.name, tf.path, err)
+	}
+}
+
+// teeWriter writes the same data to a file on each mirror.
+type teeWriter struct {
+	r     *mirrored
+	path  string
+	files []teeFile
+}
+
+func (w *teeWriter) Write(buf []byte) (int, error) {
+	var errs []string
+	files := w.files[:0]
+	for _, tf := range w.files {
+		if tf.m.err != nil {
+			// failed during an operation on another file
+			discard(tf)
+			continue
+		}
+		n, err := tf.f.Write(buf)
+		if err == nil && n != len(buf) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			discard(tf)
+			w.r.fail(tf.m, fmt.Errorf("writing %s: %w", w.path, err))
+			errs = append(errs, fmt.Sprintf("mirror %s: %s", tf.m.name, err))
+			continue
+		}
+		files = append(files, tf)
+	}
+	w.files = files
+	if len(w.files) == 0 {
+		return 0, fmt.Errorf("writing %s failed on all mirrors: %s", w.path, strings.Join(errs, "; "))
+	}
+	return len(buf), nil
+}
+
+func (w *teeWriter) Close() error {
+	var errs []string
+	ok := false
+	for _, tf := range w.files {
+		if tf.m.err != nil {
+			discard(tf)
+			continue
+		}
+		err := tf.f.Close()
+		if err != nil {
+			w.r.fail(tf.m, fmt.Errorf("closing %s: %w", w.path, err))
+			errs = append(errs, fmt.Sprintf("mirror %s: %s", tf.m.name, err))
+			continue
+		}
+		ok = true
+	}
+	w.files = nil
+	if !ok {
+		return fmt.Errorf("closing %s failed on all mirrors: %s", w.path, strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// broken is a destination that fails writes after failAfter bytes, and fails all other operations if down.
+type broken struct {
+	destination
+	down      bool
+	failAfter int
+}
+
+func (b *broken) List() ([]string, error) {
+	if b.down {
+		return nil, fmt.Errorf("unreachable")
+	}
+	return b.destination.List()
+}
+
+func (b *broken) ListDir(dir string) ([]string, error) {
+	if b.down {
+		return nil, fmt.Errorf("unreachable")
+	}
+	return b.destination.ListDir(dir)
+}
+
+func (b *broken) OpenRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if b.down {
+		return nil, fmt.Errorf("unreachable")
+	}
+	return b.destination.OpenRange(path, offset, length)
+}
+
+func (b *broken) Create(path string) (io.WriteCloser, error) {
+	if b.down {
+		return nil, fmt.Errorf("unreachable")
+	}
+	f, err := b.destination.Create(path)
+	return &brokenWriter{f, b.failAfter}, err
+}
+
+type brokenWriter struct {
+	io.WriteCloser
+	remaining int
+}
+
+func (w *brokenWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.remaining {
+		return 0, fmt.Errorf("connection lost")
+	}
+	w.remaining -= len(buf)
+	return w.WriteCloser.Write(buf)
+}
+
+func (w *brokenWriter) abort() {
+	w.WriteCloser.(aborter).abort()
+}
+
+func TestMirrored(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "bolong-mirror")
+		if err != nil {
+			t.Fatalf("tempdir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir+"/")
+	}
+	b := &broken{destination: &local{path: dirs[1]}, failAfter: 5}
+	r := &mirrored{[]*mirror{
+		{name: "a", store: &local{path: dirs[0]}},
+		{name: "b", store: b},
+		{name: "c", store: &local{path: dirs[2]}},
+	}}
+
+	write := func(path, data string) error {
+		f, err := r.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	if err := write("x", "1234"); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	// fails on b, which is dropped and cleaned up
+	if err := write("y.tmp", "123456789"); err != nil {
+		t.Fatalf("write with failing mirror: %s", err)
+	}
+	if err := r.Rename("y.tmp", "y"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if failed := r.failed(); len(failed) != 1 || failed[0].name != "b" {
+		t.Fatalf("expected mirror b to have failed, got %v", failed)
+	}
+	for i, dir := range dirs {
+		names, err := (&local{path: dir}).List()
+		exp := "[x y]"
+		if i == 1 {
+			exp = "[]"
+		}
+		if err != nil || fmt.Sprint(names) != exp {
+			t.Errorf("mirror %d has files %v, %v, expected %s", i, names, err, exp)
+		}
+	}
+
+	// reads fall back to other mirrors
+	r.mirrors[0], r.mirrors[1] = r.mirrors[1], r.mirrors[0]
+	b.down = true
+	names, err := r.List()
+	if err != nil || fmt.Sprint(names) != "[x y]" {
+		t.Errorf("list with unreachable mirror, got %v, %v", names, err)
+	}
+	if err := os.Remove(dirs[0] + "y"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	rc, err := r.Open("y")
+	if err != nil {
+		t.Fatalf("open, with file missing on first two mirrors: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "123456789" {
+		t.Errorf("read from mirror, got %q, %v", buf, err)
+	}
+
+	// a file missing on some mirrors is removed from the others
+	if err := r.Delete("y"); err != nil {
+		t.Errorf("delete: %s", err)
+	}
+	if err := r.Delete("y"); err == nil || !os.IsNotExist(err) {
+		t.Errorf("delete of missing file, got %v, expected not exist", err)
+	}
+
+	// failing on all mirrors is an error
+	r.mirrors[1].store = &broken{destination: r.mirrors[1].store}
+	r.mirrors[2].store = &broken{destination: r.mirrors[2].store}
+	if err := write("z", "1"); err == nil {
+		t.Errorf("write failing on all mirrors succeeded")
+	}
+}
+
+// TestMirrorFailedWrite checks that files still being written to a mirror when
+// it fails are not stored on that mirror.
+func TestMirrorFailedWrite(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "bolong-mirror")
+		tcheck(t, err, "tempdir")
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir+"/")
+	}
+	r := &mirrored{[]*mirror{
+		{name: "a", store: &local{path: dirs[0]}},
+		{name: "b", store: &broken{destination: &local{path: dirs[1]}, failAfter: 5}},
+	}}
+
+	data, err := r.Create("20171222-0001.data")
+	tcheck(t, err, "create")
+	_, err = data.Write([]byte("1234"))
+	tcheck(t, err, "write")
+	// fails mirror b while the data file is still being written
+	index, err := r.Create("20171222-0001.index1.full.tmp")
+	tcheck(t, err, "create")
+	_, err = index.Write([]byte("123456789"))
+	tcheck(t, err, "write with failing mirror")
+	tcheck(t, index.Close(), "close")
+	_, err = data.Write([]byte("5678"))
+	tcheck(t, err, "write after mirror failed")
+	tcheck(t, data.Close(), "close")
+
+	for i, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		tcheck(t, err, "readdir")
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		exp := "[20171222-0001.data 20171222-0001.index1.full.tmp]"
+		if i == 1 {
+			exp = "[]"
+		}
+		if fmt.Sprint(names) != exp {
+			t.Errorf("mirror %d has files %v, expected %s", i, names, exp)
+		}
+	}
+}
+
+// TestMirrorChain checks that an incremental backup is only made when all
+// mirrors have the backups it builds on.
+func TestMirrorChain(t *testing.T) {
+	// latest returns the name of the latest backup on the mirror at dir, and whether it is incremental
+	latest := func(dir string) (string, bool) {
+		t.Helper()
+		l, err := listDestinationBackups(&local{path: dir})
+		tcheck(t, err, "listing backups")
+		if len(l) == 0 {
+			t.Fatalf("no backups in %s", dir)
+		}
+		b := l[len(l)-1]
+		return b.name, b.incremental
+	}
+	write := func(contents string) {
+		t.Helper()
+		writeTestFiles(t, "testdir/workdir", map[string]string{"file": contents})
+	}
+
+	os.RemoveAll("testdir")
+	c := configuration{IncrementalsPerFull: 10}
+	c.Mirrors = make([]destinationConfig, 1)
+	c.Mirrors[0].Kind = "local"
+	c.Mirrors[0].Local.Path = "testdir/backup-mirror"
+	setupTestConfig(t, c)
+
+	write("1")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	write("22")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0002")
+	if name, incr := latest("testdir/backup-mirror/"); name != "20171222-0002" || !incr {
+		t.Fatalf("latest backup on mirror, got %s, incremental %v", name, incr)
+	}
+
+	// as if the second mirror failed during the last backup, removing the files it created
+	for _, path := range []string{"20171222-0002.data", "20171222-0002.index1.incr"} {
+		tcheck(t, os.Remove("testdir/backup-mirror/"+path), "removing file")
+	}
+	write("333")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0003")
+	for _, dir := range []string{"testdir/backup/", "testdir/backup-mirror/"} {
+		if name, incr := latest(dir); name != "20171222-0003" || incr {
+			t.Errorf("latest backup on %s, got %s, incremental %v, expected full", dir, name, incr)
+		}
+	}
+
+	// the mirror has the complete chain again
+	write("4444")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0004")
+	if name, incr := latest("testdir/backup-mirror/"); name != "20171222-0004" || !incr {
+		t.Errorf("latest backup on mirror, got %s, incremental %v, expected incremental", name, incr)
+	}
+
+	// restorable from the mirror alone
+	tcheck(t, os.RemoveAll("testdir/backup"), "removing main destination")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if buf, err := ioutil.ReadFile("testdir/restore/file"); err != nil || string(buf) != "4444" {
+		t.Errorf("restored from mirror, got %q, %v", buf, err)
+	}
+}
+
+// TestMirrorRetention checks that old backups are cleaned up per mirror, with the
+// number of backups to keep of each mirror.
+func TestMirrorRetention(t *testing.T) {
+	// names returns the backups on the mirror at dir
+	names := func(dir string) string {
+		t.Helper()
+		l, err := listDestinationBackups(&local{path: dir})
+		tcheck(t, err, "listing backups")
+		var names []string
+		for _, b := range l {
+			names = append(names, b.name)
+		}
+		return fmt.Sprint(names)
+	}
+
+	os.RemoveAll("testdir")
+	c := configuration{FullKeep: 2}
+	c.Mirrors = make([]destinationConfig, 2)
+	c.Mirrors[0].Kind = "local"
+	c.Mirrors[0].Local.Path = "testdir/backup-keep3"
+	c.Mirrors[0].FullKeep = 3
+	c.Mirrors[1].Kind = "local"
+	c.Mirrors[1].Local.Path = "testdir/backup-default"
+	setupTestConfig(t, c)
+
+	for i := 1; i <= 4; i++ {
+		writeTestFiles(t, "testdir/workdir", map[string]string{"file": fmt.Sprint(i)})
+		backupCmd([]string{"testdir/workdir"}, fmt.Sprintf("20171222-000%d", i))
+	}
+	if l := names("testdir/backup/"); l != "[20171222-0003 20171222-0004]" {
+		t.Errorf("backups on main destination, got %s", l)
+	}
+	if l := names("testdir/backup-keep3/"); l != "[20171222-0002 20171222-0003 20171222-0004]" {
+		t.Errorf("backups on mirror with own fullKeep, got %s", l)
+	}
+	if l := names("testdir/backup-default/"); l != "[20171222-0003 20171222-0004]" {
+		t.Errorf("backups on mirror with top-level fullKeep, got %s", l)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of parts in a multipart upload, as allowed by S3.
+	maxParts = 10000
+
+	// number of parts uploaded concurrently, if not configured.
+	defaultPartsInFlight = 2
+)
+
+// multipartUploader is implemented by remote destinations that can store
+// a file in parts. Large files are then uploaded without buffering them
+// completely, and with requests of a known size. When a request fails,
+// only that part has to be sent again.
+type multipartUploader interface {
+	// Upload a complete file in a single request. Used for files smaller than a single part.
+	putObject(path string, buf []byte) error
+
+	initUpload(path string) (uploadID string, err error)
+	uploadPart(path, uploadID string, partNumber int, buf []byte) (etag string, err error)
+	completeUpload(path, uploadID string, etags []string) error
+	abortUpload(path, uploadID string) error
+}
+
+// multipartWriter buffers data until it has a full part, then uploads it in
+// the background, with up to inFlight parts being uploaded at the same time.
+// A failed part upload is retried like other remote operations, configured with
+// config fields "retries" and "retryDelay". On close, the remaining data
+// is uploaded as the last part and the upload is completed. If the file is
+// smaller than a single part, it is uploaded in a single request.
+type multipartWriter struct {
+	u        multipartUploader
+	path     string
+	partSize int
+	buf      []byte
+	uploadID string // only changed while locked, read by abortUploads
+	nparts   int
+	sem      chan []byte // buffers available for parts, limits the number of parts in flight
+	wg       sync.WaitGroup
+
+	sync.Mutex
+	etags []string // index is part number - 1
+	err   error    // first error, also from background uploads
+}
+
+var _ io.WriteCloser = &multipartWriter{}
+
+// uploads are the multipart writers in progress, for aborting their uploads
+// when a backup is interrupted.
+var uploads = struct {
+	sync.Mutex
+	writers map[*multipartWriter]struct{}
+}{writers: map[*multipartWriter]struct{}{}}
+
+func newMultipartWriter(u multipartUploader, path string, partSize, inFlight int) *multipartWriter {
+	if inFlight < 1 {
+		inFlight = 1
+	}
+	w := &multipartWriter{
+		u:        u,
+		path:     path,
+		partSize: partSize,
+		sem:      make(chan []byte, inFlight+1),
+	}
+	// one buffer is being filled while others are uploading
+	for i := 0; i < inFlight+1; i++ {
+		w.sem <- nil // buffers are allocated when needed
+	}
+	uploads.Lock()
+	uploads.writers[w] = struct{}{}
+	uploads.Unlock()
+	return w
+}
+
+// done unregisters w as in progress.
+func (w *multipartWriter) done() {
+	uploads.Lock()
+	delete(uploads.writers, w)
+	uploads.Unlock()
+}
+
+// abortUploads aborts the multipart uploads in progress, e.g. when the backup
+// is interrupted. Parts still being uploaded are not waited for.
+func abortUploads() {
+	uploads.Lock()
+	writers := uploads.writers
+	uploads.writers = map[*multipartWriter]struct{}{}
+	uploads.Unlock()
+	for w := range writers {
+		w.Lock()
+		uploadID := w.uploadID
+		if w.err == nil {
+			w.err = fmt.Errorf("writing %s: upload aborted", w.path)
+		}
+		w.Unlock()
+		if uploadID != "" {
+			log.Println("aborting multipart upload for", w.path)
+			if err := w.u.abortUpload(w.path, uploadID); err != nil {
+				log.Printf("aborting multipart upload for %s: %s\n", w.path, err)
+			}
+		}
+	}
+}
+
+func (w *multipartWriter) error() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.err
+}
+
+func (w *multipartWriter) setError(err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *multipartWriter) Write(buf []byte) (int, error) {
+	if err := w.error(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(buf) > 0 {
+		if w.buf == nil {
+			w.buf = <-w.sem
+			if w.buf == nil {
+				w.buf = make([]byte, 0, w.partSize)
+			}
+		}
+		m := w.partSize - len(w.buf)
+		if m > len(buf) {
+			m = len(buf)
+		}
+		w.buf = append(w.buf, buf[:m]...)
+		buf = buf[m:]
+		n += m
+		if len(w.buf) == w.partSize {
+			err := w.flush()
+			if err != nil {
+				w.setError(err)
+				w.abort()
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush starts an upload of the buffered data as the next part, starting the multipart upload if needed.
+func (w *multipartWriter) flush() error {
+	if err := w.error(); err != nil {
+		return err
+	}
+	if w.uploadID == "" {
+		id, err := w.u.initUpload(w.path)
+		if err != nil {
+			return fmt.Errorf("starting multipart upload for %s: %w", w.path, err)
+		}
+		w.Lock()
+		w.uploadID = id
+		w.Unlock()
+	}
+	if w.nparts >= maxParts {
+		return fmt.Errorf("uploading %s: more than %d parts, increase the part size", w.path, maxParts)
+	}
+	w.nparts++
+	partNumber := w.nparts
+	uploadID := w.uploadID
+	buf := w.buf
+	w.buf = nil
+	w.Lock()
+	w.etags = append(w.etags, "")
+	w.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() {
+			w.sem <- buf[:0]
+		}()
+
+		retries, delay := retrySettings()
+		var err error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				if w.error() != nil {
+					return
+				}
+				log.Printf("uploading part %d of %s failed, retrying in %s: %s", partNumber, w.path, delay, err)
+				time.Sleep(delay)
+				delay *= 2
+			}
+			var etag string
+			etag, err = w.u.uploadPart(w.path, uploadID, partNumber, buf)
+			if err == nil {
+				w.Lock()
+				w.etags[partNumber-1] = etag
+				w.Unlock()
+				return
+			}
+		}
+		w.setError(fmt.Errorf("uploading part %d of %s: %w", partNumber, w.path, err))
+	}()
+	return nil
+}
+
+// wait waits until all background part uploads have finished.
+func (w *multipartWriter) wait() {
+	w.wg.Wait()
+}
+
+// abort stops the upload without storing the file, waiting for part uploads in progress.
+func (w *multipartWriter) abort() {
+	w.done()
+	w.setError(fmt.Errorf("writing %s: upload aborted", w.path))
+	w.wait()
+	w.Lock()
+	uploadID := w.uploadID
+	w.uploadID = ""
+	w.Unlock()
+	if uploadID == "" {
+		return
+	}
+	// best effort, the original error is more interesting
+	w.u.abortUpload(w.path, uploadID)
+}
+
+func (w *multipartWriter) Close() error {
+	if err := w.error(); err != nil {
+		w.abort()
+		return err
+	}
+	// any further writes or closes are errors
+	defer w.setError(fmt.Errorf("writing %s: file already closed", w.path))
+	defer w.done()
+
+	if w.uploadID == "" {
+		err := w.u.putObject(w.path, w.buf)
+		w.buf = nil
+		return err
+	}
+	if len(w.buf) > 0 {
+		err := w.flush()
+		if err != nil {
+			w.setError(err)
+		}
+	}
+	w.buf = nil
+	w.wait()
+	err := w.error()
+	if err == nil {
+		err = w.u.completeUpload(w.path, w.uploadID, w.etags)
+		if err != nil {
+			err = fmt.Errorf("completing multipart upload for %s: %w", w.path, err)
+		}
+	}
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestContinueOnError(t *testing.T) {
+	// backup makes a backup as an unprivileged user, root can read all files.
+	backup := func(name string) bool {
+		t.Helper()
+		if os.Geteuid() != 0 {
+			return backupCmd([]string{"testdir/workdir"}, name)
+		}
+		// the file system uid only applies to this thread
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		syscall.Setfsuid(65534)
+		defer syscall.Setfsuid(0)
+		return backupCmd([]string{"testdir/workdir"}, name)
+	}
+	// index returns the paths in the latest backup, with the index of the backup with their data
+	index := func() string {
+		t.Helper()
+		idx := latestIndex(t)
+		var l []string
+		for _, f := range idx.contents {
+			s := f.name
+			if f.dataOffset >= 0 && f.previousIndex >= 0 {
+				s += "@" + idx.previous[f.previousIndex].name
+			}
+			l = append(l, s)
+		}
+		sort.Strings(l)
+		return strings.Join(l, " ")
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"a": "a", "secret": "secret", "private/b": "b"})
+	tcheck(t, os.Link("testdir/workdir/a", "testdir/workdir/private/la"), "link")
+	tcheck(t, os.Link("testdir/workdir/private/b", "testdir/workdir/private/lb"), "link")
+	c := configuration{ContinueOnError: true, IncrementalsPerFull: 2}
+	setupTestConfig(t, c)
+	tcheck(t, os.Chmod("testdir/backup", 0777), "chmod backup dir")
+
+	if partial := backup("20171222-0001"); partial {
+		t.Fatalf("first backup is partial")
+	}
+
+	// in an incremental backup, the versions of the previous backup are kept. a
+	// hard link to a file outside the unreadable directory becomes a copy.
+	tcheck(t, ioutil.WriteFile("testdir/workdir/secret", []byte("changed"), 0644), "writing file")
+	tcheck(t, os.Chmod("testdir/workdir/secret", 0), "chmod")
+	tcheck(t, os.Chmod("testdir/workdir/private", 0), "chmod")
+	if _, err := os.Open("testdir/workdir/secret"); err == nil && os.Geteuid() != 0 {
+		t.Skip("permissions not enforced")
+	}
+	if partial := backup("20171222-0002"); !partial {
+		t.Fatalf("backup with unreadable files not partial")
+	}
+	if s, exp := index(), ". a@20171222-0001 private private/b@20171222-0001 private/la@20171222-0001 private/lb secret@20171222-0001"; s != exp {
+		t.Errorf("incremental backup, got %q, expected %q", s, exp)
+	}
+
+	// in a full backup, they are left out
+	c.IncrementalsPerFull = 0
+	setupTestConfig(t, c)
+	if partial := backup("20171222-0003"); !partial {
+		t.Fatalf("backup with unreadable files not partial")
+	}
+	if s, exp := index(), ". a private"; s != exp {
+		t.Errorf("full backup, got %q, expected %q", s, exp)
+	}
+
+	// excluded unreadable directories don't make a backup partial
+	tcheck(t, os.Chmod("testdir/workdir/secret", 0644), "chmod")
+	c.Exclude = []string{"^private/"}
+	setupTestConfig(t, c)
+	if partial := backup("20171222-0004"); partial {
+		t.Fatalf("backup with excluded unreadable directory is partial")
+	}
+	if s, exp := index(), ". a secret"; s != exp {
+		t.Errorf("backup with excluded directory, got %q, expected %q", s, exp)
+	}
+	tcheck(t, os.Chmod("testdir/workdir/private", 0755), "chmod")
+
+	// files that cannot be stat'ed only make a backup partial if they are not excluded
+	writeTestFiles(t, "testdir/workdir", map[string]string{"ssh/id_rsa": "key"})
+	tcheck(t, os.Chmod("testdir/workdir/ssh", 0644), "chmod")
+	c.Exclude = nil
+	setupTestConfig(t, c)
+	if partial := backup("20171222-0005"); !partial {
+		t.Fatalf("backup with file that cannot be stat'ed not partial")
+	}
+	c.Exclude = []string{"^ssh/id_rsa$"}
+	setupTestConfig(t, c)
+	if partial := backup("20171222-0006"); partial {
+		t.Fatalf("backup with excluded file that cannot be stat'ed is partial")
+	}
+	if s, exp := index(), ". a private private/b private/la private/lb secret ssh"; s != exp {
+		t.Errorf("backup with excluded file, got %q, expected %q", s, exp)
+	}
+	tcheck(t, os.Chmod("testdir/workdir/ssh", 0755), "chmod")
+}
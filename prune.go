@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+// prune removes old backups according to the configured number of backups to
+// keep, as is done after each backup. Useful when backups are made with
+// credentials that can only add files, e.g. to an append-only "serve-repo"
+// repository, and old backups are removed with admin credentials.
+func prune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "print backups that are removed")
+	fs.Usage = func() {
+		log.Println("usage: bolong [flags] prune [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l := mirrors
+	if len(mirrors) == 1 {
+		m := *mirrors[0]
+		m.name = ""
+		l = []*mirror{&m}
+	}
+	pruned := false
+	for _, m := range l {
+		if m.fullKeep > 0 || m.incrementalForFullKeep > 0 {
+			cleanupBackups(m, *verbose)
+			pruned = true
+		}
+	}
+	if !pruned {
+		log.Fatalln(`nothing to prune, "fullKeep" and "incrementalForFullKeep" are not set`)
+	}
+}
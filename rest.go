@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// rest is a destination for a repository served by "bolong serve-repo".
+type rest struct {
+	base     *url.URL // path ends with slash
+	user     string
+	password string
+}
+
+var _ destination = &rest{}
+
+// url returns the full url for path, relative to the base url.
+func (r *rest) url(path string) *url.URL {
+	u := *r.base
+	u.Path += path
+	u.RawPath = ""
+	return &u
+}
+
+func (r *rest) request(method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	req.SetBasicAuth(r.user, r.password)
+	return req, nil
+}
+
+// do executes req. If the response status is not okStatus, an error with the
+// message from the server is returned, and the response is closed.
+func (r *rest) do(req *http.Request, okStatus int) (*http.Response, error) {
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == okStatus {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &httpStatusError{"", okStatus, resp.StatusCode, strings.TrimSpace(string(buf))}
+}
+
+// List returns filenames, ordered by name.
+func (r *rest) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *rest) ListDir(dir string) (names []string, err error) {
+	u := r.url("")
+	if dir != "" {
+		u = r.url(dir + "/")
+	}
+	req, err := r.request("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.do(req, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", u.Path, err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		names = append(names, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading listing: %s", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *rest) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *rest) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	req, err := r.request("GET", r.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	expect := http.StatusOK
+	if rng := httpRange(offset, length); rng != "" {
+		req.Header.Set("Range", rng)
+		expect = http.StatusPartialContent
+	}
+	resp, err := r.do(req, expect)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+// Create streams the file to the server in a single PUT request, with chunked
+// transfer encoding. The server only stores the file if all data was received.
+func (r *rest) Create(path string) (w io.WriteCloser, err error) {
+	pr, pw := io.Pipe()
+	req, err := r.request("PUT", r.url(path), pr)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &pipeWriter{pw, make(chan error, 1)}
+	go func() {
+		resp, err := r.do(req, http.StatusCreated)
+		if err != nil {
+			err = fmt.Errorf("creating %s: %w", path, err)
+			pr.CloseWithError(err)
+			upload.err <- err
+			return
+		}
+		upload.err <- resp.Body.Close()
+	}()
+	return upload, nil
+}
+
+// Rename moves the file at the server. In an append-only repository, existing files cannot be replaced.
+func (r *rest) Rename(opath, npath string) (err error) {
+	u := r.url(opath)
+	u.RawQuery = url.Values{"rename": {npath}}.Encode()
+	req, err := r.request("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(req, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("moving %s to %s: %w", opath, npath, err)
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes a file. In an append-only repository, this requires admin credentials.
+func (r *rest) Delete(path string) (err error) {
+	req, err := r.request("DELETE", r.url(path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(req, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
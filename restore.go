@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +21,66 @@ type restore struct {
 	previousIndex int
 	previous      previous
 	files         []*file // no directories
+	ranges        []*dataRange
+	chunked       *file // if set, the restore is of this file, from its chunks
+}
+
+// dataRange is a part of a data file that is fetched and read sequentially, starting at a checkpoint.
+type dataRange struct {
+	start checkpoint
+	end   int64   // compressed offset where the range ends, -1 for the end of the data file
+	files []*file // ascending by dataOffset
+}
+
+// readCheckpoints returns the checkpoints of the data file of an earlier backup, from its index.
+func readCheckpoints(p previous) ([]checkpoint, error) {
+	idx, err := readIndex(&backup{p.name, p.incremental})
+	if err != nil && p.incremental {
+		// older versions marked a full backup as incremental when referenced by the incremental backup that followed it
+		var xerr error
+		idx, xerr = readIndex(&backup{p.name, false})
+		if xerr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return idx.checkpoints, nil
+}
+
+// planRanges divides files into ranges of the data file to fetch.
+// Files must be sorted by dataOffset. A new range is started when a checkpoint
+// lies between the end of a file and the start of the next file, so the data in
+// between is skipped.
+func planRanges(files []*file, checkpoints []checkpoint) []*dataRange {
+	// the start of the data file is always a checkpoint
+	cps := append([]checkpoint{{0, 0}}, checkpoints...)
+	var ranges []*dataRange
+	var r *dataRange
+	var end int64 // uncompressed offset where the data for r ends
+	for _, f := range files {
+		i := sort.Search(len(cps), func(i int) bool {
+			return cps[i].offset > f.dataOffset
+		}) - 1
+		if r == nil || cps[i].offset > end {
+			r = &dataRange{start: cps[i]}
+			ranges = append(ranges, r)
+			end = f.dataOffset
+		}
+		r.files = append(r.files, f)
+		if f.dataOffset+f.size > end {
+			end = f.dataOffset + f.size
+		}
+		r.end = -1
+		j := sort.Search(len(cps), func(j int) bool {
+			return cps[j].offset >= end
+		})
+		if j < len(cps) && cps[j].compressed > r.start.compressed {
+			r.end = cps[j].compressed
+		}
+	}
+	return ranges
 }
 
 func restoreCmd(args []string) {
@@ -31,6 +92,9 @@ func restoreCmd(args []string) {
 	verbose := fs.Bool("verbose", false, "print restored files")
 	quiet := fs.Bool("quiet", false, "be quiet, do not show progress")
 	name := fs.String("name", "latest", "name of backup to restore")
+	root := fs.String("root", "", "only restore the files of this source, directly in destination")
+	noXattrs := fs.Bool("no-xattrs", false, "do not restore extended attributes")
+	xattrSkip := fs.String("xattr-skip", "", "comma-separated namespaces of extended attributes not to restore, e.g. \"security,trusted\" when not running as root")
 	err := fs.Parse(args)
 	if err != nil {
 		log.Println(err)
@@ -66,6 +130,10 @@ func restoreCmd(args []string) {
 
 	idx, err := readIndex(backup)
 	check(err, "parsing index")
+	if *root != "" {
+		err = idx.selectRoot(*root)
+		check(err, "selecting source")
+	}
 
 	idx.previous = append(idx.previous, previous{backup.incremental, backup.name, idx.dataSize})
 	var (
@@ -76,14 +144,20 @@ func restoreCmd(args []string) {
 		nfiles     int
 		dirs       []*file
 		needDirs   = map[string]struct{}{}
+		files      = map[string]*file{}
+		selected   = map[string]struct{}{}
+		links      []*file // hard links, created after restoring the file they link to
+		specials   []*file // fifos, sockets and devices, created after the directories
 	)
 	for _, f := range idx.contents {
+		files[f.name] = f
 		if f.isDir {
 			dirs = append(dirs, f)
 		}
 		if len(regexps) > 0 && !matchAny(regexps, f.name) {
 			continue
 		}
+		selected[f.name] = struct{}{}
 		if f.isDir {
 			needDirs[f.name] = struct{}{}
 			continue
@@ -98,21 +172,74 @@ func restoreCmd(args []string) {
 			dir = path.Dir(dir)
 		}
 
+		if f.special != 0 {
+			specials = append(specials, f)
+			nfiles++
+			continue
+		}
+
+		if f.hardLink() {
+			if _, ok := selected[f.link]; ok {
+				links = append(links, f)
+				nfiles++
+				continue
+			}
+			// the file it links to is not restored, restore the contents as a regular file
+			f = files[f.link].linkCopy(f)
+		}
+
+		if f.chunked() {
+			restores = append(restores, &restore{previousIndex: -1, chunked: f})
+			for _, c := range f.chunks {
+				dataSize += c.size
+			}
+			totalSize += f.size
+			nfiles++
+			continue
+		}
+
 		prevIndex := f.previousIndex
 		if prevIndex < 0 {
 			prevIndex = len(idx.previous) - 1
 		}
 		rest, ok := restoreMap[prevIndex]
 		if !ok {
-			rest = &restore{prevIndex, idx.previous[prevIndex], nil}
+			rest = &restore{prevIndex, idx.previous[prevIndex], nil, nil, nil}
 			restoreMap[prevIndex] = rest
 			restores = append(restores, rest)
-			dataSize += rest.previous.dataSize
 		}
 		rest.files = append(rest.files, f)
 		totalSize += f.size
 		nfiles++
 	}
+
+	// determine which parts of the data files we need, so we only fetch those.
+	for _, rest := range restores {
+		if rest.chunked != nil {
+			continue
+		}
+		checkpoints := idx.checkpoints
+		if rest.previousIndex != len(idx.previous)-1 {
+			// the checkpoints of earlier data files are in their own index
+			var err error
+			checkpoints, err = readCheckpoints(rest.previous)
+			if err != nil {
+				log.Printf("reading index of earlier backup %s for checkpoints, reading its entire data file: %s\n", rest.previous.name, err)
+			}
+		}
+		sort.Slice(rest.files, func(i, j int) bool {
+			return rest.files[i].dataOffset < rest.files[j].dataOffset
+		})
+		rest.ranges = planRanges(rest.files, checkpoints)
+		dataSize += saltSize
+		for _, r := range rest.ranges {
+			offset, length := safeRange(r.start, r.end)
+			if length < 0 {
+				length = rest.previous.dataSize - offset
+			}
+			dataSize += length
+		}
+	}
 	if *verbose {
 		dirWord := "dirs"
 		if len(dirs) == 1 {
@@ -219,6 +346,79 @@ func restoreCmd(args []string) {
 		return
 	}
 
+	skipNamespaces := map[string]bool{}
+	for _, ns := range strings.Split(*xattrSkip, ",") {
+		if ns != "" {
+			skipNamespaces[ns] = true
+		}
+	}
+	var xattrWarning sync.Once
+	// attributes that could not be set, because the user may not or the file system doesn't support
+	// them, are reported at the end instead of failing the restore
+	var xattrsSkipped struct {
+		sync.Mutex
+		n     int
+		first string
+	}
+	// setXattrs restores the extended attributes. Done after chown, which clears file capabilities.
+	setXattrs := func(lcheck func(error, string), file *file, tpath string) {
+		if *noXattrs || len(file.xattrs) == 0 {
+			return
+		}
+		if !xattrSupported {
+			xattrWarning.Do(func() {
+				log.Printf("\nwarning: extended attributes not supported on this system, not restoring them\n")
+			})
+			return
+		}
+		for _, x := range file.xattrs {
+			if skipNamespaces[xattrNamespace(x.name)] {
+				continue
+			}
+			err := writeXattr(tpath, x)
+			if err != nil && xattrNotPermitted(err) {
+				xattrsSkipped.Lock()
+				if xattrsSkipped.n == 0 {
+					xattrsSkipped.first = fmt.Sprintf("%s: %s", file.name, err)
+				}
+				xattrsSkipped.n++
+				xattrsSkipped.Unlock()
+				continue
+			}
+			lcheck(err, file.name)
+		}
+	}
+
+	// setAttributes sets owner, permissions, extended attributes and mtime of a restored file.
+	setAttributes := func(lcheck func(error, string), file *file, tpath string) {
+		err := lchown(file, tpath)
+		lcheck(err, "lchown")
+		err = os.Chmod(tpath, file.permissions)
+		lcheck(err, "setting permisssions on restored file")
+		setXattrs(lcheck, file, tpath)
+		err = os.Chtimes(tpath, file.mtime, file.mtime)
+		lcheck(err, "setting mtime/atime on restored file")
+	}
+
+	var idKey []byte
+	restoreChunked := func(lcheck func(error, string), file *file) {
+		if *verbose {
+			fmt.Println(file.name)
+		}
+		tpath := target + file.name
+		f, err := os.Create(tpath)
+		lcheck(err, "restoring file")
+		for result := range fetchChunks(store, idKey, file.chunks, transferred) {
+			fc := <-result
+			lcheck(fc.err, "restoring contents of file")
+			_, err = fc.buf.WriteTo(f)
+			lcheck(err, "restoring contents of file")
+		}
+		err = f.Close()
+		lcheck(err, "closing restored file")
+		setAttributes(lcheck, file, tpath)
+	}
+
 	restorePrevious := func(rest *restore) {
 		lcheck, handle := errorHandler(func(err error) {
 			// print additional newline, or we would print text behind progress text
@@ -226,68 +426,83 @@ func restoreCmd(args []string) {
 		})
 		defer handle()
 
-		dataPath := fmt.Sprintf("%s.data", rest.previous.name)
-		var data io.ReadCloser
-		data, err := store.Open(dataPath)
-		lcheck(err, "open data file")
-		data = &readCounter{data, transferred}
-		data, err = newSafeReader(data)
-		lcheck(err, "opening safe reader")
-		defer func() {
-			err := data.Close()
-			lcheck(err, "closing data file")
-		}()
+		if rest.chunked != nil {
+			restoreChunked(lcheck, rest.chunked)
+			return
+		}
 
-		sort.Slice(rest.files, func(i, j int) bool {
-			return rest.files[i].dataOffset < rest.files[j].dataOffset
-		})
+		dataPath := fmt.Sprintf("%s.data", rest.previous.name)
 
-		offset := int64(0)
-		for _, file := range rest.files {
-			if *verbose {
-				fmt.Println(file.name)
-			}
-			tpath := target + file.name
+		// the key is derived from the salt at the start of the data file
+		var salt io.ReadCloser
+		salt, err := store.OpenRange(dataPath, 0, saltSize)
+		lcheck(err, "open data file")
+		key, err := readSafeKey(&readCounter{salt, transferred})
+		lcheck(err, "reading data file")
+		err = salt.Close()
+		lcheck(err, "closing data file")
 
-			if file.dataOffset > offset {
-				_, err := io.Copy(ioutil.Discard, &io.LimitedReader{R: data, N: file.dataOffset - offset})
-				lcheck(err, "skipping through data")
-				offset = file.dataOffset
-			}
+		restoreFiles := func(data io.Reader, offset int64, files []*file) {
+			for _, file := range files {
+				if *verbose {
+					fmt.Println(file.name)
+				}
+				tpath := target + file.name
 
-			if file.isSymlink {
-				buf, err := ioutil.ReadAll(&io.LimitedReader{R: data, N: file.size})
-				lcheck(err, "reading symlink path")
-				n := int64(len(buf))
-				if n != file.size {
-					log.Fatalf("short file contents for symlink %s: expected to read %d, but got %d", file.name, file.size, n)
+				if file.dataOffset > offset {
+					_, err := io.Copy(ioutil.Discard, &io.LimitedReader{R: data, N: file.dataOffset - offset})
+					lcheck(err, "skipping through data")
+					offset = file.dataOffset
 				}
-				offset += file.size
-				target := string(buf)
-				err = os.Symlink(target, tpath)
-				lcheck(err, "creating symlink")
-				err = lchown(file, tpath)
-				lcheck(err, "lchown")
-			} else {
-				f, err := os.Create(tpath)
-				lcheck(err, "restoring file")
-				r := &io.LimitedReader{R: data, N: file.size}
-				n, err := io.Copy(f, r)
-				if n != file.size {
-					log.Fatalf("short file contents for file %s: expected to write %d, but wrote %d", file.name, file.size, n)
+
+				if file.isSymlink {
+					buf, err := ioutil.ReadAll(&io.LimitedReader{R: data, N: file.size})
+					lcheck(err, "reading symlink path")
+					n := int64(len(buf))
+					if n != file.size {
+						log.Fatalf("short file contents for symlink %s: expected to read %d, but got %d", file.name, file.size, n)
+					}
+					offset += file.size
+					target := string(buf)
+					err = os.Symlink(target, tpath)
+					lcheck(err, "creating symlink")
+					err = lchown(file, tpath)
+					lcheck(err, "lchown")
+					setXattrs(lcheck, file, tpath)
+				} else {
+					f, err := os.Create(tpath)
+					lcheck(err, "restoring file")
+					r := &io.LimitedReader{R: data, N: file.size}
+					n, err := io.Copy(f, r)
+					if n != file.size {
+						log.Fatalf("short file contents for file %s: expected to write %d, but wrote %d", file.name, file.size, n)
+					}
+					offset += file.size
+					lcheck(err, "restoring contents of file")
+					err = f.Close()
+					lcheck(err, "closing restored file")
+					setAttributes(lcheck, file, tpath)
 				}
-				offset += file.size
-				lcheck(err, "restoring contents of file")
-				err = f.Close()
-				lcheck(err, "closing restored file")
-				err = lchown(file, tpath)
-				lcheck(err, "lchown")
-				err = os.Chmod(tpath, file.permissions)
-				lcheck(err, "setting permisssions on restored file")
-				err = os.Chtimes(tpath, file.mtime, file.mtime)
-				lcheck(err, "setting mtime/atime on restored file")
 			}
 		}
+
+		for _, r := range rest.ranges {
+			offset, length := safeRange(r.start, r.end)
+			var data io.ReadCloser
+			data, err := store.OpenRange(dataPath, offset, length)
+			lcheck(err, "open data file")
+			data = &readCounter{data, transferred}
+			data, err = newSafeRangeReader(data, key, r.start)
+			lcheck(err, "opening safe reader")
+			restoreFiles(data, r.start.offset, r.files)
+			err = data.Close()
+			lcheck(err, "closing data file")
+		}
+	}
+
+	if len(restores) > len(restoreMap) {
+		// some files are stored in chunks
+		idKey = chunkIDKey()
 	}
 
 	// restore all directories first. ensures creating files always works.
@@ -298,6 +513,22 @@ func restoreCmd(args []string) {
 		}
 	}
 
+	for _, f := range specials {
+		if f.special&os.ModeDevice != 0 && euid != 0 {
+			if !*quiet {
+				log.Printf("warning: not running as root, not restoring device %s\n", f.name)
+			}
+			continue
+		}
+		if *verbose {
+			fmt.Println(f.name)
+		}
+		tpath := target + f.name
+		err = makeSpecial(tpath, f)
+		check(err, "restoring special file")
+		setAttributes(check, f, tpath)
+	}
+
 	// start restoring.
 	// we restore 3 data files at a time, for higher throughput.
 	// we start the first & last data files first. those are most likely to be big and dominate the time it takes to restore.
@@ -398,14 +629,27 @@ func restoreCmd(args []string) {
 		fmt.Println("")
 	}
 
+	for _, f := range links {
+		if *verbose {
+			fmt.Println(f.name)
+		}
+		err = os.Link(target+f.link, target+f.name)
+		check(err, "restoring hard link")
+	}
+
 	// restore owner and mtimes for directories
 	for _, f := range dirs {
 		if _, ok := needDirs[f.name]; ok {
 			tpath := target + f.name
 			err = lchown(f, tpath)
 			check(err, "lchown")
+			setXattrs(check, f, tpath)
 			err = os.Chtimes(tpath, f.mtime, f.mtime)
 			check(err, "setting mtime for restored directory")
 		}
 	}
+
+	if xattrsSkipped.n > 0 {
+		log.Printf("warning: %d extended attributes not restored, e.g. %s (skip namespaces with -xattr-skip)\n", xattrsSkipped.n, xattrsSkipped.first)
+	}
 }
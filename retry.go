@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	defaultRetries = 5
+	maxRetryDelay  = time.Minute
+)
+
+// retrying wraps a remote destination, retrying failed operations with
+// exponential backoff. Only temporary errors are retried, e.g. network errors
+// and server errors, not a missing file.
+// Reads from an opened file that fail halfway are resumed by opening the rest of the file again.
+// Writes to a created file are not retried, destinations must handle that
+// themselves, e.g. with multipart uploads.
+type retrying struct {
+	store   destination
+	retries int           // number of retries after the first attempt
+	delay   time.Duration // before first retry, doubled for each next retry
+}
+
+var _ destination = &retrying{}
+
+// unit of config field "retryDelay", shorter in tests.
+var retryDelayUnit = time.Second
+
+// retrySettings returns the number of retries after a failed first attempt,
+// and the delay before the first retry, from config fields "retries" and
+// "retryDelay".
+func retrySettings() (retries int, delay time.Duration) {
+	if config.Retries < 0 {
+		return 0, 0
+	}
+	retries = config.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	delay = retryDelayUnit
+	if config.RetryDelay > 0 {
+		delay = time.Duration(config.RetryDelay) * retryDelayUnit
+	}
+	return
+}
+
+// temporaryError is implemented by errors from destinations that know whether retrying can help.
+type temporaryError interface {
+	temporary() bool
+}
+
+// retryable returns whether an operation that failed with err should be retried.
+// Errors that don't say whether they are temporary, such as network errors, are retried.
+func retryable(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	var te temporaryError
+	if errors.As(err, &te) {
+		return te.temporary()
+	}
+	return true
+}
+
+// sleep waits before the retry after attempt number attempt (starting at 0).
+func (r *retrying) sleep(op string, attempt int, err error) {
+	delay := r.delay << uint(attempt)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	// add some jitter, so parallel operations don't all retry at the same moment
+	delay += time.Duration(rand.Int63n(int64(delay)/4 + 1))
+	log.Printf("%s failed, retrying in %s: %s", op, delay.Round(time.Millisecond), err)
+	time.Sleep(delay)
+}
+
+// do calls fn until it succeeds, fails with a permanent error, or we run out of retries.
+// fn is passed the attempt number, starting at 0.
+func (r *retrying) do(op string, fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= r.retries || !retryable(err) {
+			return err
+		}
+		r.sleep(op, attempt, err)
+	}
+}
+
+func (r *retrying) List() (names []string, err error) {
+	err = r.do("listing files", func(int) error {
+		names, err = r.store.List()
+		return err
+	})
+	return
+}
+
+func (r *retrying) ListDir(dir string) (names []string, err error) {
+	err = r.do("listing files in "+dir, func(int) error {
+		names, err = r.store.ListDir(dir)
+		return err
+	})
+	return
+}
+
+func (r *retrying) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *retrying) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	if length == 0 {
+		// nothing to read, and an empty range cannot be requested from http-based destinations
+		return &retryReader{r: r, path: path, offset: offset}, nil
+	}
+	err = r.do("opening "+path, func(int) error {
+		rc, err = r.store.OpenRange(path, offset, length)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retryReader{r: r, path: path, rc: rc, offset: offset, remaining: length}, nil
+}
+
+// Create retries creating the file, but not writes to the file.
+func (r *retrying) Create(path string) (w io.WriteCloser, err error) {
+	err = r.do("creating "+path, func(int) error {
+		w, err = r.store.Create(path)
+		return err
+	})
+	return
+}
+
+// Rename retries renaming. If an earlier attempt may have succeeded but we did not get a response,
+// a retry may find the original file missing. We then check if the file is present under the new name.
+func (r *retrying) Rename(opath, npath string) (err error) {
+	return r.do("renaming "+opath, func(attempt int) error {
+		err := r.store.Rename(opath, npath)
+		if attempt > 0 && err != nil && errors.Is(err, os.ErrNotExist) {
+			dir, nname := splitDir(npath)
+			_, oname := splitDir(opath)
+			names, lerr := r.store.ListDir(dir)
+			if lerr == nil && hasName(names, nname) && !hasName(names, oname) {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// Delete retries removing the file. If an earlier attempt may have succeeded, a missing file is not an error.
+func (r *retrying) Delete(path string) (err error) {
+	return r.do("deleting "+path, func(attempt int) error {
+		err := r.store.Delete(path)
+		if attempt > 0 && err != nil && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func hasName(names []string, name string) bool {
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// retryReader resumes reading a file that fails halfway, by opening the remainder of the file again.
+type retryReader struct {
+	r         *retrying
+	path      string
+	rc        io.ReadCloser
+	offset    int64 // of next byte to read
+	remaining int64 // bytes left to read, -1 for until end of file
+}
+
+func (rr *retryReader) Read(buf []byte) (n int, err error) {
+	eof := false
+	err = rr.r.do("reading "+rr.path, func(attempt int) (err error) {
+		if rr.rc == nil {
+			if rr.remaining == 0 {
+				eof = true
+				return nil
+			}
+			rr.rc, err = rr.r.store.OpenRange(rr.path, rr.offset, rr.remaining)
+			if err != nil {
+				return err
+			}
+		}
+		n, err = rr.rc.Read(buf)
+		rr.offset += int64(n)
+		if rr.remaining >= 0 {
+			rr.remaining -= int64(n)
+		}
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		if err != nil && n == 0 {
+			// the next attempt opens the file again
+			rr.rc.Close()
+			rr.rc = nil
+			return err
+		}
+		// an error with data is returned again by the next read
+		return nil
+	})
+	if err == nil && eof {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (rr *retryReader) Close() error {
+	if rr.rc == nil {
+		return nil
+	}
+	return rr.rc.Close()
+}
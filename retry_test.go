@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flaky is a destination that fails operations with a temporary error until failures runs out.
+// Reads from opened files fail after readLimit bytes, if set.
+type flaky struct {
+	destination
+	failures  int
+	calls     int
+	readLimit int64
+}
+
+func (f *flaky) fail() error {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return &httpStatusError{"", 200, 503, "try again"}
+	}
+	return nil
+}
+
+func (f *flaky) List() ([]string, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.destination.List()
+}
+
+func (f *flaky) ListDir(dir string) ([]string, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.destination.ListDir(dir)
+}
+
+func (f *flaky) OpenRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	rc, err := f.destination.OpenRange(path, offset, length)
+	if err != nil || f.readLimit == 0 {
+		return rc, err
+	}
+	return &flakyReader{rc, f.readLimit}, nil
+}
+
+func (f *flaky) Rename(opath, npath string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	err := f.destination.Rename(opath, npath)
+	if err == nil && f.calls == 1 {
+		// succeeded, but pretend the response got lost
+		return fmt.Errorf("connection reset")
+	}
+	return err
+}
+
+func (f *flaky) Delete(path string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.destination.Delete(path)
+}
+
+type flakyReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *flakyReader) Read(buf []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(buf)) > r.remaining {
+		buf = buf[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(buf)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func TestRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-retry")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	data := strings.Repeat("0123456789", 1000)
+	if err := ioutil.WriteFile(dir+"/a", []byte(data), 0666); err != nil {
+		t.Fatalf("writing file: %s", err)
+	}
+
+	f := &flaky{destination: &local{path: dir + "/"}}
+	r := &retrying{f, 3, time.Millisecond}
+
+	f.failures = 3
+	names, err := r.List()
+	if err != nil || len(names) != 1 || f.calls != 4 {
+		t.Errorf("list with temporary failures, got %v, %v, %d calls", names, err, f.calls)
+	}
+
+	f.failures = 4
+	if _, err := r.List(); err == nil {
+		t.Errorf("list with too many failures succeeded")
+	}
+
+	// permanent errors are not retried
+	f.calls = 0
+	if _, err := r.Open("missing"); err == nil || f.calls != 1 {
+		t.Errorf("open of missing file, got err %v after %d calls, expected error after 1 call", err, f.calls)
+	}
+
+	// reads that fail halfway are resumed
+	f.readLimit = 3333
+	rc, err := r.Open("a")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil || string(buf) != data {
+		t.Errorf("read with resumes, got err %v, %d bytes", err, len(buf))
+	}
+	rc.Close()
+
+	// resumed ranged reads stay within the range
+	rc, err = r.OpenRange("a", 1000, 7000)
+	if err != nil {
+		t.Fatalf("open range: %s", err)
+	}
+	buf, err = ioutil.ReadAll(rc)
+	if err != nil || string(buf) != data[1000:8000] {
+		t.Errorf("ranged read with resumes, got err %v, %d bytes", err, len(buf))
+	}
+	rc.Close()
+
+	// empty ranges are not requested from the destination
+	f.calls = 0
+	f.failures = 1
+	rc, err = r.OpenRange("a", 1000, 0)
+	if err != nil {
+		t.Fatalf("open empty range: %s", err)
+	}
+	buf, err = ioutil.ReadAll(rc)
+	if err != nil || len(buf) != 0 || f.calls != 0 {
+		t.Errorf("empty range, got err %v, %d bytes, %d calls", err, len(buf), f.calls)
+	}
+	rc.Close()
+	f.failures = 0
+
+	// rename that succeeded without us getting a response
+	f.calls = 0
+	if err := r.Rename("a", "b"); err != nil {
+		t.Errorf("rename: %s", err)
+	}
+	if _, err := os.Stat(dir + "/b"); err != nil {
+		t.Errorf("renamed file missing: %s", err)
+	}
+
+	// delete of a missing file on a retry succeeds
+	f.calls = 0
+	f.failures = 1
+	if err := r.Delete("b"); err != nil {
+		t.Errorf("delete after temporary failure: %s", err)
+	}
+	if err := r.Delete("b"); err == nil {
+		t.Errorf("delete of missing file on first attempt succeeded")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3 is a destination for S3-compatible storage, e.g. AWS S3, Minio, Ceph RGW.
+// Requests are signed with AWS Signature Version 4.
+type s3 struct {
+	endpoint  *url.URL // scheme and host, eg https://s3.eu-west-1.amazonaws.com
+	region    string
+	bucket    string
+	path      string // starts and ends with slash
+	pathStyle bool   // if set, bucket is in the url path instead of in the host name
+	accessKey string
+	secret    string
+	partSize  int // in bytes
+	inFlight  int // max number of parts uploading concurrently
+}
+
+var _ destination = &s3{}
+var _ multipartUploader = &s3{}
+
+const (
+	s3TimeFormat  = "20060102T150405Z"
+	s3EmptyHash   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of empty payload
+	s3DefaultPart = 64 * 1024 * 1024
+)
+
+// s3Escape escapes s according to the rules for AWS signature version 4.
+// Only the unreserved characters from RFC 3986 are not escaped. Slashes are only kept if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalRequest returns the canonical request for signature version 4.
+// Header names in signedHeaders must be lower case and sorted.
+func s3CanonicalRequest(method, escapedPath string, query url.Values, header http.Header, host string, signedHeaders []string, payloadHash string) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	headers := ""
+	for _, h := range signedHeaders {
+		v := host
+		if h != "host" {
+			v = strings.Join(header[http.CanonicalHeaderKey(h)], ",")
+		}
+		headers += h + ":" + strings.TrimSpace(v) + "\n"
+	}
+
+	return strings.Join([]string{
+		method,
+		escapedPath,
+		strings.Join(params, "&"),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// s3Signature returns the hex-encoded signature for a canonical request.
+func s3Signature(secret, region string, t time.Time, canonicalRequest string) string {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	day := t.Format("20060102")
+	scope := day + "/" + region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	msg := "AWS4-HMAC-SHA256\n" + t.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := mac([]byte("AWS4"+secret), day)
+	key = mac(key, region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	return hex.EncodeToString(mac(key, msg))
+}
+
+// s3SignedHeaders returns the sorted list of headers in h that we include in the signature, including "host".
+func s3SignedHeaders(h http.Header) []string {
+	l := []string{"host"}
+	for k := range h {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" || lk == "content-md5" {
+			l = append(l, lk)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+// sign adds the headers for signature version 4 to req.
+func (r *s3) sign(req *http.Request, payloadHash string, t time.Time) {
+	req.Header.Set("x-amz-date", t.Format(s3TimeFormat))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signed := s3SignedHeaders(req.Header)
+	cr := s3CanonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), req.Header, req.Host, signed, payloadHash)
+	sig := s3Signature(r.secret, r.region, t, cr)
+	scope := t.Format("20060102") + "/" + r.region + "/s3/aws4_request"
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", r.accessKey, scope, strings.Join(signed, ";"), sig))
+}
+
+// url returns the url for key (without leading slash) in our bucket, with optional query string.
+func (r *s3) url(key string, query url.Values) *url.URL {
+	u := &url.URL{
+		Scheme:   r.endpoint.Scheme,
+		Host:     r.endpoint.Host,
+		Path:     "/" + key,
+		RawPath:  "/" + s3Escape(key, true),
+		RawQuery: strings.Replace(query.Encode(), "+", "%20", -1),
+	}
+	if r.pathStyle {
+		u.Path = "/" + r.bucket + u.Path
+		u.RawPath = "/" + s3Escape(r.bucket, false) + u.RawPath
+	} else {
+		u.Host = r.bucket + "." + u.Host
+	}
+	return u
+}
+
+// do signs and executes a request. On success, the response is returned and the
+// caller must close its body. On error, or if the status code is not
+// expectStatus, an error is returned and the response body is closed.
+func (r *s3) do(method, key string, query url.Values, header http.Header, body []byte, expectStatus int) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.url(key, query).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := s3EmptyHash
+	if body != nil {
+		h := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(h[:])
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	r.sign(req, payloadHash, time.Now().UTC())
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectStatus {
+		defer resp.Body.Close()
+		return nil, s3ResponseError(resp, expectStatus)
+	}
+	return resp, nil
+}
+
+// s3ResponseError returns an error for an unexpected http response, with the error code and message from the response body, if any.
+func s3ResponseError(resp *http.Response, expectStatus int) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1024))
+	if xml.Unmarshal(buf, &e) == nil && e.Code != "" {
+		return &httpStatusError{"", expectStatus, resp.StatusCode, e.Code + ": " + e.Message}
+	}
+	return &httpStatusError{"", expectStatus, resp.StatusCode, ""}
+}
+
+// s3CheckBody reads an xml response body that can contain an error, even with a 200 response (e.g. for copy and complete-multipart).
+func s3CheckBody(resp *http.Response, v interface{}) error {
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %s", err)
+	}
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(buf, &e) == nil && e.XMLName.Local == "Error" {
+		return fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	err = xml.Unmarshal(buf, v)
+	if err != nil {
+		return fmt.Errorf("parsing response xml: %s", err)
+	}
+	return nil
+}
+
+// List returns filenames, ordered by name.
+func (r *s3) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *s3) ListDir(dir string) (names []string, err error) {
+	prefix := r.path[1:]
+	if dir != "" {
+		prefix += dir + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := r.do("GET", "", query, nil, nil, 200)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", "/"+r.bucket+"/"+prefix, err)
+		}
+		var list struct {
+			Key                   []string `xml:"Contents>Key"`
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing directory contents xml: %s", err)
+		}
+		for _, key := range list.Key {
+			if !strings.HasPrefix(key, prefix) {
+				return nil, fmt.Errorf("listing %s: key %q does not have requested prefix", "/"+r.bucket+"/"+prefix, key)
+			}
+			names = append(names, key[len(prefix):])
+		}
+		if !list.IsTruncated {
+			break
+		}
+		if list.NextContinuationToken == "" || list.NextContinuationToken == token {
+			return nil, fmt.Errorf("listing %s: truncated listing without new continuation token", "/"+r.bucket+"/"+prefix)
+		}
+		token = list.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *s3) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *s3) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	var header http.Header
+	expect := 200
+	if rng := httpRange(offset, length); rng != "" {
+		header = http.Header{"Range": {rng}}
+		expect = 206
+	}
+	resp, err := r.do("GET", r.path[1:]+path, nil, header, nil, expect)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+func (r *s3) Create(path string) (w io.WriteCloser, err error) {
+	return newMultipartWriter(r, path, r.partSize, r.inFlight), nil
+}
+
+func (r *s3) putObject(path string, buf []byte) error {
+	if buf == nil {
+		buf = []byte{}
+	}
+	resp, err := r.do("PUT", r.path[1:]+path, nil, nil, buf, 200)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
+
+func (r *s3) initUpload(path string) (uploadID string, err error) {
+	resp, err := r.do("POST", r.path[1:]+path, url.Values{"uploads": {""}}, nil, nil, 200)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = s3CheckBody(resp, &result)
+	if err == nil && result.UploadID == "" {
+		err = fmt.Errorf("missing upload id in response")
+	}
+	return result.UploadID, err
+}
+
+func (r *s3) uploadPart(path, uploadID string, partNumber int, buf []byte) (etag string, err error) {
+	query := url.Values{
+		"partNumber": {fmt.Sprintf("%d", partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := r.do("PUT", r.path[1:]+path, query, nil, buf, 200)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	etag = resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("missing etag in response")
+	}
+	return etag, nil
+}
+
+func (r *s3) completeUpload(path, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	buf, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do("POST", r.path[1:]+path, url.Values{"uploadId": {uploadID}}, nil, buf, 200)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3CheckBody(resp, nil)
+}
+
+func (r *s3) abortUpload(path, uploadID string) error {
+	resp, err := r.do("DELETE", r.path[1:]+path, url.Values{"uploadId": {uploadID}}, nil, nil, 204)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Rename copies the file to the new name at the server, then removes the original.
+func (r *s3) Rename(opath, npath string) (err error) {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s3Escape(r.bucket, false)+"/"+s3Escape(r.path[1:]+opath, true))
+	resp, err := r.do("PUT", r.path[1:]+npath, nil, header, nil, 200)
+	if err != nil {
+		return fmt.Errorf("copying resource: %w", err)
+	}
+	err = s3CheckBody(resp, nil)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("copying resource: %w", err)
+	}
+
+	err = r.Delete(opath)
+	if err != nil {
+		return fmt.Errorf("deleting original resource after copying: %w", err)
+	}
+	return nil
+}
+
+func (r *s3) Delete(path string) (err error) {
+	resp, err := r.do("DELETE", r.path[1:]+path, nil, nil, nil, 204)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
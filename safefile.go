@@ -6,6 +6,8 @@ import (
 	"crypto/sha512"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
 
 	"github.com/minio/sio"
 	"github.com/pierrec/lz4"
@@ -15,6 +17,20 @@ import (
 // our safe file consists of:
 // - 32 byte salt, for deriving a key based on a passphrase
 // - a file generated by github.com/minio/sio
+//
+// the data encrypted by sio is lz4-compressed. at checkpoints, the lz4 frame is
+// ended and a new one started, so decompression can start there. all sio packages
+// hold a full payload except the last, so the package holding a position in the
+// compressed data is known, and decryption can start at that package.
+
+const (
+	saltSize       = 32
+	sioPayloadSize = 64 * 1024
+	sioPackageSize = 16 + sioPayloadSize + 16 // header, payload, tag
+)
+
+// minimum uncompressed data between checkpoints.
+var checkpointInterval int64 = 4 * 1024 * 1024
 
 type safeReader struct {
 	orig   io.ReadCloser
@@ -24,17 +40,71 @@ type safeReader struct {
 }
 
 func newSafeReader(r io.ReadCloser) (*safeReader, error) {
-	salt := make([]byte, 32)
+	key, err := readSafeKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return newSafeRangeReader(r, key, checkpoint{})
+}
+
+// derived keys, by passphrase and salt. chunks written in one backup share a
+// salt, caching saves a key derivation for each chunk read.
+var safeKeys = struct {
+	sync.Mutex
+	keys map[string][]byte
+}{keys: map[string][]byte{}}
+
+// safeKey returns the key for salt, derived from the passphrase.
+func safeKey(salt []byte) []byte {
+	k := config.Passphrase + "\x00" + string(salt)
+	safeKeys.Lock()
+	defer safeKeys.Unlock()
+	key, ok := safeKeys.keys[k]
+	if !ok {
+		key = pbkdf2.Key([]byte(config.Passphrase), salt, 4096, 32, sha512.New)
+		safeKeys.keys[k] = key
+	}
+	return key
+}
+
+// readSafeKey reads the salt at the start of a safe file, and returns the key derived from it.
+func readSafeKey(r io.Reader) ([]byte, error) {
+	salt := make([]byte, saltSize)
 	_, err := io.ReadFull(r, salt)
 	if err != nil {
 		return nil, fmt.Errorf("reading salt: %s", err)
 	}
-	key := pbkdf2.Key([]byte(config.Passphrase), salt, 4096, 32, sha512.New)
+	return safeKey(salt), nil
+}
+
+// safeRange returns the range of the safe file to fetch for reading the data
+// from checkpoint c up to compressed offset end, typically the next checkpoint.
+// If end is -1, the range extends to the end of the file, and length is -1.
+func safeRange(c checkpoint, end int64) (offset, length int64) {
+	offset = saltSize + c.compressed/sioPayloadSize*sioPackageSize
+	if end < 0 {
+		return offset, -1
+	}
+	npackages := (end+sioPayloadSize-1)/sioPayloadSize - c.compressed/sioPayloadSize
+	return offset, npackages * sioPackageSize
+}
+
+// newSafeRangeReader returns a reader for the data starting at checkpoint c.
+// Reader r must be positioned at the offset returned by safeRange.
+func newSafeRangeReader(r io.ReadCloser, key []byte, c checkpoint) (*safeReader, error) {
+	var err error
 	sf := &safeReader{orig: r}
-	sf.crypt, err = sio.DecryptReader(sf.orig, sio.Config{Key: key})
+	seq := c.compressed / sioPayloadSize
+	sf.crypt, err = sio.DecryptReader(sf.orig, sio.Config{Key: key, SequenceNumber: uint32(seq)})
 	if err != nil {
 		return nil, fmt.Errorf("decrypting file: %s", err)
 	}
+	if skip := c.compressed - seq*sioPayloadSize; skip > 0 {
+		_, err = io.CopyN(ioutil.Discard, sf.crypt, skip)
+		if err != nil {
+			return nil, fmt.Errorf("skipping to checkpoint: %s", err)
+		}
+	}
 	sf.lz = lz4.NewReader(sf.crypt)
 	sf.reader = bufio.NewReader(sf.lz)
 	return sf, nil
@@ -49,35 +119,77 @@ func (sf *safeReader) Close() error {
 }
 
 type safeWriter struct {
-	orig   io.WriteCloser
-	crypt  io.WriteCloser
-	lz     io.WriteCloser
-	writer *bufio.Writer
+	orig        io.WriteCloser
+	crypt       io.WriteCloser
+	compressed  *writeCounter // counts compressed data written to crypt
+	lz          *lz4.Writer
+	writer      *bufio.Writer
+	offset      int64 // uncompressed data written
+	checkpoints []checkpoint
 }
 
 func newSafeWriter(w io.WriteCloser) (*safeWriter, error) {
-	salt := make([]byte, 32)
-	_, err := rand.Read(salt)
+	salt, key, err := newSafeSalt()
+	if err != nil {
+		return nil, err
+	}
+	return newSafeSaltWriter(w, salt, key)
+}
+
+// newSafeSalt returns a new random salt, and the key derived from it.
+func newSafeSalt() (salt, key []byte, err error) {
+	salt = make([]byte, saltSize)
+	_, err = rand.Read(salt)
 	if err != nil {
-		return nil, fmt.Errorf("generating salt: %s", err)
+		return nil, nil, fmt.Errorf("generating salt: %s", err)
 	}
-	_, err = w.Write(salt)
+	return salt, pbkdf2.Key([]byte(config.Passphrase), salt, 4096, 32, sha512.New), nil
+}
+
+// newSafeSaltWriter returns a writer for a safe file with the salt and key from
+// newSafeSalt. Files can share a salt, sio uses a random nonce for each file.
+func newSafeSaltWriter(w io.WriteCloser, salt, key []byte) (*safeWriter, error) {
+	_, err := w.Write(salt)
 	if err != nil {
 		return nil, fmt.Errorf("writing salt: %s", err)
 	}
-	key := pbkdf2.Key([]byte(config.Passphrase), salt, 4096, 32, sha512.New)
 	sf := &safeWriter{orig: w}
 	sf.crypt, err = sio.EncryptWriter(sf.orig, sio.Config{Key: key})
 	if err != nil {
 		return nil, fmt.Errorf("creating encrypted file: %s", err)
 	}
-	sf.lz = lz4.NewWriter(sf.crypt)
+	sf.compressed = &writeCounter{f: sf.crypt}
+	sf.lz = lz4.NewWriter(sf.compressed)
 	sf.writer = bufio.NewWriter(sf.lz)
 	return sf, nil
 }
 
 func (sf *safeWriter) Write(buf []byte) (n int, err error) {
-	return sf.writer.Write(buf)
+	n, err = sf.writer.Write(buf)
+	sf.offset += int64(n)
+	return
+}
+
+// checkpoint makes a checkpoint at the current offset, if enough data was written since the previous checkpoint.
+// The current lz4 frame is ended, and a new frame started.
+func (sf *safeWriter) checkpoint() error {
+	last := int64(0)
+	if n := len(sf.checkpoints); n > 0 {
+		last = sf.checkpoints[n-1].offset
+	}
+	if sf.offset-last < checkpointInterval {
+		return nil
+	}
+	err := sf.writer.Flush()
+	if err == nil {
+		err = sf.lz.Close()
+	}
+	if err != nil {
+		return err
+	}
+	sf.lz.Reset(sf.compressed)
+	sf.checkpoints = append(sf.checkpoints, checkpoint{sf.offset, sf.compressed.size})
+	return nil
 }
 
 func (sf *safeWriter) Close() error {
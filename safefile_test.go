@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSafeRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-safefile")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(c configuration, interval int64) {
+		config = c
+		checkpointInterval = interval
+	}(config, checkpointInterval)
+	config.Passphrase = "test1234"
+	checkpointInterval = 200 * 1024
+
+	// files of somewhat compressible data, with checkpoints between them
+	rnd := rand.New(rand.NewSource(1))
+	var files []*file
+	var contents [][]byte
+	dest := &local{path: dir + "/"}
+	f, err := dest.Create("x.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	sf, err := newSafeWriter(f)
+	if err != nil {
+		t.Fatalf("new safe writer: %s", err)
+	}
+	offset := int64(0)
+	for i := 0; i < 100; i++ {
+		buf := make([]byte, rnd.Intn(100*1024))
+		for j := range buf {
+			buf[j] = byte('a' + rnd.Intn(4))
+		}
+		if i%10 == 0 {
+			buf = nil
+		}
+		if err := sf.checkpoint(); err != nil {
+			t.Fatalf("checkpoint: %s", err)
+		}
+		if _, err := sf.Write(buf); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		files = append(files, &file{size: int64(len(buf)), dataOffset: offset})
+		contents = append(contents, buf)
+		offset += int64(len(buf))
+	}
+	if err := sf.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if len(sf.checkpoints) < 10 {
+		t.Fatalf("expected at least 10 checkpoints, got %d", len(sf.checkpoints))
+	}
+	info, err := os.Stat(dir + "/x.data")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+
+	rc, err := dest.OpenRange("x.data", 0, saltSize)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	key, err := readSafeKey(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("reading key: %s", err)
+	}
+
+	// restore sets of files, checking we fetch less than the whole file
+	for _, sel := range [][]int{{0}, {1, 2}, {50}, {10, 60, 61, 99}, {99}, {30, 31, 32, 33, 34, 35, 36, 37, 38, 39}} {
+		var need []*file
+		for _, i := range sel {
+			need = append(need, files[i])
+		}
+		ranges := planRanges(need, sf.checkpoints)
+		fetched := int64(0)
+		i := 0
+		for _, r := range ranges {
+			offset, length := safeRange(r.start, r.end)
+			if length < 0 {
+				length = info.Size() - offset
+			}
+			fetched += length
+			rc, err := dest.OpenRange("x.data", offset, length)
+			if err != nil {
+				t.Fatalf("open range: %s", err)
+			}
+			data, err := newSafeRangeReader(rc, key, r.start)
+			if err != nil {
+				t.Fatalf("new safe range reader: %s", err)
+			}
+			pos := r.start.offset
+			for _, f := range r.files {
+				if _, err := io.CopyN(ioutil.Discard, data, f.dataOffset-pos); err != nil {
+					t.Fatalf("skipping to file %d: %s", sel[i], err)
+				}
+				buf := make([]byte, f.size)
+				if _, err := io.ReadFull(data, buf); err != nil {
+					t.Fatalf("reading file %d: %s", sel[i], err)
+				}
+				if !bytes.Equal(buf, contents[sel[i]]) {
+					t.Errorf("file %d: contents differ", sel[i])
+				}
+				pos = f.dataOffset + f.size
+				i++
+			}
+			data.Close()
+		}
+		if i != len(sel) {
+			t.Errorf("ranges for %v have %d files", sel, i)
+		}
+		if fetched >= info.Size() {
+			t.Errorf("restoring files %v fetches %d bytes, not less than entire file of %d bytes", sel, fetched, info.Size())
+		}
+	}
+
+	// a data file without checkpoints is read from the start
+	ranges := planRanges(files[50:51], nil)
+	if len(ranges) != 1 || ranges[0].start != (checkpoint{}) || ranges[0].end != -1 {
+		t.Errorf("range without checkpoints, got %#v", ranges[0])
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// repoUser is an account for the repository server, as configured in the users file.
+type repoUser struct {
+	Name     string
+	Password string
+	Admin    bool // admins can delete and overwrite files, also in append-only mode
+}
+
+// repoServer serves the files in a local directory over HTTP, for the "rest"
+// destination. In append-only mode, non-admin users can only add files:
+// deleting files, creating or renaming over existing files, and renaming
+// files other than temporary ".tmp" files, are refused.
+type repoServer struct {
+	store      *local
+	users      map[string]repoUser
+	appendOnly bool
+}
+
+func serveRepo(args []string) {
+	fs := flag.NewFlagSet("serve-repo", flag.ExitOnError)
+	address := fs.String("address", "localhost:8080", "address to listen on")
+	usersPath := fs.String("users", "", "json file with users: [{\"name\": ..., \"password\": ..., \"admin\": false}, ...]")
+	appendOnly := fs.Bool("append-only", false, "only allow non-admin users to add files, not to delete or overwrite them")
+	tlsCert := fs.String("tls-cert", "", "certificate file for serving https")
+	tlsKey := fs.String("tls-key", "", "key file for serving https")
+	fs.Usage = func() {
+		log.Println("usage: bolong [flags] serve-repo [flags] directory")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 1 || *usersPath == "" || (*tlsCert == "") != (*tlsKey == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*usersPath)
+	check(err, "opening users file")
+	var users []repoUser
+	err = json.NewDecoder(f).Decode(&users)
+	check(err, "parsing users file")
+	f.Close()
+
+	dir := args[0]
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	fi, err := os.Stat(dir)
+	check(err, "repository directory")
+	if !fi.IsDir() {
+		log.Fatalf("%s is not a directory", dir)
+	}
+
+	s := &repoServer{store: &local{path: dir}, users: map[string]repoUser{}, appendOnly: *appendOnly}
+	for _, u := range users {
+		if u.Name == "" || u.Password == "" {
+			log.Fatalln("users must have a name and password")
+		}
+		if _, ok := s.users[u.Name]; ok {
+			log.Fatalf("duplicate user %q\n", u.Name)
+		}
+		s.users[u.Name] = u
+	}
+	if len(s.users) == 0 {
+		log.Fatalln("no users configured")
+	}
+
+	log.Printf("serving %s on %s, append-only %v\n", dir, *address, *appendOnly)
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(*address, *tlsCert, *tlsKey, s)
+	} else {
+		err = http.ListenAndServe(*address, s)
+	}
+	check(err, "serving")
+}
+
+// repoNameOK returns whether name can be a file in the repository, possibly in
+// a subdirectory like for chunks. Temporary files start with a dot and are not
+// accessible.
+func repoNameOK(name string) bool {
+	for _, s := range strings.Split(name, "/") {
+		if s == "" || strings.ContainsAny(s, "\\\x00") || strings.HasPrefix(s, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *repoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, _ := r.BasicAuth()
+	user, ok := s.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="bolong"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	httpError := func(err error, msg string) {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("%s: %s: %s\n", username, msg, err)
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+	// appendOnly checks if the operation is allowed, writing an error response if not.
+	appendOnly := func(op string) bool {
+		if s.appendOnly && !user.Admin {
+			http.Error(w, "repository is append-only, "+op+" requires admin", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(s.store.path + name)
+		return err == nil
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dir := strings.Trim(r.URL.Path, "/")
+		if dir != "" && !repoNameOK(dir) {
+			http.Error(w, "bad directory name", http.StatusBadRequest)
+			return
+		}
+		names, err := s.store.ListDir(dir)
+		if err != nil {
+			httpError(err, "listing files")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+		return
+	}
+
+	name := r.URL.Path[1:]
+	if !repoNameOK(name) {
+		http.Error(w, "bad file name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f, err := os.Open(s.store.path + name)
+		if err != nil {
+			httpError(err, "opening file")
+			return
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err != nil {
+			httpError(err, "stat file")
+			return
+		} else if fi.IsDir() {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		// handles range requests
+		http.ServeContent(w, r, "", time.Time{}, f)
+	case "PUT":
+		if exists(name) && !appendOnly("overwriting "+name) {
+			return
+		}
+		create := s.store.Create
+		if s.appendOnly && !user.Admin {
+			// the file may be created by another request during the upload
+			create = s.store.createNew
+		}
+		f, err := create(name)
+		if err != nil {
+			httpError(err, "creating file")
+			return
+		}
+		// a client that goes away before sending all data results in an error here, and no file
+		if _, err := io.Copy(f, r.Body); err != nil {
+			f.(*localWriter).abort()
+			log.Printf("%s: receiving %s: %s\n", username, name, err)
+			http.Error(w, "receiving data", http.StatusBadRequest)
+			return
+		}
+		if err := f.Close(); errors.Is(err, os.ErrExist) {
+			// only for non-admins in append-only mode, writes the response
+			appendOnly("overwriting " + name)
+			return
+		} else if err != nil {
+			httpError(err, "writing file")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "POST":
+		npath := r.URL.Query().Get("rename")
+		if !repoNameOK(npath) {
+			http.Error(w, "missing or bad new name for rename", http.StatusBadRequest)
+			return
+		}
+		// clients only rename temporary files into place
+		if !strings.HasSuffix(name, ".tmp") && !appendOnly("renaming "+name) {
+			return
+		}
+		rename := s.store.Rename
+		if s.appendOnly && !user.Admin {
+			rename = s.store.renameNoReplace
+		}
+		if err := rename(name, npath); errors.Is(err, os.ErrExist) {
+			// only for non-admins in append-only mode, writes the response
+			appendOnly("renaming over " + npath)
+			return
+		} else if err != nil {
+			httpError(err, "renaming file")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if !appendOnly("deleting " + name) {
+			return
+		}
+		if err := s.store.Delete(name); err != nil {
+			httpError(err, "removing file")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingReader returns data, then an error, like a client that goes away halfway an upload.
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(buf []byte) (int, error) {
+	n, err := r.data.Read(buf)
+	if err == io.EOF {
+		err = fmt.Errorf("connection reset")
+	}
+	return n, err
+}
+
+func TestRepoServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolong-repo")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &repoServer{
+		store: &local{path: dir + "/"},
+		users: map[string]repoUser{
+			"client": {"client", "secret1", false},
+			"admin":  {"admin", "secret2", true},
+		},
+		appendOnly: true,
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	base, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("parsing url: %s", err)
+	}
+	client := &rest{base, "client", "secret1"}
+	admin := &rest{base, "admin", "secret2"}
+
+	write := func(r *rest, path, data string) error {
+		w, err := r.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	status := func(err error) int {
+		var se *httpStatusError
+		if !errors.As(err, &se) {
+			return 0
+		}
+		return se.code
+	}
+
+	if err := write(client, "20171222-0001.data", "0123456789"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := write(client, "20171222-0001.index1.full.tmp", "index"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := client.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	names, err := client.List()
+	if err != nil || strings.Join(names, ",") != "20171222-0001.data,20171222-0001.index1.full" {
+		t.Errorf("list, got %v, %v", names, err)
+	}
+	rc, err := client.OpenRange("20171222-0001.data", 2, 3)
+	if err != nil {
+		t.Fatalf("open range: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "234" {
+		t.Errorf("read range, got %q, %v", buf, err)
+	}
+	if _, err := client.Open("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("open of missing file, got %v, expected not exist", err)
+	}
+
+	// clients cannot remove or replace files in an append-only repository
+	if err := client.Delete("20171222-0001.data"); status(err) != http.StatusForbidden {
+		t.Errorf("delete by client, got %v, expected forbidden", err)
+	}
+	if err := write(client, "20171222-0001.data", "overwritten"); status(err) != http.StatusForbidden {
+		t.Errorf("overwrite by client, got %v, expected forbidden", err)
+	}
+	if err := write(client, "other", "x"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := client.Rename("other", "20171222-0001.data"); status(err) != http.StatusForbidden {
+		t.Errorf("rename over existing file by client, got %v, expected forbidden", err)
+	}
+	if err := client.Rename("other", "new"); status(err) != http.StatusForbidden {
+		t.Errorf("rename of file other than temporary file by client, got %v, expected forbidden", err)
+	}
+	if err := write(client, "other.tmp", "x"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := client.Rename("other.tmp", "20171222-0001.data"); status(err) != http.StatusForbidden {
+		t.Errorf("rename of temporary file over existing file by client, got %v, expected forbidden", err)
+	}
+
+	// the checks are atomic, a file created by another request during an upload is not replaced
+	f, err := s.store.createNew("20171222-0002.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := write(client, "20171222-0002.data", "first"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := f.Write([]byte("second")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := f.Close(); !errors.Is(err, os.ErrExist) {
+		t.Errorf("close of new file over existing file, got %v, expected exist error", err)
+	}
+	if err := s.store.renameNoReplace("other.tmp", "20171222-0002.data"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("rename without replacing over existing file, got %v, expected exist error", err)
+	}
+	if buf, err := ioutil.ReadFile(dir + "/20171222-0002.data"); err != nil || string(buf) != "first" {
+		t.Errorf("new file replaced, got %q, %v", buf, err)
+	}
+	if err := client.Rename("other.tmp", "20171222-0002.index1.full"); err != nil {
+		t.Errorf("rename of temporary file by client: %s", err)
+	}
+	if buf, err := ioutil.ReadFile(dir + "/20171222-0001.data"); err != nil || string(buf) != "0123456789" {
+		t.Errorf("data file changed, got %q, %v", buf, err)
+	}
+
+	// admins can
+	if err := write(admin, "other", "y"); err != nil {
+		t.Errorf("overwrite by admin: %s", err)
+	}
+	if err := admin.Rename("other", "20171222-0001.data"); err != nil {
+		t.Errorf("rename over existing file by admin: %s", err)
+	}
+	if err := admin.Delete("20171222-0001.data"); err != nil {
+		t.Errorf("delete by admin: %s", err)
+	}
+	for _, name := range []string{"20171222-0002.data", "20171222-0002.index1.full"} {
+		if err := admin.Delete(name); err != nil {
+			t.Errorf("delete by admin: %s", err)
+		}
+	}
+
+	// no access with bad credentials, no access to temporary files
+	if _, err := (&rest{base, "admin", "bad"}).List(); status(err) != http.StatusUnauthorized {
+		t.Errorf("list with bad password, got %v, expected unauthorized", err)
+	}
+	if _, err := admin.Open(".tmp-x"); status(err) != http.StatusBadRequest {
+		t.Errorf("open of temporary file, got %v, expected bad request", err)
+	}
+
+	// interrupted uploads don't leave files behind
+	req := httptest.NewRequest("PUT", "/partial", &failingReader{strings.NewReader("partial data")})
+	req.SetBasicAuth("client", "secret1")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("interrupted upload, got status %d, expected bad request", rec.Code)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 || files[0].Name() != "20171222-0001.index1.full" {
+		t.Errorf("unexpected files after interrupted upload, %v, %v", files, err)
+	}
+
+	testDestinationDir(t, admin)
+}
+
+// TestRepoServerBackups runs the backup tests against the repository server.
+func TestRepoServerBackups(t *testing.T) {
+	repo := &repoServer{
+		store: &local{path: "testdir/backup/"},
+		users: map[string]repoUser{"client": {"client", "secret", false}},
+	}
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	setMain := func(c *configuration) {
+		c.Kind = "rest"
+		c.Rest.URL = server.URL + "/"
+		c.Rest.User = "client"
+		c.Rest.Password = "secret"
+		c.Retries = -1 // the removed repository directory is not temporary
+	}
+	removeMain := func() {
+		err := os.RemoveAll("testdir/backup")
+		if err != nil {
+			t.Errorf("removing tree: %s", err)
+		}
+	}
+	testBackups(t, setMain, removeMain)
+}
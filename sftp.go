@@ -0,0 +1,714 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftp is a destination that stores files on an ssh server, using the sftp subsystem (protocol version 3).
+// A single ssh connection is made on first use, and reused for all operations.
+// If the connection breaks, a new connection is made for the next operation.
+type sftp struct {
+	address string // host:port
+	config  *ssh.ClientConfig
+	path    string // remote directory, ends with slash
+
+	sync.Mutex
+	conn *sftpConn
+}
+
+var _ destination = &sftp{}
+
+// newSftp returns an sftp destination authenticating with a private key, verifying the host key against a known_hosts file.
+func newSftp(address, user, keyFile, keyPassphrase, knownHostsFile, path string) (*sftp, error) {
+	home := os.Getenv("HOME")
+	if keyFile == "" {
+		keyFile = home + "/.ssh/id_rsa"
+	}
+	if knownHostsFile == "" {
+		knownHostsFile = home + "/.ssh/known_hosts"
+	}
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %s", err)
+	}
+	var signer ssh.Signer
+	if keyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(keyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key %s: %s", keyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %s", err)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}
+	return &sftp{address: sftpAddress(address), config: config, path: path}, nil
+}
+
+// sftp packet types and flags, see draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpRead          = 5
+	sshFxpWrite         = 6
+	sshFxpOpendir       = 11
+	sshFxpReaddir       = 12
+	sshFxpRemove        = 13
+	sshFxpMkdir         = 14
+	sshFxpRename        = 18
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpData          = 103
+	sshFxpName          = 104
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxOK                    = 0
+	sshFxEOF                   = 1
+	sshFxNoSuchFile            = 2
+	sshFxNoConnection          = 6
+	sshFxConnectionLost        = 7
+	sshFxfRead                 = 0x01
+	sshFxfWrite                = 0x02
+	sshFxfCreat                = 0x08
+	sshFxfTrunc                = 0x10
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrUIDGID      = 0x02
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+	sshFileXferAttrExtended    = 0x80000000
+
+	sftpChunkSize  = 32 * 1024 // max data size in read/write requests that all servers accept
+	sftpMaxPending = 64        // max read or write requests in flight per file
+)
+
+// sftpStatusError is an error returned by the sftp server in a status response.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.code, e.msg)
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) work for missing files.
+func (e *sftpStatusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.code == sshFxNoSuchFile
+}
+
+// temporary returns whether the request may succeed when retried.
+// Only for lost connections, other errors like permission denied are permanent.
+func (e *sftpStatusError) temporary() bool {
+	return e.code == sshFxNoConnection || e.code == sshFxConnectionLost
+}
+
+// sftpBuf builds and parses sftp packets.
+type sftpBuf struct {
+	buf []byte
+	err error
+}
+
+func (b *sftpBuf) byte(v byte) *sftpBuf {
+	b.buf = append(b.buf, v)
+	return b
+}
+
+func (b *sftpBuf) uint32(v uint32) *sftpBuf {
+	b.buf = append(b.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	return b
+}
+
+func (b *sftpBuf) uint64(v uint64) *sftpBuf {
+	return b.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+
+func (b *sftpBuf) string(s string) *sftpBuf {
+	b.uint32(uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	return b
+}
+
+var errSftpShortPacket = errors.New("sftp: short packet")
+
+func (b *sftpBuf) getUint32() uint32 {
+	if len(b.buf) < 4 {
+		b.err = errSftpShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.buf)
+	b.buf = b.buf[4:]
+	return v
+}
+
+func (b *sftpBuf) getUint64() uint64 {
+	return uint64(b.getUint32())<<32 | uint64(b.getUint32())
+}
+
+func (b *sftpBuf) getString() string {
+	n := b.getUint32()
+	if uint32(len(b.buf)) < n {
+		b.err = errSftpShortPacket
+		return ""
+	}
+	s := string(b.buf[:n])
+	b.buf = b.buf[n:]
+	return s
+}
+
+// getAttrs parses file attributes, returning the flags and permissions.
+func (b *sftpBuf) getAttrs() (flags, permissions uint32) {
+	flags = b.getUint32()
+	if flags&sshFileXferAttrSize != 0 {
+		b.getUint64()
+	}
+	if flags&sshFileXferAttrUIDGID != 0 {
+		b.getUint32()
+		b.getUint32()
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		permissions = b.getUint32()
+	}
+	if flags&sshFileXferAttrACModTime != 0 {
+		b.getUint32()
+		b.getUint32()
+	}
+	if flags&sshFileXferAttrExtended != 0 {
+		n := b.getUint32()
+		for i := uint32(0); i < n && b.err == nil; i++ {
+			b.getString()
+			b.getString()
+		}
+	}
+	return
+}
+
+type sftpPacket struct {
+	typ  byte
+	data *sftpBuf // after the request id
+}
+
+// sftpConn is an ssh connection with an sftp session. Requests can be made concurrently.
+type sftpConn struct {
+	client     *ssh.Client
+	w          io.WriteCloser
+	extensions map[string]string
+
+	sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error // once set, the connection is broken
+}
+
+func (r *sftp) connection() (*sftpConn, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.conn != nil {
+		r.conn.Lock()
+		err := r.conn.err
+		r.conn.Unlock()
+		if err == nil {
+			return r.conn, nil
+		}
+		r.conn.client.Close()
+		r.conn = nil
+	}
+	c, err := dialSftp(r.address, r.config)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = c
+	return c, nil
+}
+
+func dialSftp(address string, config *ssh.ClientConfig) (*sftpConn, error) {
+	client, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return nil, fmt.Errorf("ssh connection: %s", err)
+	}
+	c, err := newSftpConn(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newSftpConn(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("ssh session: %s", err)
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ssh session stdin: %s", err)
+	}
+	rd, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ssh session stdout: %s", err)
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		return nil, fmt.Errorf("starting sftp subsystem: %s", err)
+	}
+	c := &sftpConn{client: client, w: w, extensions: map[string]string{}, pending: map[uint32]chan sftpPacket{}}
+
+	// version negotiation, the only packets without request id
+	b := &sftpBuf{}
+	b.uint32(5).byte(sshFxpInit).uint32(3)
+	_, err = w.Write(b.buf)
+	if err != nil {
+		return nil, fmt.Errorf("sending sftp init: %s", err)
+	}
+	typ, buf, err := readSftpPacket(rd)
+	if err != nil {
+		return nil, fmt.Errorf("reading sftp version: %s", err)
+	}
+	b = &sftpBuf{buf: buf}
+	version := b.getUint32()
+	if typ != sshFxpVersion || b.err != nil || version != 3 {
+		return nil, fmt.Errorf("sftp: unsupported server version")
+	}
+	for len(b.buf) > 0 && b.err == nil {
+		name := b.getString()
+		c.extensions[name] = b.getString()
+	}
+
+	go c.reader(rd)
+	return c, nil
+}
+
+func readSftpPacket(r io.Reader) (typ byte, buf []byte, err error) {
+	var hdr [5]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1024*1024 {
+		return 0, nil, fmt.Errorf("sftp: bad packet size %d", n)
+	}
+	buf = make([]byte, n-1)
+	_, err = io.ReadFull(r, buf)
+	return hdr[4], buf, err
+}
+
+// reader dispatches responses to waiting requests until the connection fails.
+func (c *sftpConn) reader(r io.Reader) {
+	for {
+		typ, buf, err := readSftpPacket(r)
+		var id uint32
+		if err == nil && len(buf) < 4 {
+			err = errSftpShortPacket
+		} else if err == nil {
+			id = binary.BigEndian.Uint32(buf)
+		}
+		c.Lock()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("sftp: connection closed")
+			}
+			c.err = err
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.Unlock()
+			c.client.Close()
+			return
+		}
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.Unlock()
+		if ok {
+			ch <- sftpPacket{typ, &sftpBuf{buf: buf[4:]}}
+		}
+	}
+}
+
+// send sends a request, and returns a channel on which the response will be delivered.
+// If the connection breaks, the channel is closed.
+func (c *sftpConn) send(typ byte, payload *sftpBuf) (chan sftpPacket, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	b := &sftpBuf{buf: make([]byte, 0, 9+len(payload.buf))}
+	b.uint32(uint32(5 + len(payload.buf))).byte(typ).uint32(id)
+	b.buf = append(b.buf, payload.buf...)
+	ch := make(chan sftpPacket, 1)
+	c.pending[id] = ch
+	_, err := c.w.Write(b.buf)
+	if err != nil {
+		delete(c.pending, id)
+		c.err = err
+		return nil, err
+	}
+	return ch, nil
+}
+
+// wait returns the response delivered on ch, or the connection error.
+func (c *sftpConn) wait(ch chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-ch
+	if !ok {
+		c.Lock()
+		defer c.Unlock()
+		return p, c.err
+	}
+	return p, nil
+}
+
+func (c *sftpConn) call(typ byte, payload *sftpBuf) (sftpPacket, error) {
+	ch, err := c.send(typ, payload)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ch)
+}
+
+// status turns a response into an error. Responses that are not a status packet are an error, unless of type okType.
+func (p sftpPacket) status(okType byte) error {
+	if p.typ == okType && okType != sshFxpStatus {
+		return nil
+	}
+	if p.typ != sshFxpStatus {
+		return fmt.Errorf("sftp: unexpected response type %d", p.typ)
+	}
+	code := p.data.getUint32()
+	msg := p.data.getString()
+	if p.data.err != nil {
+		return p.data.err
+	}
+	if code == sshFxOK {
+		return nil
+	}
+	return &sftpStatusError{code, msg}
+}
+
+// callStatus makes a request for which only a status response is expected.
+func (c *sftpConn) callStatus(typ byte, payload *sftpBuf) error {
+	p, err := c.call(typ, payload)
+	if err != nil {
+		return err
+	}
+	return p.status(sshFxpStatus)
+}
+
+func (c *sftpConn) open(path string, flags uint32) (handle string, err error) {
+	p, err := c.call(sshFxpOpen, (&sftpBuf{}).string(path).uint32(flags).uint32(0))
+	if err == nil {
+		err = p.status(sshFxpHandle)
+	}
+	if err != nil {
+		return "", err
+	}
+	handle = p.data.getString()
+	return handle, p.data.err
+}
+
+func (c *sftpConn) close(handle string) error {
+	return c.callStatus(sshFxpClose, (&sftpBuf{}).string(handle))
+}
+
+// List returns the names of regular files in the remote directory, sorted by name.
+func (r *sftp) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *sftp) ListDir(dir string) (names []string, err error) {
+	c, err := r.connection()
+	if err != nil {
+		return nil, err
+	}
+	path := r.path
+	if dir != "" {
+		path += dir + "/"
+	}
+	p, err := c.call(sshFxpOpendir, (&sftpBuf{}).string(path))
+	if err == nil {
+		err = p.status(sshFxpHandle)
+	}
+	if dir != "" && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening directory %s: %w", path, err)
+	}
+	handle := p.data.getString()
+	defer func() {
+		err2 := c.close(handle)
+		if err == nil && err2 != nil {
+			err = fmt.Errorf("closing directory: %s", err2)
+		}
+	}()
+
+	for {
+		p, err := c.call(sshFxpReaddir, (&sftpBuf{}).string(handle))
+		if err == nil {
+			err = p.status(sshFxpName)
+		}
+		if se, ok := err.(*sftpStatusError); ok && se.code == sshFxEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading directory %s: %w", path, err)
+		}
+		n := p.data.getUint32()
+		for i := uint32(0); i < n && p.data.err == nil; i++ {
+			name := p.data.getString()
+			p.data.getString() // long name, as from ls -l
+			flags, permissions := p.data.getAttrs()
+			if name == "." || name == ".." || (flags&sshFileXferAttrPermissions != 0 && permissions&0170000 != 0100000) {
+				continue
+			}
+			names = append(names, name)
+		}
+		if p.data.err != nil {
+			return nil, fmt.Errorf("parsing directory listing: %s", p.data.err)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type sftpReadRequest struct {
+	ch     chan sftpPacket
+	offset int64
+	size   int
+}
+
+// sftpReader reads a file, with multiple read requests in flight.
+type sftpReader struct {
+	c       *sftpConn
+	handle  string
+	offset  int64 // offset for next read request
+	end     int64 // offset to stop reading at, -1 for end of file
+	pending []sftpReadRequest
+	buf     []byte // data received but not yet read
+	err     error
+}
+
+func (r *sftp) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *sftp) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	c, err := r.connection()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(r.path+path, sshFxfRead)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	end := int64(-1)
+	if length >= 0 {
+		end = offset + length
+	}
+	return &sftpReader{c: c, handle: handle, offset: offset, end: end}, nil
+}
+
+func (r *sftpReader) Read(buf []byte) (int, error) {
+	for len(r.buf) == 0 && r.err == nil {
+		r.fill()
+	}
+	if len(r.buf) == 0 {
+		return 0, r.err
+	}
+	n := copy(buf, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill waits for the first pending read request, sending new requests as needed.
+func (r *sftpReader) fill() {
+	for len(r.pending) < sftpMaxPending && (r.end < 0 || r.offset < r.end) {
+		size := int64(sftpChunkSize)
+		if r.end >= 0 && r.end-r.offset < size {
+			size = r.end - r.offset
+		}
+		ch, err := r.c.send(sshFxpRead, (&sftpBuf{}).string(r.handle).uint64(uint64(r.offset)).uint32(uint32(size)))
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.pending = append(r.pending, sftpReadRequest{ch, r.offset, int(size)})
+		r.offset += size
+	}
+	if len(r.pending) == 0 {
+		r.err = io.EOF
+		return
+	}
+
+	req := r.pending[0]
+	r.pending = r.pending[1:]
+	p, err := r.c.wait(req.ch)
+	if err == nil {
+		err = p.status(sshFxpData)
+	}
+	if se, ok := err.(*sftpStatusError); ok && se.code == sshFxEOF {
+		r.err = io.EOF
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.buf = []byte(p.data.getString())
+	if p.data.err != nil {
+		r.err = p.data.err
+		return
+	}
+	if len(r.buf) < req.size {
+		// short read, we can't use the responses to requests already in flight.
+		// responses are still delivered to their (buffered) channels, and ignored.
+		r.pending = nil
+		r.offset = req.offset + int64(len(r.buf))
+	}
+}
+
+func (r *sftpReader) Close() error {
+	r.pending = nil
+	if r.err == nil {
+		r.err = fmt.Errorf("read on closed file")
+	}
+	return r.c.close(r.handle)
+}
+
+// sftpWriter writes a file, with multiple write requests in flight.
+type sftpWriter struct {
+	c       *sftpConn
+	handle  string
+	offset  int64
+	pending []chan sftpPacket
+	err     error
+}
+
+func (r *sftp) Create(path string) (w io.WriteCloser, err error) {
+	c, err := r.connection()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(r.path+path, sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	if i := strings.LastIndex(path, "/"); i >= 0 && errors.Is(err, os.ErrNotExist) {
+		// first file in a subdirectory, e.g. for chunks. the mkdir fails if
+		// another write just created the directory, the open tells.
+		c.callStatus(sshFxpMkdir, (&sftpBuf{}).string(r.path+path[:i]).uint32(0))
+		handle, err = c.open(r.path+path, sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", path, err)
+	}
+	return &sftpWriter{c: c, handle: handle}, nil
+}
+
+func (w *sftpWriter) waitOne() {
+	ch := w.pending[0]
+	w.pending = w.pending[1:]
+	p, err := w.c.wait(ch)
+	if err == nil {
+		err = p.status(sshFxpStatus)
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *sftpWriter) Write(buf []byte) (int, error) {
+	n := 0
+	for len(buf) > 0 && w.err == nil {
+		if len(w.pending) >= sftpMaxPending {
+			w.waitOne()
+			continue
+		}
+		size := len(buf)
+		if size > sftpChunkSize {
+			size = sftpChunkSize
+		}
+		ch, err := w.c.send(sshFxpWrite, (&sftpBuf{}).string(w.handle).uint64(uint64(w.offset)).string(string(buf[:size])))
+		if err != nil {
+			w.err = err
+			break
+		}
+		w.pending = append(w.pending, ch)
+		w.offset += int64(size)
+		buf = buf[size:]
+		n += size
+	}
+	return n, w.err
+}
+
+func (w *sftpWriter) Close() error {
+	for len(w.pending) > 0 {
+		w.waitOne()
+	}
+	err := w.c.close(w.handle)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = fmt.Errorf("write on closed file")
+	return err
+}
+
+// Rename renames a file, replacing an existing file.
+// If the server supports the posix-rename extension, it is used. Plain sftp renames fail when the destination exists.
+func (r *sftp) Rename(opath, npath string) (err error) {
+	c, err := r.connection()
+	if err != nil {
+		return err
+	}
+	if _, ok := c.extensions["posix-rename@openssh.com"]; ok {
+		p, err := c.call(sshFxpExtended, (&sftpBuf{}).string("posix-rename@openssh.com").string(r.path+opath).string(r.path+npath))
+		if err == nil {
+			err = p.status(sshFxpStatus)
+		}
+		return err
+	}
+	return c.callStatus(sshFxpRename, (&sftpBuf{}).string(r.path+opath).string(r.path+npath))
+}
+
+func (r *sftp) Delete(path string) (err error) {
+	c, err := r.connection()
+	if err != nil {
+		return err
+	}
+	err = c.callStatus(sshFxpRemove, (&sftpBuf{}).string(r.path+path))
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return nil
+}
+
+// sftpAddress adds the default ssh port to address if it has none.
+func sftpAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, "22")
+	}
+	return address
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTestServer serves the sftp subsystem for files in dir, over ssh connections accepted on l.
+type sftpTestServer struct {
+	dir         string
+	config      *ssh.ServerConfig
+	posixRename bool // whether to advertise the posix-rename extension
+	maxRead     int  // reads return at most this many bytes, to exercise short reads
+}
+
+func (s *sftpTestServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				if nc.ChannelType() != "session" {
+					nc.Reject(ssh.UnknownChannelType, "session only")
+					continue
+				}
+				ch, reqs, err := nc.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					for req := range reqs {
+						ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+						req.Reply(ok, nil)
+						if ok {
+							go s.sftp(ch)
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func (s *sftpTestServer) sftp(ch ssh.Channel) {
+	defer ch.Close()
+
+	files := map[string]*os.File{}
+	dirs := map[string][]os.FileInfo{}
+	nextHandle := 0
+
+	reply := func(typ byte, b *sftpBuf) {
+		hdr := &sftpBuf{}
+		hdr.uint32(uint32(1 + len(b.buf))).byte(typ)
+		ch.Write(append(hdr.buf, b.buf...))
+	}
+	status := func(id uint32, err error) {
+		code := uint32(sshFxOK)
+		msg := ""
+		if os.IsNotExist(err) {
+			code = sshFxNoSuchFile
+		} else if err == io.EOF {
+			code = sshFxEOF
+		} else if err != nil {
+			code = 4 // failure
+		}
+		if err != nil {
+			msg = err.Error()
+		}
+		reply(sshFxpStatus, (&sftpBuf{}).uint32(id).uint32(code).string(msg).string(""))
+	}
+	handle := func(id uint32) string {
+		nextHandle++
+		h := string(rune('a' + nextHandle))
+		reply(sshFxpHandle, (&sftpBuf{}).uint32(id).string(h))
+		return h
+	}
+
+	for {
+		typ, buf, err := readSftpPacket(ch)
+		if err != nil {
+			return
+		}
+		b := &sftpBuf{buf: buf}
+		if typ == sshFxpInit {
+			v := (&sftpBuf{}).uint32(3)
+			if s.posixRename {
+				v.string("posix-rename@openssh.com").string("1")
+			}
+			reply(sshFxpVersion, v)
+			continue
+		}
+		id := b.getUint32()
+		switch typ {
+		case sshFxpOpen:
+			path := s.dir + b.getString()
+			flags := b.getUint32()
+			var f *os.File
+			if flags&sshFxfWrite != 0 {
+				f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			} else {
+				f, err = os.Open(path)
+			}
+			if err != nil {
+				status(id, err)
+			} else {
+				files[handle(id)] = f
+			}
+		case sshFxpClose:
+			h := b.getString()
+			if f, ok := files[h]; ok {
+				err = f.Close()
+				delete(files, h)
+			}
+			delete(dirs, h)
+			status(id, err)
+		case sshFxpRead:
+			f := files[b.getString()]
+			offset := b.getUint64()
+			n := int(b.getUint32())
+			if n > s.maxRead {
+				n = s.maxRead
+			}
+			data := make([]byte, n)
+			n, err = f.ReadAt(data, int64(offset))
+			if n == 0 {
+				status(id, err)
+			} else {
+				reply(sshFxpData, (&sftpBuf{}).uint32(id).string(string(data[:n])))
+			}
+		case sshFxpWrite:
+			f := files[b.getString()]
+			offset := b.getUint64()
+			_, err = f.WriteAt([]byte(b.getString()), int64(offset))
+			status(id, err)
+		case sshFxpOpendir:
+			l, err := ioutil.ReadDir(s.dir + b.getString())
+			if err != nil {
+				status(id, err)
+			} else {
+				dirs[handle(id)] = l
+			}
+		case sshFxpReaddir:
+			h := b.getString()
+			l := dirs[h]
+			if len(l) == 0 {
+				status(id, io.EOF)
+				continue
+			}
+			dirs[h] = nil
+			nb := (&sftpBuf{}).uint32(id).uint32(uint32(2 + len(l)))
+			nb.string(".").string(".").uint32(sshFileXferAttrPermissions).uint32(040755)
+			nb.string("..").string("..").uint32(0)
+			for _, fi := range l {
+				mode := uint32(0100000)
+				if fi.IsDir() {
+					mode = 040000
+				}
+				nb.string(fi.Name()).string("-rw-r--r-- " + fi.Name()).uint32(sshFileXferAttrSize | sshFileXferAttrPermissions).uint64(uint64(fi.Size())).uint32(mode | 0644)
+			}
+			reply(sshFxpName, nb)
+		case sshFxpRemove:
+			status(id, os.Remove(s.dir+b.getString()))
+		case sshFxpMkdir:
+			status(id, os.Mkdir(s.dir+b.getString(), 0777))
+		case sshFxpRename:
+			opath, npath := s.dir+b.getString(), s.dir+b.getString()
+			if _, err := os.Stat(npath); err == nil {
+				status(id, os.ErrExist)
+				continue
+			}
+			status(id, os.Rename(opath, npath))
+		case sshFxpExtended:
+			if b.getString() != "posix-rename@openssh.com" || !s.posixRename {
+				status(id, os.ErrInvalid)
+				continue
+			}
+			status(id, os.Rename(s.dir+b.getString(), s.dir+b.getString()))
+		default:
+			status(id, os.ErrInvalid)
+		}
+	}
+}
+
+func TestSftp(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bolong-sftp")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp+"/remote/backups/nested", 0777); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	newKey := func() (*ecdsa.PrivateKey, ssh.Signer) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating key: %s", err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("signer: %s", err)
+		}
+		return key, signer
+	}
+	_, hostSigner := newKey()
+	_, otherHostSigner := newKey()
+	clientKey, clientSigner := newKey()
+
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("marshal key: %s", err)
+	}
+	keyFile := tmp + "/id_ecdsa"
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+	server := &sftpTestServer{dir: tmp + "/remote/", config: config, posixRename: true, maxRead: 10000}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go server.serve(l)
+	addr := l.Addr().String()
+
+	writeKnownHosts := func(key ssh.PublicKey) {
+		t.Helper()
+		err := ioutil.WriteFile(tmp+"/known_hosts", []byte(knownhosts.Line([]string{addr}, key)+"\n"), 0600)
+		if err != nil {
+			t.Fatalf("writing known_hosts: %s", err)
+		}
+	}
+
+	// unknown host key must be rejected
+	writeKnownHosts(otherHostSigner.PublicKey())
+	r, err := newSftp(addr, "backup", keyFile, "", tmp+"/known_hosts", "backups")
+	if err != nil {
+		t.Fatalf("new sftp: %s", err)
+	}
+	if _, err := r.List(); err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Fatalf("expected host key mismatch error, got %v", err)
+	}
+
+	writeKnownHosts(hostSigner.PublicKey())
+	r, err = newSftp(addr, "backup", keyFile, "", tmp+"/known_hosts", "backups")
+	if err != nil {
+		t.Fatalf("new sftp: %s", err)
+	}
+
+	data := make([]byte, 300*1024+123)
+	rand.Read(data)
+	w, err := r.Create("20171222-0001.data")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if buf, err := ioutil.ReadFile(tmp + "/remote/backups/20171222-0001.data"); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("file at server does not match, err %v", err)
+	}
+
+	rc, err := r.Open("20171222-0001.data")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read does not match, err %v, got %d bytes, expected %d", err, len(buf), len(data))
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	for _, name := range []string{"20171222-0001.index1.full.tmp", "20171222-0002.index1.full"} {
+		w, err := r.Create(name)
+		if err == nil {
+			_, err = w.Write([]byte(name))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+	}
+	names, err := r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	exp := "20171222-0001.data,20171222-0001.index1.full.tmp,20171222-0002.index1.full"
+	if strings.Join(names, ",") != exp {
+		t.Errorf("list, got %v, expected %s", names, exp)
+	}
+
+	if err := r.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if err := r.Delete("20171222-0001.data"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := r.Delete("20171222-0001.data"); err == nil {
+		t.Fatalf("delete of missing file succeeded")
+	}
+
+	// without posix-rename, renaming over an existing file fails
+	server.posixRename = false
+	r.conn.client.Close()
+	r.conn = nil
+	if err := r.Rename("20171222-0001.index1.full", "20171222-0002.index1.full"); err == nil {
+		t.Fatalf("plain rename over existing file succeeded")
+	}
+	names, err = r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	exp = "20171222-0001.index1.full,20171222-0002.index1.full"
+	if strings.Join(names, ",") != exp {
+		t.Errorf("list, got %v, expected %s", names, exp)
+	}
+
+	server.posixRename = true
+	testDestinationDir(t, r)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheTagSignature starts a CACHEDIR.TAG file, see https://bford.info/cachedir/.
+const cacheTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// cacheDir returns whether directory path is a cache directory, with a valid CACHEDIR.TAG file.
+func cacheDir(path string) (bool, error) {
+	f, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, len(cacheTagSignature))
+	if _, err := io.ReadFull(f, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, []byte(cacheTagSignature)), nil
+}
+
+// fileKinds are the kinds of files that can be excluded with config field
+// "excludeKinds", by their extension.
+var fileKinds = map[string][]string{
+	"video":     {".avi", ".flv", ".m4v", ".mkv", ".mov", ".mp4", ".mpeg", ".mpg", ".webm", ".wmv"},
+	"audio":     {".aac", ".flac", ".m4a", ".mp3", ".ogg", ".opus", ".wav", ".wma"},
+	"image":     {".bmp", ".cr2", ".gif", ".heic", ".jpeg", ".jpg", ".nef", ".png", ".tif", ".tiff", ".webp"},
+	"archive":   {".7z", ".bz2", ".gz", ".rar", ".tar", ".tgz", ".xz", ".zip", ".zst"},
+	"diskimage": {".img", ".iso", ".qcow2", ".vdi", ".vhd", ".vhdx", ".vmdk"},
+	"object":    {".a", ".class", ".o", ".pyc", ".so"},
+}
+
+// excludeExtensions returns the lower case file extensions for kinds, which
+// are names from fileKinds, or extensions starting with a dot.
+func excludeExtensions(kinds []string) map[string]struct{} {
+	exts := map[string]struct{}{}
+	for _, k := range kinds {
+		if strings.HasPrefix(k, ".") {
+			exts[strings.ToLower(k)] = struct{}{}
+			continue
+		}
+		for _, ext := range fileKinds[k] {
+			exts[ext] = struct{}{}
+		}
+	}
+	return exts
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSkip(t *testing.T) {
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{
+		"cache/CACHEDIR.TAG":    cacheTagSignature + "\n# This file is a cache directory tag.\n",
+		"cache/sub/data":        "cached",
+		"notcache/CACHEDIR.TAG": "Signature: something else\n",
+		"notcache/data":         "",
+		"large":                 strings.Repeat("x", 1024*1024+1),
+		"small":                 strings.Repeat("x", 1024*1024),
+		"movie.MKV":             "",
+		"disk.iso":              "",
+		"notes.txt":             "",
+	})
+	setupTestConfig(t, configuration{
+		ExcludeCaches: true,
+		MaxFileSize:   1,
+		ExcludeKinds:  []string{"video", ".ISO"},
+	})
+
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	exp := ". cache notcache notcache/CACHEDIR.TAG notcache/data notes.txt small"
+	if got := latestNames(t); got != exp {
+		t.Errorf("backed up %q, expected %q", got, exp)
+	}
+}
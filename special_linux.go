@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceNumbers returns the major and minor number of a device file.
+func deviceNumbers(fi os.FileInfo) (major, minor uint64) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(stat.Rdev)
+	major = (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor = dev&0xff | (dev>>12)&^0xff
+	return
+}
+
+// makeSpecial creates a FIFO, socket or device file for f at path.
+func makeSpecial(path string, f *file) error {
+	var mode uint32
+	switch f.special {
+	case os.ModeNamedPipe:
+		mode = syscall.S_IFIFO
+	case os.ModeSocket:
+		mode = syscall.S_IFSOCK
+	case os.ModeDevice:
+		mode = syscall.S_IFBLK
+	case os.ModeDevice | os.ModeCharDevice:
+		mode = syscall.S_IFCHR
+	}
+	dev := f.minor&0xff | (f.major&0xfff)<<8 | (f.minor&^0xff)<<12 | (f.major&^0xfff)<<32
+	err := syscall.Mknod(path, mode|uint32(f.permissions), int(dev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
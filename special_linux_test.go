@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	// special returns the special files in the latest backup
+	special := func() map[string]*file {
+		t.Helper()
+		l := map[string]*file{}
+		for _, f := range latestIndex(t).contents {
+			if f.special != 0 {
+				l[f.name] = f
+			}
+		}
+		return l
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"file": "data"})
+	tcheck(t, syscall.Mkfifo("testdir/workdir/fifo", 0640), "making fifo")
+	tcheck(t, os.Chmod("testdir/workdir/fifo", 0640), "chmod fifo")
+	setupTestConfig(t, configuration{IncrementalsPerFull: 2})
+
+	// the fifo is not opened, which would block
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	l := special()
+	if f, ok := l["fifo"]; !ok || len(l) != 1 || f.special != os.ModeNamedPipe || f.dataOffset != -1 || f.specialKind() != "p" {
+		t.Fatalf("special files in backup, got %v", l)
+	}
+	backupCmd([]string{"testdir/workdir"}, "20171222-0002")
+	if l := special(); len(l) != 1 || l["fifo"] == nil || l["fifo"].dataOffset != -1 {
+		t.Errorf("unchanged fifo in incremental backup, got %v", l)
+	}
+
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	fi, err := os.Lstat("testdir/restore/fifo")
+	tcheck(t, err, "stat restored fifo")
+	if fi.Mode() != os.ModeNamedPipe|0640 {
+		t.Errorf("restored fifo has mode %v", fi.Mode())
+	}
+
+	// devices can only be made by root, and not in all containers
+	nf := &file{special: os.ModeDevice | os.ModeCharDevice, permissions: 0666, major: 1, minor: 3}
+	err = makeSpecial("testdir/null", nf)
+	if os.IsPermission(err) {
+		t.Skip("no permission to make devices")
+	}
+	tcheck(t, err, "making device")
+	fi, err = os.Lstat("testdir/null")
+	tcheck(t, err, "stat device")
+	if major, minor := deviceNumbers(fi); fi.Mode()&os.ModeCharDevice == 0 || major != 1 || minor != 3 {
+		t.Errorf("made device with mode %v, numbers %d, %d", fi.Mode(), major, minor)
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// deviceNumbers returns zeroes, device numbers are only stored on Linux.
+func deviceNumbers(fi os.FileInfo) (major, minor uint64) {
+	return 0, 0
+}
+
+func makeSpecial(path string, f *file) error {
+	return errors.New("creating special files not supported on this system")
+}
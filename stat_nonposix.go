@@ -9,3 +9,13 @@ import (
 func userGroupName(fi os.FileInfo) (string, string) {
 	return "u", "g"
 }
+
+// hardLinkID returns false, hard links are not detected on these systems.
+func hardLinkID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// fileDevice returns false, devices are not known on these systems.
+func fileDevice(fi os.FileInfo) (dev uint64, ok bool) {
+	return 0, false
+}
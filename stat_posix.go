@@ -27,3 +27,21 @@ func userGroupName(fi os.FileInfo) (string, string) {
 	}
 	return owner, group
 }
+
+// hardLinkID returns the device and inode of a regular file with multiple hard links, and whether it has them.
+func hardLinkID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || stat.Nlink <= 1 {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// fileDevice returns the device the file is on.
+func fileDevice(fi os.FileInfo) (dev uint64, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
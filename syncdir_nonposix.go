@@ -0,0 +1,8 @@
+// +build windows plan9
+
+package main
+
+// syncDir is a no-op, directories cannot be synced on these systems.
+func syncDir(dir string) error {
+	return nil
+}
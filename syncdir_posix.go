@@ -0,0 +1,21 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+)
+
+// syncDir flushes the directory entries of dir to stable storage, e.g. after a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	err2 := d.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
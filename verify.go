@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// verify checks that the files needed for restoring each backup are present:
+// the index file, the data files it references and its chunks. With -read,
+// chunks are also read and their contents checked. Done for each mirror.
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	read := fs.Bool("read", false, "read all referenced chunks, verifying their contents")
+	verbose := fs.Bool("verbose", false, "print each missing chunk")
+	fs.Usage = func() {
+		log.Println("usage: bolong [flags] verify [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ok := true
+	if len(mirrors) == 1 {
+		ok = verifyMirror(&mirror{name: "", store: store}, *read, *verbose)
+	} else {
+		for _, m := range mirrors {
+			if !verifyMirror(m, *read, *verbose) {
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// verifyMirror verifies the backups on m, returning whether all is well.
+func verifyMirror(m *mirror, read, verbose bool) bool {
+	prefix := ""
+	if m.name != "" {
+		prefix = "mirror " + m.name + ": "
+	}
+	names, err := m.store.List()
+	if err != nil {
+		log.Printf("%slisting files: %s\n", prefix, err)
+		return false
+	}
+	present := map[string]struct{}{}
+	for _, name := range names {
+		present[name] = struct{}{}
+	}
+	chunkNames, err := m.store.ListDir(chunkDir)
+	if err != nil {
+		log.Printf("%slisting chunks: %s\n", prefix, err)
+		return false
+	}
+	nchunks := 0
+	for _, name := range chunkNames {
+		if isChunk(name) {
+			present[chunkDir+"/"+name] = struct{}{}
+			nchunks++
+		}
+	}
+	backups, err := listDestinationBackups(m.store)
+	if err != nil {
+		log.Printf("%s%s\n", prefix, err)
+		return false
+	}
+
+	problems := 0
+	refs := map[string]int{}
+	chunks := map[string]chunkRef{} // referenced and present
+	for _, b := range backups {
+		idx, err := readDestinationIndex(m.store, b)
+		if err != nil {
+			log.Printf("%sbackup %s: %s\n", prefix, b.name, err)
+			problems++
+			continue
+		}
+		dataFiles := []string{b.name + ".data"}
+		for _, p := range idx.previous {
+			dataFiles = append(dataFiles, p.name+".data")
+		}
+		for _, path := range dataFiles {
+			if _, ok := present[path]; !ok {
+				log.Printf("%sbackup %s: missing data file %s\n", prefix, b.name, path)
+				problems++
+			}
+		}
+		missing := map[string]struct{}{}
+		for _, f := range idx.contents {
+			for _, c := range f.chunks {
+				refs[c.name()]++
+				if _, ok := present[c.name()]; ok {
+					chunks[c.name()] = c
+				} else if _, ok := missing[c.name()]; !ok {
+					missing[c.name()] = struct{}{}
+					if verbose {
+						log.Printf("%sbackup %s: missing chunk %s of %s\n", prefix, b.name, c.name(), f.name)
+					}
+				}
+			}
+		}
+		if len(missing) > 0 {
+			log.Printf("%sbackup %s: %d missing chunks\n", prefix, b.name, len(missing))
+			problems++
+		}
+	}
+
+	if read && len(chunks) > 0 {
+		idKey := chunkIDKey()
+		for name, c := range chunks {
+			rc, err := m.store.Open(name)
+			if err == nil {
+				err = readChunk(ioutil.Discard, rc, idKey, c)
+				rc.Close()
+			}
+			if err != nil {
+				log.Printf("%schunk %s: %s\n", prefix, name, err)
+				problems++
+			}
+		}
+	}
+
+	nrefs := 0
+	for _, n := range refs {
+		nrefs += n
+	}
+	fmt.Printf("%s%d backups, %d chunks referenced %d times, %d unreferenced chunks, %d problems\n", prefix, len(backups), len(refs), nrefs, nchunks-len(chunks), problems)
+	return problems == 0
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// webdav is a destination for a WebDAV share, e.g. Nextcloud or ownCloud.
+type webdav struct {
+	base     *url.URL // path ends with slash
+	user     string   // for basic auth, if not empty
+	password string
+
+	sync.Mutex
+	dirs map[string]bool // subcollections known to exist, e.g. for chunks
+}
+
+var _ destination = &webdav{}
+
+// url returns the full url for path, relative to the base url.
+func (r *webdav) url(path string) string {
+	u := *r.base
+	u.Path += path
+	u.RawPath = ""
+	return u.String()
+}
+
+func (r *webdav) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, r.url(path), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %s", err)
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	return req, nil
+}
+
+// do executes req. If the response status is not one of okStatus, an error is returned and the response is closed.
+func (r *webdav) do(req *http.Request, okStatus ...int) (*http.Response, error) {
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, &httpStatusError{"", okStatus[0], resp.StatusCode, ""}
+}
+
+// List returns the names of the files (not collections) in the base collection, ordered by name.
+func (r *webdav) List() (names []string, err error) {
+	return r.ListDir("")
+}
+
+func (r *webdav) ListDir(dir string) (names []string, err error) {
+	path := ""
+	if dir != "" {
+		path = dir + "/"
+	}
+	body := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+	req, err := r.request("PROPFIND", path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	resp, err := r.do(req, http.StatusMultiStatus)
+	if dir != "" && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", r.base.Path+path, err)
+	}
+	defer resp.Body.Close()
+
+	var multistatus struct {
+		Response []struct {
+			Href     string `xml:"DAV: href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+				} `xml:"DAV: prop"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("parsing directory listing xml: %s", err)
+	}
+	for _, response := range multistatus.Response {
+		u, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("parsing href in directory listing: %s", err)
+		}
+		if !strings.HasPrefix(u.Path, r.base.Path+path) {
+			return nil, fmt.Errorf("listing %s: unexpected path %s", r.base.Path+path, u.Path)
+		}
+		name := u.Path[len(r.base.Path+path):]
+		isCollection := false
+		for _, ps := range response.Propstat {
+			isCollection = isCollection || ps.Prop.ResourceType.Collection != nil
+		}
+		if name == "" || isCollection || strings.HasSuffix(name, "/") || strings.Contains(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *webdav) Open(path string) (rc io.ReadCloser, err error) {
+	return r.OpenRange(path, 0, -1)
+}
+
+func (r *webdav) OpenRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	req, err := r.request("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	expect := http.StatusOK
+	if rng := httpRange(offset, length); rng != "" {
+		req.Header.Set("Range", rng)
+		expect = http.StatusPartialContent
+	}
+	resp, err := r.do(req, expect)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+// Create streams the file to the server in a single PUT request, with chunked transfer encoding.
+func (r *webdav) Create(path string) (w io.WriteCloser, err error) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		if err := r.mkcol(path[:i]); err != nil {
+			return nil, err
+		}
+	}
+	pr, pw := io.Pipe()
+	req, err := r.request("PUT", path, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &pipeWriter{pw, make(chan error, 1)}
+	go func() {
+		resp, err := r.do(req, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+		if err != nil {
+			err = fmt.Errorf("creating %s: %w", path, err)
+			pr.CloseWithError(err)
+			upload.err <- err
+			return
+		}
+		upload.err <- resp.Body.Close()
+	}()
+	return upload, nil
+}
+
+// mkcol creates subcollection dir, unless it is known to exist. A PUT into a
+// missing collection fails, and a streamed request body cannot be sent again.
+func (r *webdav) mkcol(dir string) error {
+	r.Lock()
+	ok := r.dirs[dir]
+	r.Unlock()
+	if ok {
+		return nil
+	}
+	req, err := r.request("MKCOL", dir+"/", nil)
+	if err != nil {
+		return err
+	}
+	// method not allowed means the collection exists
+	resp, err := r.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return fmt.Errorf("creating collection %s: %w", dir, err)
+	}
+	resp.Body.Close()
+	r.Lock()
+	if r.dirs == nil {
+		r.dirs = map[string]bool{}
+	}
+	r.dirs[dir] = true
+	r.Unlock()
+	return nil
+}
+
+// Rename moves the file at the server, replacing an existing file.
+func (r *webdav) Rename(opath, npath string) (err error) {
+	req, err := r.request("MOVE", opath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", r.url(npath))
+	req.Header.Set("Overwrite", "T")
+	resp, err := r.do(req, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("moving %s to %s: %w", opath, npath, err)
+	}
+	return resp.Body.Close()
+}
+
+func (r *webdav) Delete(path string) (err error) {
+	req, err := r.request("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(req, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", path, err)
+	}
+	return resp.Body.Close()
+}
+
+// checkWebdavURL verifies the url is usable as webdav base url.
+func checkWebdavURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("must be an http or https url")
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		return fmt.Errorf("path must end with a slash")
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("must not have a query string, fragment or credentials")
+	}
+	return nil
+}
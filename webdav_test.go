@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebdav is a minimal WebDAV server, for a single collection at base. Files
+// are kept in memory. Subcollections, one level deep, are made with MKCOL.
+type fakeWebdav struct {
+	base     string // path, ends with slash
+	user     string
+	password string
+
+	sync.Mutex
+	files       map[string][]byte // by name relative to base, with the subcollection
+	collections []string          // names of subcollections, listed in the base collection
+	chunkedPuts int               // number of PUT requests with a streamed body
+	down        bool              // if set, all requests fail with a server error
+}
+
+func newFakeWebdav() *fakeWebdav {
+	return &fakeWebdav{
+		base:     "/remote.php/dav/files/user/backups/",
+		user:     "user",
+		password: "secret",
+		files:    map[string][]byte{},
+	}
+}
+
+// name returns the name relative to the base collection for path, which can be
+// in an existing subcollection.
+func (s *fakeWebdav) name(path string) (string, bool) {
+	if !strings.HasPrefix(path, s.base) {
+		return "", false
+	}
+	name := path[len(s.base):]
+	t := strings.Split(name, "/")
+	return name, t[len(t)-1] != "" && (len(t) == 1 || len(t) == 2 && s.collection(t[0]))
+}
+
+func (s *fakeWebdav) collection(name string) bool {
+	for _, c := range s.collections {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeWebdav) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "reading body", http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if user, password, ok := r.BasicAuth(); !ok || user != s.user || password != s.password {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "MKCOL" {
+		dir := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, s.base), "/")
+		if !strings.HasPrefix(r.URL.Path, s.base) || dir == "" || strings.Contains(dir, "/") {
+			http.Error(w, "conflict", http.StatusConflict)
+		} else if s.collection(dir) || s.files[dir] != nil {
+			http.Error(w, "exists", http.StatusMethodNotAllowed)
+		} else {
+			s.collections = append(s.collections, dir)
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+
+	if r.Method == "PROPFIND" {
+		// the base collection, or a subcollection
+		dir := strings.TrimPrefix(r.URL.Path, s.base)
+		if !strings.HasPrefix(r.URL.Path, s.base) || dir != "" && !(strings.HasSuffix(dir, "/") && s.collection(strings.TrimSuffix(dir, "/"))) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Depth") != "1" {
+			http.Error(w, "depth must be 1", http.StatusForbidden)
+			return
+		}
+		if err := xml.Unmarshal(body, &struct{}{}); err != nil {
+			http.Error(w, "bad propfind xml", http.StatusBadRequest)
+			return
+		}
+		type resourceType struct {
+			Collection *struct{} `xml:"D:collection"`
+		}
+		type response struct {
+			Href         string       `xml:"D:href"`
+			ResourceType resourceType `xml:"D:propstat>D:prop>D:resourcetype"`
+			Status       string       `xml:"D:propstat>D:status"`
+		}
+		var ms struct {
+			XMLName  xml.Name   `xml:"D:multistatus"`
+			XMLNS    string     `xml:"xmlns:D,attr"`
+			Response []response `xml:"D:response"`
+		}
+		ms.XMLNS = "DAV:"
+		href := func(name string) string {
+			u := url.URL{Path: s.base + name}
+			return u.EscapedPath()
+		}
+		// the collection itself is listed too, some servers use absolute urls
+		ms.Response = append(ms.Response, response{"http://" + r.Host + href(dir), resourceType{&struct{}{}}, "HTTP/1.1 200 OK"})
+		if dir == "" {
+			for _, name := range s.collections {
+				ms.Response = append(ms.Response, response{href(name + "/"), resourceType{&struct{}{}}, "HTTP/1.1 200 OK"})
+			}
+		}
+		for name := range s.files {
+			if strings.HasPrefix(name, dir) && !strings.Contains(name[len(dir):], "/") {
+				ms.Response = append(ms.Response, response{href(name), resourceType{}, "HTTP/1.1 200 OK"})
+			}
+		}
+		w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+		w.WriteHeader(http.StatusMultiStatus)
+		xml.NewEncoder(w).Encode(ms)
+		return
+	}
+
+	name, ok := s.name(r.URL.Path)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		buf, ok := s.files[name]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		// handles range requests
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	case "PUT":
+		if r.ContentLength < 0 {
+			s.chunkedPuts++
+		}
+		_, exists := s.files[name]
+		s.files[name] = body
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "MOVE":
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || u.Host != r.Host {
+			http.Error(w, "bad destination", http.StatusBadGateway)
+			return
+		}
+		nname, ok := s.name(u.Path)
+		if !ok {
+			http.Error(w, "bad destination", http.StatusConflict)
+			return
+		}
+		buf, ok := s.files[name]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, exists := s.files[nname]
+		if exists && r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		delete(s.files, name)
+		s.files[nname] = buf
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "DELETE":
+		if _, ok := s.files[name]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(s.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebdav(t *testing.T) {
+	fake := newFakeWebdav()
+	fake.collections = []string{"sub dir"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	base, err := url.Parse(server.URL + fake.base)
+	if err != nil {
+		t.Fatalf("parsing url: %s", err)
+	}
+	r := &webdav{base: base, user: fake.user, password: fake.password}
+
+	write := func(path, data string) {
+		t.Helper()
+		w, err := r.Create(path)
+		if err != nil {
+			t.Fatalf("create %s: %s", path, err)
+		}
+		// written in two parts, the request body is streamed
+		if _, err := fmt.Fprint(w, data[:len(data)/2]); err != nil {
+			t.Fatalf("write %s: %s", path, err)
+		}
+		if _, err := fmt.Fprint(w, data[len(data)/2:]); err != nil {
+			t.Fatalf("write %s: %s", path, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close %s: %s", path, err)
+		}
+	}
+
+	data := "0123456789abcdefghijklmnopqrstuvwxyz"
+	write("20171222-0001.data", data)
+	write("20171222-0001.index1.full.tmp", "small+file")
+	write("name with space%", "x")
+	if string(fake.files["20171222-0001.data"]) != data || fake.chunkedPuts != 3 {
+		t.Errorf("files not streamed to server, %d chunked puts", fake.chunkedPuts)
+	}
+
+	names, err := r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	exp := []string{"20171222-0001.data", "20171222-0001.index1.full.tmp", "name with space%"}
+	if strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Errorf("list, got %q, expected %q", names, exp)
+	}
+
+	rc, err := r.OpenRange("20171222-0001.data", 10, 5)
+	if err != nil {
+		t.Fatalf("open range: %s", err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "abcde" {
+		t.Errorf("read range, got %q, %v", buf, err)
+	}
+	rc, err = r.Open("name with space%")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	buf, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(buf) != "x" {
+		t.Errorf("read, got %q, %v", buf, err)
+	}
+
+	// existing files are replaced
+	write("20171222-0001.index1.full", "old")
+	if err := r.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if string(fake.files["20171222-0001.index1.full"]) != "small+file" || fake.files["20171222-0001.index1.full.tmp"] != nil {
+		t.Errorf("unexpected files at server after rename")
+	}
+	if err := r.Rename("20171222-0001.index1.full.tmp", "20171222-0001.index1.full"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rename of missing file, got %v, expected os.ErrNotExist", err)
+	}
+	if _, err := r.Open("20171222-0001.index1.full.tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("open of missing file, got %v, expected os.ErrNotExist", err)
+	}
+
+	if err := r.Delete("name with space%"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := r.Delete("name with space%"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("delete of missing file, got %v, expected os.ErrNotExist", err)
+	}
+	names, err = r.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if exp := "20171222-0001.data,20171222-0001.index1.full"; strings.Join(names, ",") != exp {
+		t.Errorf("list after rename and delete, got %q, expected %q", names, exp)
+	}
+	testDestinationDir(t, r)
+
+	r.password = "bad"
+	if _, err := r.List(); err == nil {
+		t.Errorf("list with bad credentials succeeded")
+	}
+}
+
+// TestWebdavBackups runs the backup tests against the fake WebDAV server.
+func TestWebdavBackups(t *testing.T) {
+	fake := newFakeWebdav()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	setMain := func(c *configuration) {
+		c.Kind = "webdav"
+		c.WebDAV.URL = server.URL + fake.base
+		c.WebDAV.User = fake.user
+		c.WebDAV.Password = fake.password
+		c.Retries = -1 // the server going down is not temporary
+	}
+	testBackups(t, setMain, markDown(fake, &fake.down))
+}
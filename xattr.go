@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// xattr is an extended attribute of a file, such as an SELinux label, file
+// capabilities or a POSIX ACL. They are only stored with config field "xattrs" set.
+type xattr struct {
+	name  string // including namespace, e.g. "security.selinux"
+	value []byte
+}
+
+type xattrError struct {
+	op   string
+	name string
+	err  error
+}
+
+func (e *xattrError) Error() string {
+	return fmt.Sprintf("%s extended attribute %s: %s", e.op, e.name, e.err)
+}
+
+func (e *xattrError) Unwrap() error {
+	return e.err
+}
+
+// xattrNamespace returns the namespace of the attribute, e.g. "security".
+func xattrNamespace(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+func xattrsEqual(a, b []xattr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name != b[i].name || string(a[i].value) != string(b[i].value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// the syscall package has no functions for xattrs of symlinks, so we make the system calls ourselves.
+
+const xattrSupported = true
+
+// readXattrs returns the extended attributes of path, without following symlinks, sorted by name.
+// POSIX ACLs are extended attributes "system.posix_acl_access" and "system.posix_acl_default".
+func readXattrs(path string) ([]xattr, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []byte
+	for {
+		n, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0)
+		if errno == syscall.ENOTSUP {
+			return nil, nil
+		} else if errno != 0 {
+			return nil, errno
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		names = make([]byte, n)
+		n, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&names[0])), uintptr(len(names)))
+		if errno == syscall.ERANGE {
+			// attribute added in the mean time
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		names = names[:n]
+		break
+	}
+
+	var l []xattr
+	for _, name := range strings.Split(strings.TrimSuffix(string(names), "\x00"), "\x00") {
+		if name == "" || strings.Contains(name, "\n") {
+			// cannot be stored in the index
+			continue
+		}
+		value, err := lgetxattr(p, name)
+		if err == syscall.ENODATA {
+			// removed in the mean time
+			continue
+		} else if err != nil {
+			return nil, &xattrError{"reading", name, err}
+		}
+		l = append(l, xattr{name, value})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].name < l[j].name
+	})
+	return l, nil
+}
+
+func lgetxattr(p *byte, name string) ([]byte, error) {
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		size, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+		if errno == syscall.ERANGE {
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		return buf[:size], nil
+	}
+}
+
+// xattrNotPermitted returns whether writing an attribute failed because the user
+// may not set it, e.g. in namespace "trusted" when not root, or because the
+// file or file system doesn't support it, e.g. "user" attributes on symlinks.
+func xattrNotPermitted(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP)
+}
+
+// writeXattr sets an extended attribute of path, without following symlinks.
+func writeXattr(path string, x xattr) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(x.name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(x.value) > 0 {
+		v = unsafe.Pointer(&x.value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(x.value)), 0, 0)
+	if errno != 0 {
+		return &xattrError{"writing", x.name, errno}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	userXattr := func(path string) string {
+		t.Helper()
+		l, err := readXattrs(path)
+		tcheck(t, err, "reading xattrs")
+		for _, x := range l {
+			if x.name == "user.test" {
+				return string(x.value)
+			}
+		}
+		return ""
+	}
+
+	os.RemoveAll("testdir")
+	writeTestFiles(t, "testdir/workdir", map[string]string{"file": "data"})
+	err := writeXattr("testdir/workdir/file", xattr{"user.test", []byte("value 1")})
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("file system does not support user extended attributes")
+	}
+	tcheck(t, err, "setting xattr")
+	tcheck(t, writeXattr("testdir/workdir", xattr{"user.test", []byte("dir")}), "setting xattr")
+	setupTestConfig(t, configuration{Xattrs: true, IncrementalsPerFull: 2})
+
+	backupCmd([]string{"testdir/workdir"}, "20171222-0001")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if v := userXattr("testdir/restore/file"); v != "value 1" {
+		t.Errorf("restored xattr of file, got %q", v)
+	}
+	if v := userXattr("testdir/restore"); v != "dir" {
+		t.Errorf("restored xattr of dir, got %q", v)
+	}
+
+	// a changed xattr makes an incremental backup store the file
+	tcheck(t, writeXattr("testdir/workdir/file", xattr{"user.test", []byte("value 2")}), "setting xattr")
+	backupCmd([]string{"testdir/workdir"}, "20171222-0002")
+	tcheck(t, os.RemoveAll("testdir/restore"), "removing restore dir")
+	restoreCmd([]string{"-quiet", "testdir/restore"})
+	if v := userXattr("testdir/restore/file"); v != "value 2" {
+		t.Errorf("restored xattr of file, got %q", v)
+	}
+
+	restoreCmd([]string{"-quiet", "-xattr-skip", "trusted,user", "testdir/restore-skip"})
+	if v := userXattr("testdir/restore-skip/file"); v != "" {
+		t.Errorf("skipped namespace restored, got %q", v)
+	}
+
+	// attributes that cannot be set, like "user" attributes on symlinks, are
+	// skipped with a warning. The index is changed to have one.
+	tcheck(t, os.Symlink("file", "testdir/workdir/link"), "creating symlink")
+	setupTestConfig(t, configuration{Xattrs: true})
+	backupCmd([]string{"testdir/workdir"}, "20171222-0003")
+	idx := latestIndex(t)
+	for _, f := range idx.contents {
+		if f.name == "link" {
+			f.xattrs = []xattr{{"user.test", []byte("link")}}
+		}
+	}
+	f, err := store.Create("20171222-0003.index1.full")
+	tcheck(t, err, "creating index")
+	sf, err := newSafeWriter(f)
+	tcheck(t, err, "creating safe file")
+	tcheck(t, writeIndex(sf, idx), "writing index")
+	tcheck(t, sf.Close(), "closing index")
+	restoreCmd([]string{"-quiet", "testdir/restore-link"})
+	if v := userXattr("testdir/restore-link/file"); v != "value 2" {
+		t.Errorf("restored xattr of file next to symlink, got %q", v)
+	}
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+const xattrSupported = false
+
+// readXattrs returns no extended attributes, they are only supported on Linux.
+func readXattrs(path string) ([]xattr, error) {
+	return nil, nil
+}
+
+func writeXattr(path string, x xattr) error {
+	return errors.New("extended attributes not supported on this system")
+}
+
+func xattrNotPermitted(err error) bool {
+	return false
+}